@@ -7,8 +7,10 @@
 package exec
 
 import (
+	"context"
 	"io"
 	"os/exec"
+	"time"
 )
 
 // ExecuteOptions specify parameters to the Execute method.
@@ -20,6 +22,10 @@ type ExecuteOptions struct {
 	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
+	// Timeout bounds the execution of the command. When it expires the
+	// subprocess is killed and Execute returns an error. Zero means no
+	// limit.
+	Timeout time.Duration
 }
 
 type Executor interface {
@@ -30,7 +36,13 @@ type Executor interface {
 type OsExecutor struct{}
 
 func (OsExecutor) Execute(opts ExecuteOptions) error {
-	c := exec.Command(opts.Cmd, opts.Args...)
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	c := exec.CommandContext(ctx, opts.Cmd, opts.Args...)
 	c.Stdin = opts.Stdin
 	c.Stdout = opts.Stdout
 	c.Stderr = opts.Stderr
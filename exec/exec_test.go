@@ -7,6 +7,7 @@ package exec
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	"github.com/tsuru/commandmocker"
 	check "gopkg.in/check.v1"
@@ -59,3 +60,19 @@ func (s *S) TestExecuteWithoutArgs(c *check.C) {
 	c.Assert(commandmocker.Parameters(tmpdir), check.IsNil)
 	c.Assert(b.String(), check.Equals, "ok")
 }
+
+func (s *S) TestExecuteTimeoutKillsCommand(c *check.C) {
+	var e OsExecutor
+	var b bytes.Buffer
+	opts := ExecuteOptions{
+		Cmd:     "sleep",
+		Args:    []string{"30"},
+		Stdout:  &b,
+		Stderr:  &b,
+		Timeout: 100 * time.Millisecond,
+	}
+	start := time.Now()
+	err := e.Execute(opts)
+	c.Assert(err, check.NotNil)
+	c.Assert(time.Since(start) < 10*time.Second, check.Equals, true)
+}
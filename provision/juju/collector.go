@@ -0,0 +1,802 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/provision"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Statuses reported for units whose machine is still being prepared by the
+// cloud provider. They complement the statuses defined in the provision
+// package, in the same vein as StatusDown.
+const (
+	StatusCreating   = provision.Status("creating")
+	StatusInstalling = provision.Status("installing")
+)
+
+var charmRegexp = regexp.MustCompile(`^(?:(?:local|cs):)?(?:(\w+)/)?(\w+)-\d+$`)
+
+type jujuMachine struct {
+	AgentState     string                 `yaml:"agent-state"`
+	InstanceID     string                 `yaml:"instance-id"`
+	InstanceState  string                 `yaml:"instance-state"`
+	DNSName        string                 `yaml:"dns-name"`
+	PrivateDNSName string                 `yaml:"private-dns-name"`
+	Containers     map[string]jujuMachine `yaml:"containers"`
+}
+
+type jujuUnit struct {
+	AgentState string     `yaml:"agent-state"`
+	Machine    machineRef `yaml:"machine"`
+}
+
+// machineRef identifies the machine hosting a unit in juju status output.
+// It's either a flat machine number ("105") or a container path ("105/lxc/0")
+// when the unit runs inside an LXC container nested in a machine.
+type machineRef string
+
+func (m *machineRef) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*m = machineRef(s)
+		return nil
+	}
+	var n int
+	err := unmarshal(&n)
+	if err != nil {
+		return err
+	}
+	*m = machineRef(strconv.Itoa(n))
+	return nil
+}
+
+// number returns the number of the (host) machine.
+func (m machineRef) number() int {
+	ref := string(m)
+	if i := strings.Index(ref, "/"); i >= 0 {
+		ref = ref[:i]
+	}
+	n, _ := strconv.Atoi(ref)
+	return n
+}
+
+// container returns the full container path, or an empty string for units
+// running directly on a machine.
+func (m machineRef) container() string {
+	if strings.Contains(string(m), "/") {
+		return string(m)
+	}
+	return ""
+}
+
+type jujuService struct {
+	Charm string              `yaml:"charm"`
+	Units map[string]jujuUnit `yaml:"units"`
+}
+
+type jujuOutput struct {
+	Machines map[int]jujuMachine    `yaml:"machines"`
+	Services map[string]jujuService `yaml:"services"`
+}
+
+const defaultStatusTimeout = 120 * time.Second
+
+// statusTimeout returns how long CollectStatus waits for "juju status" before
+// giving up, as defined by the juju:status-timeout setting (in seconds).
+func statusTimeout() time.Duration {
+	seconds, err := config.GetInt("juju:status-timeout")
+	if err != nil {
+		return defaultStatusTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// statusCall is one in-flight CollectStatus run; done is closed once units
+// and err are set.
+type statusCall struct {
+	done  chan struct{}
+	units []provision.Unit
+	err   error
+}
+
+// statusFlight dedups concurrent CollectStatus runs. While one "juju status"
+// is in flight, further callers wait for and share its result instead of
+// spawning a second process racing on the units collection.
+var statusFlight struct {
+	sync.Mutex
+	inflight *statusCall
+}
+
+// CollectStatus runs "juju status", maps every unit in the environment to a
+// provision.Unit and synchronizes the units collection with what juju
+// reported. The status command runs under a timeout so a hung juju doesn't
+// block the monitoring loop forever. Concurrent callers share a single run.
+func (p *jujuProvisioner) CollectStatus() ([]provision.Unit, error) {
+	statusFlight.Lock()
+	if call := statusFlight.inflight; call != nil {
+		statusFlight.Unlock()
+		<-call.done
+		return call.units, call.err
+	}
+	call := &statusCall{done: make(chan struct{})}
+	statusFlight.inflight = call
+	statusFlight.Unlock()
+	call.units, call.err = p.collectStatus()
+	statusFlight.Lock()
+	statusFlight.inflight = nil
+	statusFlight.Unlock()
+	close(call.done)
+	return call.units, call.err
+}
+
+func (p *jujuProvisioner) collectStatus() ([]provision.Unit, error) {
+	start := time.Now()
+	defer func() { recordCollectStatusDuration(time.Since(start)) }()
+	var buf bytes.Buffer
+	err := execWithTimeout(statusTimeout(), &buf, &buf, "status")
+	if err != nil {
+		return nil, &provision.Error{Reason: buf.String(), Err: err}
+	}
+	output, err := parseStatus(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	services, err := serviceApps()
+	if err != nil {
+		return nil, err
+	}
+	units, insts := unitsFromStatus(output, services)
+	attachInstanceTags(units, insts)
+	err = p.syncInstances(insts)
+	if err != nil {
+		return nil, err
+	}
+	applyELBStatus(units, insts)
+	return units, nil
+}
+
+// CollectStatusApp is the single-app variant of CollectStatus. It runs
+// "juju status" scoped to the app's service, so the API can refresh one app
+// on demand without scanning every service in the environment.
+func (p *jujuProvisioner) CollectStatusApp(app provision.App) ([]provision.Unit, error) {
+	serviceName, err := jujuServiceName(app.GetName())
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	args := append(environmentArgs(appEnvironment(app)), "status", serviceName)
+	err = execWithTimeout(statusTimeout(), &buf, &buf, args...)
+	if err != nil {
+		return nil, &provision.Error{Reason: buf.String(), Err: err}
+	}
+	output, err := parseStatus(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	units, insts := unitsFromStatus(output, map[string]serviceInfo{serviceName: {app: app.GetName()}})
+	err = p.syncInstances(insts)
+	if err != nil {
+		return nil, err
+	}
+	applyELBStatus(units, insts)
+	return units, nil
+}
+
+// CollectStatusApps refreshes the status of several apps with a single
+// "juju status" run, filtering the output in memory to just the requested
+// apps. With hundreds of apps this balances one expensive call against
+// targeted results: per-app calls are too chatty, and the full environment
+// too big to hand back. Units are keyed by app name; apps without units are
+// absent from the returned map.
+func (p *jujuProvisioner) CollectStatusApps(apps []provision.App) (map[string][]provision.Unit, error) {
+	wanted := make(map[string]struct{}, len(apps))
+	for _, app := range apps {
+		wanted[app.GetName()] = struct{}{}
+	}
+	var buf bytes.Buffer
+	err := execWithTimeout(statusTimeout(), &buf, &buf, "status")
+	if err != nil {
+		return nil, &provision.Error{Reason: buf.String(), Err: err}
+	}
+	output, err := parseStatus(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	services, err := serviceApps()
+	if err != nil {
+		return nil, err
+	}
+	units, insts := unitsFromStatus(output, services)
+	filtered := insts[:0]
+	for _, inst := range insts {
+		if _, ok := wanted[inst.AppName]; ok {
+			filtered = append(filtered, inst)
+		}
+	}
+	err = p.syncInstances(filtered)
+	if err != nil {
+		return nil, err
+	}
+	// The filtered instances are no longer index-aligned with the units, so
+	// the ELB degradation computed by syncInstances is mirrored back by unit
+	// name instead of through applyELBStatus.
+	degraded := make(map[string]struct{})
+	for _, inst := range filtered {
+		if inst.Status == StatusDegraded.String() {
+			degraded[inst.UnitName] = struct{}{}
+		}
+	}
+	result := make(map[string][]provision.Unit)
+	// Services deployed but not scaled up yet have no units; they still show
+	// up in the result, with an empty unit list, so callers can tell
+	// "provisioned but scaling" apart from "unknown app".
+	for serviceName := range output.Services {
+		info := serviceInfoFor(services, serviceName)
+		if _, ok := wanted[info.app]; ok {
+			result[info.app] = []provision.Unit{}
+		}
+	}
+	for _, unit := range units {
+		if _, ok := wanted[unit.AppName]; ok {
+			if _, ok := degraded[unit.Name]; ok {
+				unit.Status = StatusDegraded
+			}
+			result[unit.AppName] = append(result[unit.AppName], unit)
+		}
+	}
+	return result, nil
+}
+
+// ReconcileInstances persists what "juju status" reports — machines,
+// addresses, statuses and instance id changes — without building the unit
+// slice that CollectStatus returns, saving allocations on the monitoring hot
+// path.
+func (p *jujuProvisioner) ReconcileInstances() error {
+	var buf bytes.Buffer
+	err := execWithTimeout(statusTimeout(), &buf, &buf, "status")
+	if err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	output, err := parseStatus(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	services, err := serviceApps()
+	if err != nil {
+		return err
+	}
+	return p.syncInstances(instancesFromStatus(output, services))
+}
+
+// syncInstances runs the persistence side of status collection: duplicate
+// instance id resolution, ELB health annotation and the collection update.
+func (p *jujuProvisioner) syncInstances(insts []instance) error {
+	insts, err := p.dedupInstances(insts)
+	if err != nil {
+		return err
+	}
+	if p.elbSupport() {
+		p.attachELBHealth(insts)
+	}
+	return p.saveInstances(insts)
+}
+
+// statusFieldNames are the stock juju field names that can be remapped via
+// configuration for juju variants that label them differently.
+var statusFieldNames = []string{
+	"agent-state",
+	"instance-id",
+	"instance-state",
+	"dns-name",
+	"private-dns-name",
+}
+
+// statusFieldAliases returns the field names used by the local juju variant
+// for each stock field, from the juju:status-fields:<stock-name> settings.
+// An empty map means the output uses the stock names and needs no rewrite.
+func statusFieldAliases() map[string]string {
+	aliases := make(map[string]string)
+	for _, field := range statusFieldNames {
+		if alias, err := config.GetString("juju:status-fields:" + field); err == nil && alias != "" && alias != field {
+			aliases[field] = alias
+		}
+	}
+	return aliases
+}
+
+// normalizeStatusYAML rewrites the configured field aliases back to the stock
+// juju names, so the parser only ever deals with one vocabulary. The rewrite
+// is line-based, matching keys at the start of a line, which is how juju
+// emits its YAML.
+func normalizeStatusYAML(data []byte) []byte {
+	for field, alias := range statusFieldAliases() {
+		re := regexp.MustCompile(`(?m)^(\s*)` + regexp.QuoteMeta(alias) + `:`)
+		data = re.ReplaceAll(data, []byte("${1}"+field+":"))
+	}
+	return data
+}
+
+// yamlErrorLineRegexp extracts the line number from the errors of the yaml
+// decoder ("yaml: line 3: ..." from the parser, "line 3: ..." entries from
+// unmarshal type errors).
+var yamlErrorLineRegexp = regexp.MustCompile(`line (\d+):`)
+
+// yamlErrorSnippet renders the line the yaml decoder complained about with a
+// couple of lines of context, so parse failures stay debuggable without
+// dumping the whole status output into the error.
+func yamlErrorSnippet(data []byte, err error) string {
+	matches := yamlErrorLineRegexp.FindStringSubmatch(err.Error())
+	if matches == nil {
+		return ""
+	}
+	lineNo, _ := strconv.Atoi(matches[1])
+	lines := strings.Split(string(data), "\n")
+	if lineNo < 1 || lineNo > len(lines) {
+		return ""
+	}
+	start := lineNo - 1
+	if start < 1 {
+		start = 1
+	}
+	end := lineNo + 1
+	if end > len(lines) {
+		end = len(lines)
+	}
+	var buf bytes.Buffer
+	for i := start; i <= end; i++ {
+		marker := "   "
+		if i == lineNo {
+			marker = ">> "
+		}
+		fmt.Fprintf(&buf, "%s%d | %s\n", marker, i, lines[i-1])
+	}
+	return buf.String()
+}
+
+func parseStatus(data []byte) (jujuOutput, error) {
+	var output jujuOutput
+	normalized := normalizeStatusYAML(data)
+	err := yaml.Unmarshal(normalized, &output)
+	if err != nil {
+		reason := `"juju status" returned invalid YAML`
+		if snippet := yamlErrorSnippet(normalized, err); snippet != "" {
+			reason += ", near:\n" + snippet
+		}
+		return output, &provision.Error{Reason: reason, Err: err}
+	}
+	return output, nil
+}
+
+// serviceInfo identifies the app (and the app process, for services deployed
+// by ProvisionProcess) behind a juju service name.
+type serviceInfo struct {
+	app     string
+	process string
+}
+
+// serviceApps returns the service-name to app mapping recorded in the units
+// collection, so status output can be mapped back to apps whose names were
+// normalized for juju and to the process each service backs.
+func serviceApps() (map[string]serviceInfo, error) {
+	coll, err := unitsCollection()
+	if err != nil {
+		return nil, err
+	}
+	defer coll.Close()
+	var insts []instance
+	err = coll.Find(bson.M{"service": bson.M{"$ne": ""}}).Select(bson.M{"app": 1, "service": 1, "process": 1}).All(&insts)
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string]serviceInfo, len(insts))
+	for _, inst := range insts {
+		services[inst.Service] = serviceInfo{app: inst.AppName, process: inst.Process}
+	}
+	return services, nil
+}
+
+// resolveMachine finds the machine (or nested container) hosting the unit in
+// the status output.
+func resolveMachine(output jujuOutput, u jujuUnit) jujuMachine {
+	machine := output.Machines[u.Machine.number()]
+	if container := u.Machine.container(); container != "" {
+		machine = machine.Containers[container]
+	}
+	return machine
+}
+
+// statusInstance maps one unit from the status output to its instance
+// document.
+func statusInstance(serviceName string, info serviceInfo, unitName string, u jujuUnit, machine jujuMachine) instance {
+	return instance{
+		UnitName:       unitName,
+		AppName:        info.app,
+		Service:        serviceName,
+		Process:        info.process,
+		Machine:        u.Machine.number(),
+		Container:      u.Machine.container(),
+		InstanceID:     machine.InstanceID,
+		PublicAddress:  machine.DNSName,
+		PrivateAddress: machine.PrivateDNSName,
+		Status:         unitStatus(machine.InstanceState, u.AgentState, machine.AgentState).String(),
+	}
+}
+
+func serviceInfoFor(services map[string]serviceInfo, serviceName string) serviceInfo {
+	if info, ok := services[serviceName]; ok {
+		return info
+	}
+	return serviceInfo{app: appNameFromService(serviceName)}
+}
+
+func unitsFromStatus(output jujuOutput, services map[string]serviceInfo) ([]provision.Unit, []instance) {
+	var units []provision.Unit
+	var insts []instance
+	for serviceName, service := range output.Services {
+		info := serviceInfoFor(services, serviceName)
+		for unitName, u := range service.Units {
+			machine := resolveMachine(output, u)
+			inst := statusInstance(serviceName, info, unitName, u, machine)
+			unit := provision.Unit{
+				ID:          unitName,
+				Name:        unitName,
+				AppName:     info.app,
+				ProcessName: info.process,
+				IP:          machine.DNSName,
+				Status:      provision.Status(inst.Status),
+			}
+			if matches := charmRegexp.FindStringSubmatch(service.Charm); matches != nil {
+				unit.Type = matches[2]
+				inst.Type = matches[2]
+			}
+			units = append(units, unit)
+			insts = append(insts, inst)
+		}
+	}
+	return units, insts
+}
+
+// instancesFromStatus is the allocation-light sibling of unitsFromStatus,
+// used by ReconcileInstances, which doesn't need the unit slice.
+func instancesFromStatus(output jujuOutput, services map[string]serviceInfo) []instance {
+	var insts []instance
+	for serviceName, service := range output.Services {
+		info := serviceInfoFor(services, serviceName)
+		for unitName, u := range service.Units {
+			insts = append(insts, statusInstance(serviceName, info, unitName, u, resolveMachine(output, u)))
+		}
+	}
+	return insts
+}
+
+func unitStatus(instanceState, agentState, machineAgentState string) provision.Status {
+	switch {
+	case instanceState == "error" || agentState == "install-error" || machineAgentState == "start-error":
+		return provision.StatusError
+	case machineAgentState == "pending" || machineAgentState == "not-started" || machineAgentState == "":
+		return StatusCreating
+	case instanceState == "pending":
+		return StatusCreating
+	case agentState == "down":
+		return StatusDown
+	case machineAgentState == "running" && agentState == "not-started":
+		return StatusCreating
+	case machineAgentState == "running" && instanceState == "running" && agentState == "pending":
+		return StatusInstalling
+	case machineAgentState == "running" && agentState == "started" && instanceState == "running":
+		return provision.StatusStarted
+	}
+	return StatusCreating
+}
+
+// dedupInstances drops duplicated instance ids reported in a single status
+// run. During machine churn juju may briefly list the same instance backing
+// two different units, which would make the instance id change detection fire
+// spuriously. The unit that already owns the id in the units collection is
+// kept; the id is cleared from the others.
+func (p *jujuProvisioner) dedupInstances(insts []instance) ([]instance, error) {
+	byID := make(map[string][]int)
+	for i, inst := range insts {
+		if inst.InstanceID != "" {
+			byID[inst.InstanceID] = append(byID[inst.InstanceID], i)
+		}
+	}
+	coll, err := unitsCollection()
+	if err != nil {
+		return nil, err
+	}
+	defer coll.Close()
+	for id, indexes := range byID {
+		if len(indexes) < 2 {
+			continue
+		}
+		keep := indexes[0]
+		var stored instance
+		err = coll.Find(bson.M{"instanceid": id}).One(&stored)
+		if err == nil {
+			for _, i := range indexes {
+				if insts[i].UnitName == stored.UnitName {
+					keep = i
+					break
+				}
+			}
+		} else if err != mgo.ErrNotFound {
+			return nil, err
+		}
+		for _, i := range indexes {
+			if i == keep {
+				continue
+			}
+			log.Errorf("juju: instance %q reported for both %q and %q, keeping %q", id, insts[keep].UnitName, insts[i].UnitName, insts[keep].UnitName)
+			insts[i].InstanceID = ""
+		}
+	}
+	return insts, nil
+}
+
+// defaultELBUnhealthyThreshold mirrors the ELB default: two consecutive
+// failed checks take an instance out of service.
+const defaultELBUnhealthyThreshold = 2
+
+// elbUnhealthyThreshold returns how many consecutive failed health checks
+// mark an instance fully unhealthy, from juju:elb:unhealthy-threshold.
+// Started units failing for fewer checks than that are reported as degraded.
+func elbUnhealthyThreshold() int {
+	threshold, err := config.GetInt("juju:elb:unhealthy-threshold")
+	if err != nil || threshold < 1 {
+		return defaultELBUnhealthyThreshold
+	}
+	return threshold
+}
+
+// storedFailedChecks loads the consecutive failed check counters stored for
+// the given instances, keyed by unit name. Lookup failures are logged and
+// yield an empty map, restarting the counters.
+func storedFailedChecks(insts []instance) map[string]int {
+	names := make([]string, 0, len(insts))
+	for _, inst := range insts {
+		if inst.InstanceID != "" {
+			names = append(names, inst.UnitName)
+		}
+	}
+	counts := make(map[string]int, len(names))
+	if len(names) == 0 {
+		return counts
+	}
+	coll, err := unitsCollection()
+	if err != nil {
+		log.Errorf("juju: failed to load failed check counters: %s", err)
+		return counts
+	}
+	defer coll.Close()
+	var stored []instance
+	err = coll.Find(bson.M{"_id": bson.M{"$in": names}}).Select(bson.M{"elbfailedchecks": 1}).All(&stored)
+	if err != nil {
+		log.Errorf("juju: failed to load failed check counters: %s", err)
+		return counts
+	}
+	for _, inst := range stored {
+		counts[inst.UnitName] = inst.ELBFailedChecks
+	}
+	return counts
+}
+
+// attachELBHealth fills the ELB health fields of each instance with the state
+// reported by DescribeInstanceHealth, so operators can see why an instance is
+// OutOfService without calling AWS themselves. Started units failing their
+// checks for fewer consecutive collections than the unhealthy threshold are
+// downgraded to degraded. Health lookup failures are logged and don't abort
+// the status collection.
+func (p *jujuProvisioner) attachELBHealth(insts []instance) {
+	manager := p.LoadBalancer()
+	threshold := elbUnhealthyThreshold()
+	failed := storedFailedChecks(insts)
+	apps := make(map[string]map[string]*elb.InstanceState)
+	for i := range insts {
+		inst := &insts[i]
+		if inst.InstanceID == "" {
+			continue
+		}
+		states, ok := apps[inst.AppName]
+		if !ok {
+			var err error
+			states, err = manager.instanceHealth(inst.AppName)
+			if err != nil {
+				if err != ErrLoadBalancerNotFound {
+					log.Errorf("juju: failed to get ELB health of app %q: %s", inst.AppName, err)
+				}
+				states = nil
+			}
+			apps[inst.AppName] = states
+		}
+		state := states[inst.InstanceID]
+		if state == nil || state.State == nil {
+			continue
+		}
+		inst.ELBState = *state.State
+		if *state.State == "InService" {
+			continue
+		}
+		inst.ELBFailedChecks = failed[inst.UnitName] + 1
+		if *state.State == "OutOfService" {
+			inst.ELBReasonCode = aws.StringValue(state.ReasonCode)
+			inst.ELBDescription = aws.StringValue(state.Description)
+		}
+		if inst.Status == provision.StatusStarted.String() && inst.ELBFailedChecks < threshold {
+			inst.Status = StatusDegraded.String()
+		}
+	}
+}
+
+// applyELBStatus copies the health-derived statuses — degraded units — from
+// the synchronized instances back into the unit slice handed to callers. The
+// two slices are index-aligned, both built by unitsFromStatus.
+func applyELBStatus(units []provision.Unit, insts []instance) {
+	for i := range insts {
+		if insts[i].Status == StatusDegraded.String() {
+			units[i].Status = StatusDegraded
+		}
+	}
+}
+
+// defaultStuckDeadline is how long a unit may sit in a provisioning status
+// before ReapStuck flags it, when no deadline is given or configured.
+const defaultStuckDeadline = 30 * time.Minute
+
+// ReapStuck flags as error the units that sat in a provisioning status —
+// creating or installing — for longer than the deadline, so failed cloud-init
+// runs don't look like units that are still booting. A non-positive deadline
+// falls back to juju:reap-stuck-deadline (in seconds) and then to the
+// default. It returns how many units were flagged.
+func (p *jujuProvisioner) ReapStuck(deadline time.Duration) (int, error) {
+	if deadline <= 0 {
+		if seconds, err := config.GetInt("juju:reap-stuck-deadline"); err == nil {
+			deadline = time.Duration(seconds) * time.Second
+		} else {
+			deadline = defaultStuckDeadline
+		}
+	}
+	coll, err := unitsCollection()
+	if err != nil {
+		return 0, err
+	}
+	defer coll.Close()
+	cutoff := time.Now().UTC().Add(-deadline)
+	change, err := coll.UpdateAll(bson.M{
+		"status":    bson.M{"$in": []string{StatusCreating.String(), StatusInstalling.String()}},
+		"createdat": bson.M{"$lt": cutoff},
+	}, bson.M{"$set": bson.M{"status": provision.StatusError.String()}})
+	if err != nil {
+		return 0, err
+	}
+	if change.Updated > 0 {
+		log.Debugf("juju: event=reap-stuck count=%d deadline=%s", change.Updated, deadline)
+	}
+	return change.Updated, nil
+}
+
+// maybeEnqueueRestart schedules a restart of a unit whose instance id
+// rotated, but only when the app's current config hash differs from the one
+// the unit last applied. A machine replaced under unchanged config — the
+// common case for spot reclaims — keeps running without a needless restart.
+// Frozen units are left alone: freezing exists precisely to suppress this
+// kind of side effect during maintenance.
+// Enqueue failures are logged: the next restart or reconciliation catches up.
+func (p *jujuProvisioner) maybeEnqueueRestart(inst instance) {
+	desired, err := storedAppConfigHash(inst.AppName)
+	if err != nil {
+		log.Errorf("juju: failed to load config hash of app %q: %s", inst.AppName, err)
+		return
+	}
+	if desired == "" {
+		return
+	}
+	coll, err := unitsCollection()
+	if err != nil {
+		log.Errorf("juju: failed to load config hash of unit %q: %s", inst.UnitName, err)
+		return
+	}
+	defer coll.Close()
+	var stored instance
+	err = coll.FindId(inst.UnitName).Select(bson.M{"confighash": 1, "frozen": 1}).One(&stored)
+	if err != nil {
+		log.Errorf("juju: failed to load config hash of unit %q: %s", inst.UnitName, err)
+		return
+	}
+	if stored.Frozen || stored.ConfigHash == desired {
+		return
+	}
+	if err = enqueueUnitRestart(inst.AppName, inst.UnitName, desired); err != nil {
+		log.Errorf("juju: failed to enqueue restart of unit %q: %s", inst.UnitName, err)
+	}
+}
+
+func (p *jujuProvisioner) saveInstances(insts []instance) error {
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	for _, inst := range insts {
+		// The status update is conditional on the stored value differing and
+		// runs as a findAndModify, so the change (and the old status) can be
+		// detected atomically without a racy find-then-update.
+		var stored instance
+		_, err := coll.Find(bson.M{"_id": inst.UnitName, "status": bson.M{"$ne": inst.Status}}).Apply(mgo.Change{
+			Update: bson.M{"$set": bson.M{"status": inst.Status}},
+		}, &stored)
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		if err == nil {
+			log.Debugf("juju: event=status-change app=%s unit=%s machine=%d from=%s to=%s frozen=%v", inst.AppName, inst.UnitName, inst.Machine, stored.Status, inst.Status, stored.Frozen)
+			if !stored.Frozen {
+				change := statusChange{
+					Unit:      inst.UnitName,
+					App:       inst.AppName,
+					Machine:   inst.Machine,
+					OldStatus: stored.Status,
+					NewStatus: inst.Status,
+				}
+				spawn(func() { notifyStatusChange(change) })
+			}
+		}
+		update := bson.M{
+			"machine":         inst.Machine,
+			"service":         inst.Service,
+			"container":       inst.Container,
+			"publicaddress":   inst.PublicAddress,
+			"privateaddress":  inst.PrivateAddress,
+			"status":          inst.Status,
+			"type":            inst.Type,
+			"process":         inst.Process,
+			"elbstate":        inst.ELBState,
+			"elbreasoncode":   inst.ELBReasonCode,
+			"elbdescription":  inst.ELBDescription,
+			"elbfailedchecks": inst.ELBFailedChecks,
+		}
+		_, err = coll.UpsertId(inst.UnitName, bson.M{
+			"$set": update,
+			"$setOnInsert": bson.M{
+				"app":        inst.AppName,
+				"instanceid": inst.InstanceID,
+				"createdat":  time.Now().UTC(),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if inst.InstanceID == "" {
+			continue
+		}
+		change, err := coll.UpdateAll(
+			bson.M{"_id": inst.UnitName, "instanceid": bson.M{"$ne": inst.InstanceID}},
+			bson.M{"$set": bson.M{"instanceid": inst.InstanceID}},
+		)
+		if err != nil {
+			return err
+		}
+		if change.Updated > 0 {
+			log.Debugf("juju: event=instance-id-change app=%s unit=%s instanceid=%s", inst.AppName, inst.UnitName, inst.InstanceID)
+			p.maybeEnqueueRestart(inst)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,770 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/tsuru/tsuru/exec"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/exec/exectest"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	check "gopkg.in/check.v1"
+)
+
+const collectOutput = `machines:
+  0:
+    agent-state: running
+    dns-name: 192.168.0.10
+    instance-id: i-00000zz5
+    instance-state: running
+  1:
+    agent-state: running
+    dns-name: 192.168.0.11
+    instance-id: i-00000zz6
+    instance-state: running
+services:
+  as_i_rise:
+    charm: local:python-11
+    units:
+      as_i_rise/0:
+        agent-state: started
+        machine: 0
+  the_infanta:
+    charm: local:ruby-22
+    units:
+      the_infanta/0:
+        agent-state: started
+        machine: 1
+`
+
+func (s *S) TestParseStatus(c *check.C) {
+	output, err := parseStatus([]byte(collectOutput))
+	c.Assert(err, check.IsNil)
+	c.Assert(output.Machines, check.HasLen, 2)
+	c.Assert(output.Machines[0].InstanceID, check.Equals, "i-00000zz5")
+	c.Assert(output.Services, check.HasLen, 2)
+	c.Assert(output.Services["as_i_rise"].Charm, check.Equals, "local:python-11")
+	c.Assert(output.Services["as_i_rise"].Units["as_i_rise/0"].Machine, check.Equals, machineRef("0"))
+}
+
+func (s *S) TestParseStatusInvalidYAML(c *check.C) {
+	_, err := parseStatus([]byte("local: somewhere::"))
+	c.Assert(err, check.NotNil)
+	pErr, ok := err.(*provision.Error)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(pErr.Reason, check.Matches, `(?s)"juju status" returned invalid YAML.*`)
+}
+
+func (s *S) TestUnitStatus(c *check.C) {
+	var tests = []struct {
+		instance string
+		agent    string
+		machine  string
+		expected provision.Status
+	}{
+		{"running", "started", "running", provision.StatusStarted},
+		{"error", "started", "running", provision.StatusError},
+		{"running", "install-error", "running", provision.StatusError},
+		{"running", "started", "start-error", provision.StatusError},
+		{"running", "started", "pending", StatusCreating},
+		{"running", "started", "not-started", StatusCreating},
+		{"running", "started", "", StatusCreating},
+		{"pending", "started", "running", StatusCreating},
+		{"running", "not-started", "running", StatusCreating},
+		{"running", "pending", "running", StatusInstalling},
+		{"running", "down", "running", StatusDown},
+	}
+	for _, t := range tests {
+		got := unitStatus(t.instance, t.agent, t.machine)
+		c.Check(got, check.Equals, t.expected)
+	}
+}
+
+func (s *S) TestUnitsFromStatus(c *check.C) {
+	output, err := parseStatus([]byte(collectOutput))
+	c.Assert(err, check.IsNil)
+	units, insts := unitsFromStatus(output, nil)
+	c.Assert(units, check.HasLen, 2)
+	c.Assert(insts, check.HasLen, 2)
+	sort.Slice(units, func(i, j int) bool { return units[i].Name < units[j].Name })
+	c.Assert(units[0].Name, check.Equals, "as_i_rise/0")
+	c.Assert(units[0].AppName, check.Equals, "as_i_rise")
+	c.Assert(units[0].Type, check.Equals, "python")
+	c.Assert(units[0].IP, check.Equals, "192.168.0.10")
+	c.Assert(units[0].Status, check.Equals, provision.StatusStarted)
+}
+
+func (s *S) TestCollectStatus(c *check.C) {
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(collectOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	units, err := p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	c.Assert(units, check.HasLen, 2)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"status"}), check.Equals, true)
+	inst := s.getInstance(c, "as_i_rise/0")
+	c.Assert(inst.AppName, check.Equals, "as_i_rise")
+	c.Assert(inst.InstanceID, check.Equals, "i-00000zz5")
+	c.Assert(inst.PublicAddress, check.Equals, "192.168.0.10")
+}
+
+const duplicateInstanceOutput = `machines:
+  0:
+    agent-state: running
+    dns-name: 192.168.0.10
+    instance-id: i-00000zz5
+    instance-state: running
+  1:
+    agent-state: running
+    dns-name: 192.168.0.10
+    instance-id: i-00000zz5
+    instance-state: running
+services:
+  as_i_rise:
+    charm: local:python-11
+    units:
+      as_i_rise/0:
+        agent-state: started
+        machine: 0
+      as_i_rise/1:
+        agent-state: started
+        machine: 1
+`
+
+func (s *S) TestCollectStatusDuplicateInstanceID(c *check.C) {
+	s.addInstances(c, instance{
+		UnitName:   "as_i_rise/0",
+		AppName:    "as_i_rise",
+		Machine:    0,
+		InstanceID: "i-00000zz5",
+		Status:     provision.StatusStarted.String(),
+	})
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(duplicateInstanceOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	units, err := p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	c.Assert(units, check.HasLen, 2)
+	inst := s.getInstance(c, "as_i_rise/0")
+	c.Assert(inst.InstanceID, check.Equals, "i-00000zz5")
+	inst = s.getInstance(c, "as_i_rise/1")
+	c.Assert(inst.InstanceID, check.Equals, "")
+}
+
+func (s *S) TestCollectStatusFailure(c *check.C) {
+	fexec := exectest.ErrorExecutor{}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	units, err := p.CollectStatus()
+	c.Assert(units, check.IsNil)
+	c.Assert(err, check.FitsTypeOf, &provision.Error{})
+}
+
+const outOfServiceHealthResponse = `<DescribeInstanceHealthResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <DescribeInstanceHealthResult>
+    <InstanceStates>
+      <member>
+        <Description>Instance has failed at least the UnhealthyThreshold number of health checks consecutively.</Description>
+        <InstanceId>i-00000zz5</InstanceId>
+        <State>OutOfService</State>
+        <ReasonCode>Instance</ReasonCode>
+      </member>
+      <member>
+        <Description>N/A</Description>
+        <InstanceId>i-00000zz6</InstanceId>
+        <State>InService</State>
+        <ReasonCode>N/A</ReasonCode>
+      </member>
+    </InstanceStates>
+  </DescribeInstanceHealthResult>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</DescribeInstanceHealthResponse>`
+
+func (s *S) TestCollectStatusELBHealth(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	srv.healthResponse = outOfServiceHealthResponse
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(collectOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	_, err := p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	inst := s.getInstance(c, "as_i_rise/0")
+	c.Assert(inst.ELBState, check.Equals, "OutOfService")
+	c.Assert(inst.ELBReasonCode, check.Equals, "Instance")
+	c.Assert(inst.ELBDescription, check.Equals, "Instance has failed at least the UnhealthyThreshold number of health checks consecutively.")
+	inst = s.getInstance(c, "the_infanta/0")
+	c.Assert(inst.ELBState, check.Equals, "InService")
+	c.Assert(inst.ELBReasonCode, check.Equals, "")
+	c.Assert(inst.ELBDescription, check.Equals, "")
+}
+
+func (s *S) TestCollectStatusDegradedUnit(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	srv.healthResponse = outOfServiceHealthResponse
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(collectOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	units, err := p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	statuses := make(map[string]provision.Status, len(units))
+	for _, unit := range units {
+		statuses[unit.Name] = unit.Status
+	}
+	c.Assert(statuses["as_i_rise/0"], check.Equals, StatusDegraded)
+	c.Assert(statuses["the_infanta/0"], check.Equals, provision.StatusStarted)
+	inst := s.getInstance(c, "as_i_rise/0")
+	c.Assert(inst.Status, check.Equals, StatusDegraded.String())
+	c.Assert(inst.ELBFailedChecks, check.Equals, 1)
+	inst = s.getInstance(c, "the_infanta/0")
+	c.Assert(inst.Status, check.Equals, provision.StatusStarted.String())
+	c.Assert(inst.ELBFailedChecks, check.Equals, 0)
+}
+
+func (s *S) TestCollectStatusDegradedCrossesThreshold(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	srv.healthResponse = outOfServiceHealthResponse
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	s.addInstances(c, instance{
+		UnitName: "as_i_rise/0", AppName: "as_i_rise", Machine: 0,
+		InstanceID:      "i-00000zz5",
+		Status:          StatusDegraded.String(),
+		ELBFailedChecks: 1,
+	})
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(collectOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	units, err := p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	statuses := make(map[string]provision.Status, len(units))
+	for _, unit := range units {
+		statuses[unit.Name] = unit.Status
+	}
+	c.Assert(statuses["as_i_rise/0"], check.Equals, provision.StatusStarted)
+	inst := s.getInstance(c, "as_i_rise/0")
+	c.Assert(inst.Status, check.Equals, provision.StatusStarted.String())
+	c.Assert(inst.ELBFailedChecks, check.Equals, 2)
+}
+
+func (s *S) TestELBUnhealthyThreshold(c *check.C) {
+	c.Assert(elbUnhealthyThreshold(), check.Equals, defaultELBUnhealthyThreshold)
+	config.Set("juju:elb:unhealthy-threshold", 5)
+	defer config.Unset("juju:elb:unhealthy-threshold")
+	c.Assert(elbUnhealthyThreshold(), check.Equals, 5)
+}
+
+const lxcOutput = `machines:
+  105:
+    agent-state: running
+    dns-name: 192.168.0.105
+    instance-id: i-00000aa1
+    instance-state: running
+    containers:
+      105/lxc/0:
+        agent-state: running
+        dns-name: 10.0.3.15
+        instance-id: i-00000aa1-lxc0
+        instance-state: running
+services:
+  myapp:
+    charm: local:python-11
+    units:
+      myapp/0:
+        agent-state: started
+        machine: 105/lxc/0
+      myapp/1:
+        agent-state: started
+        machine: 105
+`
+
+func (s *S) TestUnitsFromStatusNestedContainers(c *check.C) {
+	output, err := parseStatus([]byte(lxcOutput))
+	c.Assert(err, check.IsNil)
+	units, insts := unitsFromStatus(output, nil)
+	c.Assert(units, check.HasLen, 2)
+	sort.Slice(insts, func(i, j int) bool { return insts[i].UnitName < insts[j].UnitName })
+	c.Assert(insts[0].UnitName, check.Equals, "myapp/0")
+	c.Assert(insts[0].Machine, check.Equals, 105)
+	c.Assert(insts[0].Container, check.Equals, "105/lxc/0")
+	c.Assert(insts[0].InstanceID, check.Equals, "i-00000aa1-lxc0")
+	c.Assert(insts[0].PublicAddress, check.Equals, "10.0.3.15")
+	c.Assert(insts[1].UnitName, check.Equals, "myapp/1")
+	c.Assert(insts[1].Machine, check.Equals, 105)
+	c.Assert(insts[1].Container, check.Equals, "")
+	c.Assert(insts[1].InstanceID, check.Equals, "i-00000aa1")
+}
+
+func (s *S) TestSSHTargetContainer(c *check.C) {
+	inst := instance{UnitName: "myapp/0", Machine: 105, Container: "105/lxc/0"}
+	c.Assert(inst.sshTarget(), check.Equals, "105/lxc/0")
+	inst = instance{UnitName: "myapp/1", Machine: 105}
+	c.Assert(inst.sshTarget(), check.Equals, "105")
+}
+
+const prefixedOutput = `machines:
+  0:
+    agent-state: running
+    dns-name: 192.168.0.10
+    instance-id: i-00000zz5
+    instance-state: running
+services:
+  tsuru-myapp:
+    charm: local:python-11
+    units:
+      tsuru-myapp/0:
+        agent-state: started
+        machine: 0
+`
+
+func (s *S) TestUnitsFromStatusStripsServicePrefix(c *check.C) {
+	config.Set("juju:service-prefix", "tsuru-")
+	defer config.Unset("juju:service-prefix")
+	output, err := parseStatus([]byte(prefixedOutput))
+	c.Assert(err, check.IsNil)
+	units, insts := unitsFromStatus(output, nil)
+	c.Assert(units, check.HasLen, 1)
+	c.Assert(units[0].AppName, check.Equals, "myapp")
+	c.Assert(insts[0].AppName, check.Equals, "myapp")
+	c.Assert(insts[0].UnitName, check.Equals, "tsuru-myapp/0")
+}
+
+// hangingExecutor blocks until its channel is closed, simulating a hung juju
+// command.
+type hangingExecutor struct {
+	release chan struct{}
+}
+
+func (e *hangingExecutor) Execute(opts exec.ExecuteOptions) error {
+	<-e.release
+	return nil
+}
+
+func (s *S) TestCollectStatusTimeout(c *check.C) {
+	config.Set("juju:status-timeout", 1)
+	defer config.Unset("juju:status-timeout")
+	hung := &hangingExecutor{release: make(chan struct{})}
+	defer close(hung.release)
+	execut = hung
+	p := &jujuProvisioner{}
+	units, err := p.CollectStatus()
+	c.Assert(units, check.IsNil)
+	c.Assert(err, check.ErrorMatches, `.*"juju status" did not finish within 1s.*`)
+}
+
+func (s *S) TestStatusTimeoutDefault(c *check.C) {
+	c.Assert(statusTimeout(), check.Equals, defaultStatusTimeout)
+	config.Set("juju:status-timeout", 30)
+	defer config.Unset("juju:status-timeout")
+	c.Assert(statusTimeout(), check.Equals, 30*time.Second)
+}
+
+const normalizedOutput = `machines:
+  0:
+    agent-state: running
+    dns-name: 192.168.0.10
+    instance-id: i-00000zz5
+    instance-state: running
+services:
+  as-i-rise:
+    charm: local:python-11
+    units:
+      as-i-rise/0:
+        agent-state: started
+        machine: 0
+`
+
+func (s *S) TestCollectStatusMapsNormalizedServiceNames(c *check.C) {
+	s.addInstances(c, instance{
+		UnitName: "as-i-rise/0",
+		AppName:  "as_i_rise",
+		Service:  "as-i-rise",
+		Machine:  0,
+		Status:   provision.StatusStarted.String(),
+	})
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(normalizedOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	units, err := p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	c.Assert(units, check.HasLen, 1)
+	c.Assert(units[0].AppName, check.Equals, "as_i_rise")
+	inst := s.getInstance(c, "as-i-rise/0")
+	c.Assert(inst.AppName, check.Equals, "as_i_rise")
+	c.Assert(inst.Service, check.Equals, "as-i-rise")
+}
+
+func (s *S) TestReconcileInstances(c *check.C) {
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(collectOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	err := p.ReconcileInstances()
+	c.Assert(err, check.IsNil)
+	inst := s.getInstance(c, "as_i_rise/0")
+	c.Assert(inst.InstanceID, check.Equals, "i-00000zz5")
+	c.Assert(inst.PublicAddress, check.Equals, "192.168.0.10")
+}
+
+func (s *S) TestInstancesFromStatus(c *check.C) {
+	output, err := parseStatus([]byte(collectOutput))
+	c.Assert(err, check.IsNil)
+	insts := instancesFromStatus(output, nil)
+	c.Assert(insts, check.HasLen, 2)
+	_, expected := unitsFromStatus(output, nil)
+	sort.Slice(insts, func(i, j int) bool { return insts[i].UnitName < insts[j].UnitName })
+	sort.Slice(expected, func(i, j int) bool { return expected[i].UnitName < expected[j].UnitName })
+	c.Assert(insts, check.DeepEquals, expected)
+}
+
+const seriesCharmOutput = `machines:
+  0:
+    agent-state: running
+    dns-name: 192.168.0.10
+    instance-id: i-00000zz5
+    instance-state: running
+services:
+  myapp:
+    charm: local:trusty/python-11
+    units:
+      myapp/0:
+        agent-state: started
+        machine: 0
+`
+
+func (s *S) TestUnitsFromStatusSeriesCharm(c *check.C) {
+	output, err := parseStatus([]byte(seriesCharmOutput))
+	c.Assert(err, check.IsNil)
+	units, _ := unitsFromStatus(output, nil)
+	c.Assert(units, check.HasLen, 1)
+	c.Assert(units[0].Type, check.Equals, "python")
+}
+
+const storeCharmOutput = `machines:
+  0:
+    agent-state: running
+    dns-name: 192.168.0.10
+    instance-id: i-00000zz5
+    instance-state: running
+services:
+  myapp:
+    charm: cs:precise/python-42
+    units:
+      myapp/0:
+        agent-state: started
+        machine: 0
+`
+
+func (s *S) TestUnitsFromStatusStoreCharm(c *check.C) {
+	output, err := parseStatus([]byte(storeCharmOutput))
+	c.Assert(err, check.IsNil)
+	units, insts := unitsFromStatus(output, nil)
+	c.Assert(units, check.HasLen, 1)
+	c.Assert(units[0].Type, check.Equals, "python")
+	c.Assert(insts[0].Type, check.Equals, "python")
+}
+
+func (s *S) TestCollectStatusApp(c *check.C) {
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {[]byte(collectOutput)}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("as_i_rise", "python", 2)
+	p := &jujuProvisioner{}
+	units, err := p.CollectStatusApp(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(units, check.HasLen, 2)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"status", "as-i-rise"}), check.Equals, true)
+	inst := s.getInstance(c, "as_i_rise/0")
+	c.Assert(inst.AppName, check.Equals, "as_i_rise")
+	c.Assert(inst.InstanceID, check.Equals, "i-00000zz5")
+}
+
+func (s *S) TestCollectStatusAppInvalidName(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("-bad-", "python", 1)
+	p := &jujuProvisioner{}
+	units, err := p.CollectStatusApp(app)
+	c.Assert(err, check.NotNil)
+	c.Assert(units, check.IsNil)
+	c.Assert(fexec.GetCommands("juju"), check.HasLen, 0)
+}
+
+func (s *S) TestCollectStatusApps(c *check.C) {
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(collectOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	apps := []provision.App{provisiontest.NewFakeApp("as_i_rise", "python", 1)}
+	result, err := p.CollectStatusApps(apps)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.GetCommands("juju"), check.HasLen, 1)
+	c.Assert(result, check.HasLen, 1)
+	c.Assert(result["as_i_rise"], check.HasLen, 1)
+	c.Assert(result["as_i_rise"][0].ID, check.Equals, "as_i_rise/0")
+	inst := s.getInstance(c, "as_i_rise/0")
+	c.Assert(inst.InstanceID, check.Equals, "i-00000zz5")
+	coll, err := unitsCollection()
+	c.Assert(err, check.IsNil)
+	defer coll.Close()
+	n, err := coll.FindId("the_infanta/0").Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 0)
+}
+
+func (s *S) TestCollectStatusAppsNoMatch(c *check.C) {
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(collectOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	result, err := p.CollectStatusApps([]provision.App{provisiontest.NewFakeApp("ghost", "python", 1)})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.HasLen, 0)
+}
+
+const zeroUnitOutput = `machines:
+  0:
+    agent-state: running
+    dns-name: 192.168.0.10
+    instance-id: i-00000zz5
+    instance-state: running
+services:
+  as_i_rise:
+    charm: local:python-11
+    units:
+      as_i_rise/0:
+        agent-state: started
+        machine: 0
+  scaling_up:
+    charm: local:ruby-22
+`
+
+func (s *S) TestCollectStatusAppsZeroUnitService(c *check.C) {
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(zeroUnitOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	apps := []provision.App{
+		provisiontest.NewFakeApp("as_i_rise", "python", 1),
+		provisiontest.NewFakeApp("scaling_up", "ruby", 0),
+	}
+	result, err := p.CollectStatusApps(apps)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.HasLen, 2)
+	c.Assert(result["as_i_rise"], check.HasLen, 1)
+	units, ok := result["scaling_up"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(units, check.HasLen, 0)
+}
+
+func (s *S) TestCollectStatusZeroUnitService(c *check.C) {
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(zeroUnitOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	units, err := p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	c.Assert(units, check.HasLen, 1)
+	c.Assert(units[0].ID, check.Equals, "as_i_rise/0")
+}
+
+func (s *S) TestReapStuck(c *check.C) {
+	old := time.Now().UTC().Add(-time.Hour)
+	s.addInstances(c,
+		instance{UnitName: "stuck/0", AppName: "stuck", Machine: 1, Status: StatusCreating.String(), CreatedAt: old},
+		instance{UnitName: "stuck/1", AppName: "stuck", Machine: 2, Status: StatusInstalling.String(), CreatedAt: old},
+		instance{UnitName: "stuck/2", AppName: "stuck", Machine: 3, Status: StatusCreating.String(), CreatedAt: time.Now().UTC()},
+		instance{UnitName: "stuck/3", AppName: "stuck", Machine: 4, Status: provision.StatusStarted.String(), CreatedAt: old},
+	)
+	p := &jujuProvisioner{}
+	flagged, err := p.ReapStuck(30 * time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(flagged, check.Equals, 2)
+	c.Assert(s.getInstance(c, "stuck/0").Status, check.Equals, provision.StatusError.String())
+	c.Assert(s.getInstance(c, "stuck/1").Status, check.Equals, provision.StatusError.String())
+	c.Assert(s.getInstance(c, "stuck/2").Status, check.Equals, StatusCreating.String())
+	c.Assert(s.getInstance(c, "stuck/3").Status, check.Equals, provision.StatusStarted.String())
+}
+
+func (s *S) TestReapStuckConfiguredDeadline(c *check.C) {
+	config.Set("juju:reap-stuck-deadline", 60)
+	defer config.Unset("juju:reap-stuck-deadline")
+	s.addInstances(c,
+		instance{UnitName: "stuck/0", AppName: "stuck", Machine: 1, Status: StatusCreating.String(), CreatedAt: time.Now().UTC().Add(-2 * time.Minute)},
+	)
+	p := &jujuProvisioner{}
+	flagged, err := p.ReapStuck(0)
+	c.Assert(err, check.IsNil)
+	c.Assert(flagged, check.Equals, 1)
+}
+
+func (s *S) TestReapStuckIgnoresUnknownCreation(c *check.C) {
+	s.addInstances(c,
+		instance{UnitName: "stuck/0", AppName: "stuck", Machine: 1, Status: StatusCreating.String()},
+	)
+	p := &jujuProvisioner{}
+	flagged, err := p.ReapStuck(time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(flagged, check.Equals, 0)
+}
+
+const aliasedOutput = `machines:
+  0:
+    agent-status: running
+    public-address: 192.168.0.10
+    instance-id: i-00000zz5
+    instance-state: running
+services:
+  as_i_rise:
+    charm: local:python-11
+    units:
+      as_i_rise/0:
+        agent-status: started
+        machine: 0
+`
+
+func (s *S) TestParseStatusWithFieldAliases(c *check.C) {
+	config.Set("juju:status-fields:dns-name", "public-address")
+	config.Set("juju:status-fields:agent-state", "agent-status")
+	defer config.Unset("juju:status-fields:dns-name")
+	defer config.Unset("juju:status-fields:agent-state")
+	output, err := parseStatus([]byte(aliasedOutput))
+	c.Assert(err, check.IsNil)
+	machine := output.Machines[0]
+	c.Assert(machine.DNSName, check.Equals, "192.168.0.10")
+	c.Assert(machine.AgentState, check.Equals, "running")
+	unit := output.Services["as_i_rise"].Units["as_i_rise/0"]
+	c.Assert(unit.AgentState, check.Equals, "started")
+}
+
+func (s *S) TestParseStatusWithoutAliasesIsUntouched(c *check.C) {
+	output, err := parseStatus([]byte(collectOutput))
+	c.Assert(err, check.IsNil)
+	c.Assert(output.Machines[0].DNSName, check.Not(check.Equals), "")
+}
+
+func (s *S) TestCollectStatusWithFieldAliases(c *check.C) {
+	config.Set("juju:status-fields:dns-name", "public-address")
+	config.Set("juju:status-fields:agent-state", "agent-status")
+	defer config.Unset("juju:status-fields:dns-name")
+	defer config.Unset("juju:status-fields:agent-state")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(aliasedOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	units, err := p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	c.Assert(units, check.HasLen, 1)
+	c.Assert(units[0].IP, check.Equals, "192.168.0.10")
+	c.Assert(units[0].Status, check.Equals, provision.StatusStarted)
+}
+
+// slowExecutor delays each execution, widening the window in which
+// concurrent CollectStatus callers overlap.
+type slowExecutor struct {
+	exectest.FakeExecutor
+	delay time.Duration
+}
+
+func (e *slowExecutor) Execute(opts exec.ExecuteOptions) error {
+	time.Sleep(e.delay)
+	return e.FakeExecutor.Execute(opts)
+}
+
+func (s *S) TestCollectStatusConcurrent(c *check.C) {
+	fexec := &slowExecutor{
+		FakeExecutor: exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(collectOutput)}}},
+		delay:        100 * time.Millisecond,
+	}
+	execut = fexec
+	p := &jujuProvisioner{}
+	const callers = 4
+	results := make([][]provision.Unit, callers)
+	errs := make([]error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = p.CollectStatus()
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < callers; i++ {
+		c.Assert(errs[i], check.IsNil)
+		c.Assert(results[i], check.HasLen, len(results[0]))
+	}
+	c.Assert(len(fexec.GetCommands("status")) < callers, check.Equals, true)
+}
+
+const processOutput = `machines:
+  5:
+    agent-state: running
+    dns-name: 192.168.0.50
+    instance-id: i-00000zz8
+    instance-state: running
+services:
+  myapp-worker:
+    charm: local:python-11
+    units:
+      myapp-worker/0:
+        agent-state: started
+        machine: 5
+`
+
+func (s *S) TestCollectStatusTracksProcess(c *check.C) {
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(processOutput)}}}
+	execut = &fexec
+	s.addInstances(c, instance{
+		UnitName: "myapp-worker/0", AppName: "myapp", Service: "myapp-worker",
+		Process: "worker", Machine: 5, Status: provision.StatusCreated.String(),
+	})
+	p := &jujuProvisioner{}
+	units, err := p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	c.Assert(units, check.HasLen, 1)
+	c.Assert(units[0].AppName, check.Equals, "myapp")
+	c.Assert(units[0].ProcessName, check.Equals, "worker")
+	inst := s.getInstance(c, "myapp-worker/0")
+	c.Assert(inst.Process, check.Equals, "worker")
+	c.Assert(inst.Status, check.Equals, provision.StatusStarted.String())
+}
+
+func (s *S) TestParseStatusErrorSnippet(c *check.C) {
+	data := "machines:\n  0:\n    agent-state: running\nservices: [bad\n"
+	_, err := parseStatus([]byte(data))
+	c.Assert(err, check.NotNil)
+	pErr, ok := err.(*provision.Error)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(pErr.Reason, check.Matches, `(?s)"juju status" returned invalid YAML, near:\n.*>> \d+ \| services: \[bad.*`)
+}
+
+func (s *S) TestYAMLErrorSnippetUnknownLine(c *check.C) {
+	c.Assert(yamlErrorSnippet([]byte("a: b"), errors.New("boom")), check.Equals, "")
+}
+
+func (s *S) TestCollectStatusAppsDegradedUnit(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	srv.healthResponse = outOfServiceHealthResponse
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(collectOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	apps := []provision.App{provisiontest.NewFakeApp("as_i_rise", "python", 1)}
+	result, err := p.CollectStatusApps(apps)
+	c.Assert(err, check.IsNil)
+	c.Assert(result["as_i_rise"], check.HasLen, 1)
+	c.Assert(result["as_i_rise"][0].Status, check.Equals, StatusDegraded)
+	inst := s.getInstance(c, "as_i_rise/0")
+	c.Assert(inst.Status, check.Equals, StatusDegraded.String())
+}
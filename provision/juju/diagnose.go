@@ -0,0 +1,126 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"bytes"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/tsuru/tsuru/provision"
+)
+
+// DiagnosisReport summarizes the discrepancies found between the units
+// collection, juju status and the app's load balancer. Empty slices mean
+// no discrepancy of that kind was found.
+type DiagnosisReport struct {
+	AppName string
+	// MissingFromELB lists the started units whose instances aren't
+	// registered with the load balancer.
+	MissingFromELB []string
+	// OutOfService lists the started units registered with the load
+	// balancer but not InService.
+	OutOfService []string
+	// UnknownELBInstances lists the instance ids registered with the load
+	// balancer that don't back any known unit.
+	UnknownELBInstances []string
+	// StaleAddresses lists the units whose stored addresses differ from
+	// what juju status reports.
+	StaleAddresses []string
+	// LoadBalancerMissing flags that ELB support is enabled but the app has
+	// no load balancer. The ELB checks are skipped when set.
+	LoadBalancerMissing bool
+}
+
+// OK tells whether the diagnosis found no discrepancies.
+func (r *DiagnosisReport) OK() bool {
+	return !r.LoadBalancerMissing &&
+		len(r.MissingFromELB) == 0 &&
+		len(r.OutOfService) == 0 &&
+		len(r.UnknownELBInstances) == 0 &&
+		len(r.StaleAddresses) == 0
+}
+
+// Diagnose cross-checks the app between the units collection, juju status
+// and the load balancer, returning a report of the discrepancies. It only
+// makes read-only calls: fixing what it finds is left to the operator (or to
+// the reconciliation tasks).
+func (p *jujuProvisioner) Diagnose(app provision.App) (DiagnosisReport, error) {
+	report := DiagnosisReport{AppName: app.GetName()}
+	insts, err := p.appInstances(app.GetName())
+	if err != nil {
+		return report, err
+	}
+	serviceName, err := jujuServiceName(app.GetName())
+	if err != nil {
+		return report, err
+	}
+	var buf bytes.Buffer
+	args := append(environmentArgs(appEnvironment(app)), "status", serviceName)
+	err = execWithTimeout(statusTimeout(), &buf, &buf, args...)
+	if err != nil {
+		return report, &provision.Error{Reason: buf.String(), Err: err}
+	}
+	output, err := parseStatus(buf.Bytes())
+	if err != nil {
+		return report, err
+	}
+	reported := make(map[string]jujuMachine)
+	if service, ok := output.Services[serviceName]; ok {
+		for unitName, u := range service.Units {
+			reported[unitName] = resolveMachine(output, u)
+		}
+	}
+	for _, inst := range insts {
+		machine, ok := reported[inst.UnitName]
+		if !ok {
+			continue
+		}
+		if inst.PublicAddress != machine.DNSName || inst.PrivateAddress != machine.PrivateDNSName {
+			report.StaleAddresses = append(report.StaleAddresses, inst.UnitName)
+		}
+	}
+	if !p.elbSupport() {
+		return report, nil
+	}
+	manager := p.LoadBalancer()
+	ids, err := manager.Instances(app)
+	if err == ErrLoadBalancerNotFound {
+		report.LoadBalancerMissing = true
+		return report, nil
+	}
+	if err != nil {
+		return report, err
+	}
+	health, err := manager.instanceHealth(app.GetName())
+	if err != nil {
+		return report, err
+	}
+	registered := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		registered[id] = true
+	}
+	known := make(map[string]bool, len(insts))
+	for _, inst := range insts {
+		if inst.InstanceID != "" {
+			known[inst.InstanceID] = true
+		}
+		if inst.Status != provision.StatusStarted.String() {
+			continue
+		}
+		if inst.InstanceID == "" || !registered[inst.InstanceID] {
+			report.MissingFromELB = append(report.MissingFromELB, inst.UnitName)
+			continue
+		}
+		if state := health[inst.InstanceID]; state == nil || aws.StringValue(state.State) != "InService" {
+			report.OutOfService = append(report.OutOfService, inst.UnitName)
+		}
+	}
+	for _, id := range ids {
+		if !known[id] {
+			report.UnknownELBInstances = append(report.UnknownELBInstances, id)
+		}
+	}
+	return report, nil
+}
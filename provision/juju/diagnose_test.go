@@ -0,0 +1,109 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/exec/exectest"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	check "gopkg.in/check.v1"
+)
+
+const diagnoseOutput = `machines:
+  0:
+    agent-state: running
+    dns-name: lost0.public.amazonaws.com
+    private-dns-name: lost0.private.internal
+    instance-id: i-00000zz5
+    instance-state: running
+  1:
+    agent-state: running
+    dns-name: lost1.public.amazonaws.com
+    private-dns-name: lost1.private.internal
+    instance-id: i-00000zz6
+    instance-state: running
+services:
+  lostkeys:
+    charm: local:python-11
+    units:
+      lostkeys/0:
+        agent-state: started
+        machine: 0
+      lostkeys/1:
+        agent-state: started
+        machine: 1
+`
+
+func (s *S) TestDiagnose(c *check.C) {
+	server := s.startELBServer()
+	defer server.close()
+	server.dnsNames["lostkeys"] = "lostkeys.us-east-1.elb.amazonaws.com"
+	server.instances["lostkeys"] = []string{"i-00000zz5", "i-00000zz7"}
+	server.healthResponse = outOfServiceHealthResponse
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {[]byte(diagnoseOutput)}}}
+	execut = &fexec
+	s.addInstances(c,
+		instance{
+			UnitName: "lostkeys/0", AppName: "lostkeys", Machine: 0,
+			InstanceID:     "i-00000zz5",
+			PublicAddress:  "stale.public.amazonaws.com",
+			PrivateAddress: "lost0.private.internal",
+			Status:         provision.StatusStarted.String(),
+		},
+		instance{
+			UnitName: "lostkeys/1", AppName: "lostkeys", Machine: 1,
+			InstanceID:     "i-00000zz6",
+			PublicAddress:  "lost1.public.amazonaws.com",
+			PrivateAddress: "lost1.private.internal",
+			Status:         provision.StatusStarted.String(),
+		},
+	)
+	app := provisiontest.NewFakeApp("lostkeys", "python", 2)
+	p := &jujuProvisioner{}
+	report, err := p.Diagnose(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.AppName, check.Equals, "lostkeys")
+	c.Assert(report.MissingFromELB, check.DeepEquals, []string{"lostkeys/1"})
+	c.Assert(report.OutOfService, check.DeepEquals, []string{"lostkeys/0"})
+	c.Assert(report.UnknownELBInstances, check.DeepEquals, []string{"i-00000zz7"})
+	c.Assert(report.StaleAddresses, check.DeepEquals, []string{"lostkeys/0"})
+	c.Assert(report.LoadBalancerMissing, check.Equals, false)
+	c.Assert(report.OK(), check.Equals, false)
+}
+
+func (s *S) TestDiagnoseHealthyAppWithoutELB(c *check.C) {
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {[]byte(diagnoseOutput)}}}
+	execut = &fexec
+	s.addInstances(c, instance{
+		UnitName: "lostkeys/0", AppName: "lostkeys", Machine: 0,
+		InstanceID:     "i-00000zz5",
+		PublicAddress:  "lost0.public.amazonaws.com",
+		PrivateAddress: "lost0.private.internal",
+		Status:         provision.StatusStarted.String(),
+	})
+	app := provisiontest.NewFakeApp("lostkeys", "python", 1)
+	p := &jujuProvisioner{}
+	report, err := p.Diagnose(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.OK(), check.Equals, true)
+}
+
+func (s *S) TestDiagnoseLoadBalancerMissing(c *check.C) {
+	server := s.startELBServer()
+	defer server.close()
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {[]byte(diagnoseOutput)}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("lostkeys", "python", 1)
+	p := &jujuProvisioner{}
+	report, err := p.Diagnose(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.LoadBalancerMissing, check.Equals, true)
+	c.Assert(report.OK(), check.Equals, false)
+}
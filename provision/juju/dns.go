@@ -0,0 +1,46 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"github.com/pkg/errors"
+	"github.com/tsuru/config"
+)
+
+// DNSProvider creates or updates the DNS record of an app, pointing it at
+// the given address. Providers register themselves through
+// RegisterDNSProvider and are selected with the juju:dns:provider setting.
+type DNSProvider interface {
+	Register(appName, addr string) error
+}
+
+var dnsProviders = make(map[string]func() DNSProvider)
+
+// RegisterDNSProvider makes a DNS provider available for selection through
+// the juju:dns:provider setting. It's meant to be called from init
+// functions, mirroring RegisterRouter.
+func RegisterDNSProvider(name string, factory func() DNSProvider) {
+	dnsProviders[name] = factory
+}
+
+// dnsSupport tells whether a DNS provider is configured, making provisioning
+// register app records automatically.
+func (p *jujuProvisioner) dnsSupport() bool {
+	name, _ := config.GetString("juju:dns:provider")
+	return name != ""
+}
+
+// dnsProvider returns the provider selected by juju:dns:provider.
+func dnsProvider() (DNSProvider, error) {
+	name, _ := config.GetString("juju:dns:provider")
+	if name == "" {
+		return nil, errors.New("juju: dns:provider is not configured")
+	}
+	factory, ok := dnsProviders[name]
+	if !ok {
+		return nil, errors.Errorf("juju: unknown DNS provider %q", name)
+	}
+	return factory(), nil
+}
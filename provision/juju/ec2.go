@@ -0,0 +1,244 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/log"
+	tsuruNet "github.com/tsuru/tsuru/net"
+	"github.com/tsuru/tsuru/provision"
+)
+
+func ec2Client() (*ec2.EC2, error) {
+	keyID, _ := config.GetString("juju:ec2:access-key")
+	secret, _ := config.GetString("juju:ec2:secret-key")
+	region, err := config.GetString("juju:ec2:region")
+	if err != nil {
+		region = defaultELBRegion
+	}
+	endpoint, _ := config.GetString("juju:ec2:endpoint")
+	cfg := aws.Config{
+		Credentials: credentials.NewStaticCredentials(keyID, secret, ""),
+		Region:      aws.String(region),
+		Endpoint:    aws.String(endpoint),
+		HTTPClient:  tsuruNet.Dial15Full300ClientNoKeepAlive,
+	}
+	sess, err := session.NewSession(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ec2.New(sess), nil
+}
+
+// ReapTerminated removes from the units collection the documents whose
+// backing instances no longer exist in EC2 or have been terminated out of
+// band (e.g. a spot reclaim), returning how many documents were removed.
+func (p *jujuProvisioner) ReapTerminated() (int, error) {
+	coll, err := unitsCollection()
+	if err != nil {
+		return 0, err
+	}
+	defer coll.Close()
+	var insts []instance
+	err = coll.Find(bson.M{"instanceid": bson.M{"$ne": ""}}).All(&insts)
+	if err != nil {
+		return 0, err
+	}
+	if len(insts) == 0 {
+		return 0, nil
+	}
+	ids := make([]string, len(insts))
+	for i, inst := range insts {
+		ids[i] = inst.InstanceID
+	}
+	client, err := ec2Client()
+	if err != nil {
+		return 0, err
+	}
+	// Filtering by instance-id instead of passing InstanceIds makes EC2 omit
+	// unknown instances rather than failing the whole call.
+	resp, err := client.DescribeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("instance-id"),
+			Values: aws.StringSlice(ids),
+		}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	alive := make(map[string]bool)
+	for _, reservation := range resp.Reservations {
+		for _, ec2Inst := range reservation.Instances {
+			if ec2Inst.InstanceId == nil {
+				continue
+			}
+			state := ""
+			if ec2Inst.State != nil {
+				state = aws.StringValue(ec2Inst.State.Name)
+			}
+			if state != ec2.InstanceStateNameTerminated {
+				alive[*ec2Inst.InstanceId] = true
+			}
+		}
+	}
+	removed := 0
+	for _, inst := range insts {
+		if alive[inst.InstanceID] {
+			continue
+		}
+		log.Debugf("juju: reaping unit %q, instance %q is gone", inst.UnitName, inst.InstanceID)
+		if err = coll.RemoveId(inst.UnitName); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// instanceTagsToImport returns the names of the EC2 instance tags that
+// should be copied to the unit view, as defined by the
+// juju:instance-tags-to-import setting.
+func instanceTagsToImport() []string {
+	tags, _ := config.GetList("juju:instance-tags-to-import")
+	return tags
+}
+
+// attachInstanceTags fills the Tags field of each unit with the selected EC2
+// tags of its backing instance. units and insts are the index-aligned slices
+// built by unitsFromStatus. The tags of every instance come from a single
+// DescribeInstances call per status run; lookup failures are logged and don't
+// abort the status collection.
+func attachInstanceTags(units []provision.Unit, insts []instance) {
+	wanted := instanceTagsToImport()
+	if len(wanted) == 0 {
+		return
+	}
+	var ids []string
+	for _, inst := range insts {
+		if inst.InstanceID != "" {
+			ids = append(ids, inst.InstanceID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	client, err := ec2Client()
+	if err != nil {
+		log.Errorf("juju: failed to import instance tags: %s", err)
+		return
+	}
+	resp, err := client.DescribeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("instance-id"),
+			Values: aws.StringSlice(ids),
+		}},
+	})
+	if err != nil {
+		log.Errorf("juju: failed to import instance tags: %s", err)
+		return
+	}
+	tags := make(map[string]map[string]string)
+	for _, reservation := range resp.Reservations {
+		for _, ec2Inst := range reservation.Instances {
+			if ec2Inst.InstanceId == nil {
+				continue
+			}
+			instTags := make(map[string]string)
+			for _, tag := range ec2Inst.Tags {
+				instTags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+			tags[*ec2Inst.InstanceId] = instTags
+		}
+	}
+	for i := range units {
+		instTags := tags[insts[i].InstanceID]
+		if len(instTags) == 0 {
+			continue
+		}
+		for _, key := range wanted {
+			if value, ok := instTags[key]; ok {
+				if units[i].Tags == nil {
+					units[i].Tags = make(map[string]string)
+				}
+				units[i].Tags[key] = value
+			}
+		}
+	}
+}
+
+// RefreshIPs updates the stored addresses of the app's units straight from
+// EC2, bypassing juju status, which can keep reporting stale addresses for a
+// while after an instance reboot.
+func (p *jujuProvisioner) RefreshIPs(app provision.App) error {
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	var insts []instance
+	err = coll.Find(bson.M{"app": app.GetName(), "instanceid": bson.M{"$ne": ""}}).All(&insts)
+	if err != nil {
+		return err
+	}
+	if len(insts) == 0 {
+		return nil
+	}
+	ids := make([]string, len(insts))
+	for i, inst := range insts {
+		ids[i] = inst.InstanceID
+	}
+	client, err := ec2Client()
+	if err != nil {
+		return err
+	}
+	resp, err := client.DescribeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("instance-id"),
+			Values: aws.StringSlice(ids),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	current := make(map[string]*ec2.Instance)
+	for _, reservation := range resp.Reservations {
+		for _, ec2Inst := range reservation.Instances {
+			if ec2Inst.InstanceId != nil {
+				current[*ec2Inst.InstanceId] = ec2Inst
+			}
+		}
+	}
+	for _, inst := range insts {
+		ec2Inst := current[inst.InstanceID]
+		if ec2Inst == nil {
+			continue
+		}
+		public := aws.StringValue(ec2Inst.PublicDnsName)
+		if public == "" {
+			public = aws.StringValue(ec2Inst.PublicIpAddress)
+		}
+		private := aws.StringValue(ec2Inst.PrivateDnsName)
+		if private == "" {
+			private = aws.StringValue(ec2Inst.PrivateIpAddress)
+		}
+		if public == inst.PublicAddress && private == inst.PrivateAddress {
+			continue
+		}
+		log.Debugf("juju: event=refresh-ips unit=%s public=%s private=%s", inst.UnitName, public, private)
+		err = coll.UpdateId(inst.UnitName, bson.M{"$set": bson.M{
+			"publicaddress":  public,
+			"privateaddress": private,
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	check "gopkg.in/check.v1"
+)
+
+const describeInstancesResponse = `<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>req-1</requestId>
+  <reservationSet>
+    <item>
+      <instancesSet>
+        <item>
+          <instanceId>i-00000zz5</instanceId>
+          <instanceState><code>16</code><name>running</name></instanceState>
+        </item>
+        <item>
+          <instanceId>i-00000zz6</instanceId>
+          <instanceState><code>48</code><name>terminated</name></instanceState>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+</DescribeInstancesResponse>`
+
+// fakeEC2 is an HTTP server that mimics the subset of the EC2 API used by
+// the provisioner, recording every request it receives.
+type fakeEC2 struct {
+	srv      *httptest.Server
+	reqs     []url.Values
+	response string
+}
+
+func (s *S) startEC2Server(response string) *fakeEC2 {
+	f := &fakeEC2{response: response}
+	f.srv = httptest.NewServer(f)
+	config.Set("juju:ec2:endpoint", f.srv.URL)
+	config.Set("juju:ec2:access-key", "aws-key")
+	config.Set("juju:ec2:secret-key", "aws-secret")
+	return f
+}
+
+func (f *fakeEC2) close() {
+	f.srv.Close()
+	config.Unset("juju:ec2:endpoint")
+	config.Unset("juju:ec2:access-key")
+	config.Unset("juju:ec2:secret-key")
+}
+
+func (f *fakeEC2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f.reqs = append(f.reqs, r.Form)
+	fmt.Fprint(w, f.response)
+}
+
+func (s *S) TestReapTerminated(c *check.C) {
+	srv := s.startEC2Server(describeInstancesResponse)
+	defer srv.close()
+	s.addInstances(c,
+		instance{UnitName: "radiohead/0", AppName: "radiohead", InstanceID: "i-00000zz5", Status: provision.StatusStarted.String()},
+		instance{UnitName: "radiohead/1", AppName: "radiohead", InstanceID: "i-00000zz6", Status: provision.StatusStarted.String()},
+		instance{UnitName: "radiohead/2", AppName: "radiohead", InstanceID: "i-00000zz7", Status: provision.StatusStarted.String()},
+	)
+	p := &jujuProvisioner{}
+	removed, err := p.ReapTerminated()
+	c.Assert(err, check.IsNil)
+	c.Assert(removed, check.Equals, 2)
+	c.Assert(srv.reqs, check.HasLen, 1)
+	c.Assert(srv.reqs[0].Get("Action"), check.Equals, "DescribeInstances")
+	c.Assert(srv.reqs[0].Get("Filter.1.Name"), check.Equals, "instance-id")
+	inst := s.getInstance(c, "radiohead/0")
+	c.Assert(inst.InstanceID, check.Equals, "i-00000zz5")
+	coll, err := unitsCollection()
+	c.Assert(err, check.IsNil)
+	defer coll.Close()
+	count, err := coll.Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, 1)
+}
+
+func (s *S) TestReapTerminatedNoInstances(c *check.C) {
+	p := &jujuProvisioner{}
+	removed, err := p.ReapTerminated()
+	c.Assert(err, check.IsNil)
+	c.Assert(removed, check.Equals, 0)
+}
+
+const describeAddressesResponse = `<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>req-1</requestId>
+  <reservationSet>
+    <item>
+      <instancesSet>
+        <item>
+          <instanceId>i-00000zz5</instanceId>
+          <instanceState><code>16</code><name>running</name></instanceState>
+          <dnsName>new.public.amazonaws.com</dnsName>
+          <privateDnsName>new.private.internal</privateDnsName>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+</DescribeInstancesResponse>`
+
+func (s *S) TestRefreshIPs(c *check.C) {
+	srv := s.startEC2Server(describeAddressesResponse)
+	defer srv.close()
+	s.addInstances(c,
+		instance{UnitName: "radiohead/0", AppName: "radiohead", InstanceID: "i-00000zz5", PublicAddress: "old.public.amazonaws.com", PrivateAddress: "old.private.internal", Status: provision.StatusStarted.String()},
+		instance{UnitName: "radiohead/1", AppName: "radiohead", InstanceID: "i-00000zz9", PublicAddress: "kept.public.amazonaws.com", Status: provision.StatusStarted.String()},
+	)
+	app := provisiontest.NewFakeApp("radiohead", "python", 2)
+	p := &jujuProvisioner{}
+	err := p.RefreshIPs(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.reqs, check.HasLen, 1)
+	c.Assert(srv.reqs[0].Get("Action"), check.Equals, "DescribeInstances")
+	inst := s.getInstance(c, "radiohead/0")
+	c.Assert(inst.PublicAddress, check.Equals, "new.public.amazonaws.com")
+	c.Assert(inst.PrivateAddress, check.Equals, "new.private.internal")
+	inst = s.getInstance(c, "radiohead/1")
+	c.Assert(inst.PublicAddress, check.Equals, "kept.public.amazonaws.com")
+}
+
+func (s *S) TestRefreshIPsNoInstances(c *check.C) {
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	p := &jujuProvisioner{}
+	err := p.RefreshIPs(app)
+	c.Assert(err, check.IsNil)
+}
+
+const describeTagsResponse = `<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <requestId>req-1</requestId>
+  <reservationSet>
+    <item>
+      <instancesSet>
+        <item>
+          <instanceId>i-00000zz5</instanceId>
+          <instanceState><code>16</code><name>running</name></instanceState>
+          <tagSet>
+            <item><key>team</key><value>cobrateam</value></item>
+            <item><key>owner</key><value>ops</value></item>
+            <item><key>billing</key><value>internal</value></item>
+          </tagSet>
+        </item>
+      </instancesSet>
+    </item>
+  </reservationSet>
+</DescribeInstancesResponse>`
+
+func (s *S) TestAttachInstanceTags(c *check.C) {
+	srv := s.startEC2Server(describeTagsResponse)
+	defer srv.close()
+	config.Set("juju:instance-tags-to-import", []string{"team", "owner"})
+	units := []provision.Unit{
+		{ID: "radiohead/0", Name: "radiohead/0", AppName: "radiohead"},
+		{ID: "radiohead/1", Name: "radiohead/1", AppName: "radiohead"},
+	}
+	insts := []instance{
+		{UnitName: "radiohead/0", AppName: "radiohead", InstanceID: "i-00000zz5"},
+		{UnitName: "radiohead/1", AppName: "radiohead", InstanceID: "i-00000zz9"},
+	}
+	attachInstanceTags(units, insts)
+	c.Assert(srv.reqs, check.HasLen, 1)
+	c.Assert(srv.reqs[0].Get("Action"), check.Equals, "DescribeInstances")
+	c.Assert(units[0].Tags, check.DeepEquals, map[string]string{"team": "cobrateam", "owner": "ops"})
+	c.Assert(units[1].Tags, check.IsNil)
+}
+
+func (s *S) TestAttachInstanceTagsNotConfigured(c *check.C) {
+	srv := s.startEC2Server(describeTagsResponse)
+	defer srv.close()
+	units := []provision.Unit{{ID: "radiohead/0", Name: "radiohead/0", AppName: "radiohead"}}
+	insts := []instance{{UnitName: "radiohead/0", AppName: "radiohead", InstanceID: "i-00000zz5"}}
+	attachInstanceTags(units, insts)
+	c.Assert(srv.reqs, check.HasLen, 0)
+	c.Assert(units[0].Tags, check.IsNil)
+}
@@ -0,0 +1,716 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/log"
+	tsuruNet "github.com/tsuru/tsuru/net"
+	"github.com/tsuru/tsuru/provision"
+)
+
+const defaultELBRegion = "us-east-1"
+
+// ErrLoadBalancerNotFound is the error returned by Addr and other ELBManager
+// methods when the app doesn't have a load balancer.
+var ErrLoadBalancerNotFound = errors.New("juju: load balancer not found")
+
+// addrCache caches the DNS name of each app's load balancer. ELBs keep their
+// DNS name for their whole lifetime, so entries are only invalidated when the
+// load balancer is destroyed.
+var addrCache = struct {
+	sync.Mutex
+	addrs map[string]string
+}{addrs: make(map[string]string)}
+
+func cachedAddr(name string) (string, bool) {
+	addrCache.Lock()
+	defer addrCache.Unlock()
+	addr, ok := addrCache.addrs[name]
+	return addr, ok
+}
+
+func cacheAddr(name, addr string) {
+	addrCache.Lock()
+	defer addrCache.Unlock()
+	addrCache.addrs[name] = addr
+}
+
+func invalidateAddr(name string) {
+	addrCache.Lock()
+	defer addrCache.Unlock()
+	delete(addrCache.addrs, name)
+}
+
+// ELBManager manages Elastic Load Balancers for apps provisioned by the juju
+// provisioner, one balancer per app, named after the app.
+type ELBManager struct {
+	e *elb.ELB
+}
+
+func (m *ELBManager) client() (*elb.ELB, error) {
+	if m.e != nil {
+		return m.e, nil
+	}
+	keyID, _ := config.GetString("juju:elb:access-key")
+	secret, _ := config.GetString("juju:elb:secret-key")
+	region, err := config.GetString("juju:elb:region")
+	if err != nil {
+		region = defaultELBRegion
+	}
+	endpoint, _ := config.GetString("juju:elb:endpoint")
+	cfg := aws.Config{
+		Credentials: credentials.NewStaticCredentials(keyID, secret, ""),
+		Region:      aws.String(region),
+		Endpoint:    aws.String(endpoint),
+		HTTPClient:  tsuruNet.Dial15Full300ClientNoKeepAlive,
+	}
+	sess, err := session.NewSession(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	m.e = elb.New(sess)
+	return m.e, nil
+}
+
+func elbListeners() []*elb.Listener {
+	instancePort, err := config.GetInt("juju:elb:instance-port")
+	if err != nil {
+		instancePort = 80
+	}
+	return []*elb.Listener{{
+		InstancePort:     aws.Int64(int64(instancePort)),
+		InstanceProtocol: aws.String("HTTP"),
+		LoadBalancerPort: aws.Int64(80),
+		Protocol:         aws.String("HTTP"),
+	}}
+}
+
+// lbName composes the AWS name of the app's balancer identified by the given
+// logical name. The default balancer (empty name) is named after the app
+// alone.
+func lbName(app provision.Named, name string) string {
+	if name == "" {
+		return app.GetName()
+	}
+	return app.GetName() + "-" + name
+}
+
+// namedListeners returns the listeners of the balancer group identified by
+// name, read from juju:elb:groups:<name>. Groups without specific settings
+// share the default listener configuration.
+func namedListeners(name string) []*elb.Listener {
+	instancePort, err := config.GetInt("juju:elb:groups:" + name + ":instance-port")
+	if err != nil {
+		return elbListeners()
+	}
+	lbPort, err := config.GetInt("juju:elb:groups:" + name + ":port")
+	if err != nil {
+		lbPort = instancePort
+	}
+	return []*elb.Listener{{
+		InstancePort:     aws.Int64(int64(instancePort)),
+		InstanceProtocol: aws.String("HTTP"),
+		LoadBalancerPort: aws.Int64(int64(lbPort)),
+		Protocol:         aws.String("HTTP"),
+	}}
+}
+
+// ELBCreateError is the error returned by Create. It distinguishes a setup
+// that timed out from one AWS rejected, and tells whether the half-created
+// balancer was removed before returning, so a retry starts clean. After a
+// timeout the rollback happens in the background, once the in-flight attempt
+// resolves, so RolledBack stays false.
+type ELBCreateError struct {
+	AppName    string
+	Timeout    bool
+	RolledBack bool
+	Err        error
+}
+
+func (e *ELBCreateError) Error() string {
+	if e.Timeout {
+		return fmt.Sprintf("juju: timed out creating load balancer for app %q: %s", e.AppName, e.Err)
+	}
+	return fmt.Sprintf("juju: failed to create load balancer for app %q: %s", e.AppName, e.Err)
+}
+
+// elbCreateTimeout returns how long Create waits for the balancer setup
+// before giving up, from juju:elb:create-timeout. Zero means no timeout.
+func elbCreateTimeout() time.Duration {
+	timeout, _ := config.GetDuration("juju:elb:create-timeout")
+	return timeout
+}
+
+// elbCreateResult is the outcome of one createWithSetup run: whether this
+// call created the balancer (as opposed to reusing one left by an earlier
+// attempt) and the setup error, if any.
+type elbCreateResult struct {
+	created bool
+	err     error
+}
+
+// Create creates the default load balancer for the app. The placement of the
+// balancer comes from configuration: inside a VPC when juju:elb:use-vpc is
+// true, spread across juju:elb:avail-zones otherwise. On failure — including
+// a timeout set through juju:elb:create-timeout — the half-created balancer
+// is deleted and the returned *ELBCreateError records what happened.
+func (m *ELBManager) Create(app provision.Named) error {
+	resCh := make(chan elbCreateResult, 1)
+	go func() {
+		created, err := m.createWithSetup(app)
+		resCh <- elbCreateResult{created: created, err: err}
+	}()
+	var res elbCreateResult
+	if timeout := elbCreateTimeout(); timeout > 0 {
+		select {
+		case res = <-resCh:
+		case <-time.After(timeout):
+			cerr := &ELBCreateError{AppName: app.GetName(), Timeout: true, Err: errors.Errorf("no response after %s", timeout)}
+			// The in-flight attempt may still create the balancer; deleting
+			// it now would race that creation, so the rollback waits for the
+			// attempt to resolve in the background.
+			spawn(func() {
+				if late := <-resCh; late.created {
+					if derr := m.Destroy(app); derr != nil {
+						log.Errorf("juju: failed to roll back half-created load balancer of app %q: %s", app.GetName(), derr)
+					}
+				}
+			})
+			return cerr
+		}
+	} else {
+		res = <-resCh
+	}
+	if res.err == nil {
+		return nil
+	}
+	cerr := &ELBCreateError{AppName: app.GetName(), Err: res.err}
+	if !res.created {
+		// Don't delete a balancer this call didn't create: the idempotent
+		// create path reuses one left by an earlier attempt, which may be
+		// registered and serving.
+		return cerr
+	}
+	if derr := m.Destroy(app); derr == nil {
+		cerr.RolledBack = true
+	} else {
+		log.Errorf("juju: failed to roll back half-created load balancer of app %q: %s", app.GetName(), derr)
+	}
+	return cerr
+}
+
+func (m *ELBManager) createWithSetup(app provision.Named) (bool, error) {
+	client, created, err := m.create(app.GetName(), elbListeners())
+	if err != nil {
+		return created, err
+	}
+	if err = m.setupStickiness(client, app.GetName()); err != nil {
+		return created, err
+	}
+	if err = m.setupIdleTimeout(client, app.GetName(), app.GetName()); err != nil {
+		return created, err
+	}
+	return created, m.setupAccessLog(client, app.GetName())
+}
+
+// CreateNamed creates an additional load balancer for the app, identified by
+// a logical name (e.g. "admin"), so apps can expose separate listener groups
+// on separate balancers.
+func (m *ELBManager) CreateNamed(app provision.Named, name string) error {
+	_, _, err := m.create(lbName(app, name), namedListeners(name))
+	return err
+}
+
+func (m *ELBManager) create(balancer string, listeners []*elb.Listener) (*elb.ELB, bool, error) {
+	client, err := m.client()
+	if err != nil {
+		return nil, false, err
+	}
+	input := elb.CreateLoadBalancerInput{
+		LoadBalancerName: aws.String(balancer),
+		Listeners:        listeners,
+	}
+	groups, _ := config.GetList("juju:elb:security-groups")
+	if vpc, _ := config.GetBool("juju:elb:use-vpc"); vpc {
+		subnets, _ := config.GetList("juju:elb:vpc-subnets")
+		input.Subnets = aws.StringSlice(subnets)
+		input.SecurityGroups = aws.StringSlice(groups)
+		input.Scheme = aws.String("internal")
+	} else {
+		if len(groups) > 0 {
+			// Classic (non-VPC) balancers don't take security groups; failing
+			// here beats AWS silently ignoring the setting.
+			return nil, false, errors.New("juju: elb:security-groups requires juju:elb:use-vpc and juju:elb:vpc-subnets")
+		}
+		zones, _ := config.GetList("juju:elb:avail-zones")
+		input.AvailabilityZones = aws.StringSlice(zones)
+	}
+	resp, err := client.CreateLoadBalancer(&input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != elb.ErrCodeDuplicateAccessPointNameException {
+			return nil, false, err
+		}
+		// The balancer survived an earlier failed provision attempt; creating
+		// it is idempotent as long as it belongs to the same app.
+		return client, false, nil
+	}
+	if resp.DNSName != nil {
+		cacheAddr(balancer, *resp.DNSName)
+	}
+	return client, true, nil
+}
+
+// stickinessPolicyName is the name of the session stickiness policy that
+// ELBManager creates on the balancers it manages.
+const stickinessPolicyName = "tsuru-stickiness"
+
+// setupStickiness creates the session stickiness policy selected by the
+// juju:elb:stickiness:policy setting ("lb-cookie" or "app-cookie") and
+// assigns it to the HTTP listener. It's a no-op when the setting is absent,
+// keeping stickiness opt-in.
+func (m *ELBManager) setupStickiness(client *elb.ELB, lbName string) error {
+	policy, _ := config.GetString("juju:elb:stickiness:policy")
+	switch policy {
+	case "":
+		return nil
+	case "lb-cookie":
+		input := elb.CreateLBCookieStickinessPolicyInput{
+			LoadBalancerName: aws.String(lbName),
+			PolicyName:       aws.String(stickinessPolicyName),
+		}
+		if expiration, err := config.GetInt("juju:elb:stickiness:expiration"); err == nil {
+			input.CookieExpirationPeriod = aws.Int64(int64(expiration))
+		}
+		if _, err := client.CreateLBCookieStickinessPolicy(&input); err != nil {
+			return err
+		}
+	case "app-cookie":
+		cookieName, err := config.GetString("juju:elb:stickiness:cookie-name")
+		if err != nil {
+			return errors.New("juju: elb:stickiness:cookie-name must be defined for app-cookie stickiness")
+		}
+		_, err = client.CreateAppCookieStickinessPolicy(&elb.CreateAppCookieStickinessPolicyInput{
+			LoadBalancerName: aws.String(lbName),
+			PolicyName:       aws.String(stickinessPolicyName),
+			CookieName:       aws.String(cookieName),
+		})
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("juju: unknown ELB stickiness policy %q", policy)
+	}
+	_, err := client.SetLoadBalancerPoliciesOfListener(&elb.SetLoadBalancerPoliciesOfListenerInput{
+		LoadBalancerName: aws.String(lbName),
+		LoadBalancerPort: aws.Int64(80),
+		PolicyNames:      []*string{aws.String(stickinessPolicyName)},
+	})
+	return err
+}
+
+// idleTimeout returns the connection idle timeout for the app's balancer, in
+// seconds: juju:elb:apps:<app>:idle-timeout when set, juju:elb:idle-timeout
+// otherwise. Zero means keeping the ELB default (60s). AWS only accepts
+// values between 1 and 3600 seconds; anything else is a config error.
+func idleTimeout(appName string) (int, error) {
+	timeout, err := config.GetInt("juju:elb:apps:" + appName + ":idle-timeout")
+	if err != nil {
+		timeout, err = config.GetInt("juju:elb:idle-timeout")
+		if err != nil {
+			return 0, nil
+		}
+	}
+	if timeout < 1 || timeout > 3600 {
+		return 0, errors.Errorf("juju: elb idle timeout must be between 1 and 3600 seconds, got %d", timeout)
+	}
+	return timeout, nil
+}
+
+// setupIdleTimeout applies the configured connection idle timeout to the
+// balancer. It's a no-op when no timeout is configured, keeping the ELB
+// default for apps that don't long-poll.
+func (m *ELBManager) setupIdleTimeout(client *elb.ELB, appName, balancer string) error {
+	timeout, err := idleTimeout(appName)
+	if err != nil || timeout == 0 {
+		return err
+	}
+	_, err = client.ModifyLoadBalancerAttributes(&elb.ModifyLoadBalancerAttributesInput{
+		LoadBalancerName: aws.String(balancer),
+		LoadBalancerAttributes: &elb.LoadBalancerAttributes{
+			ConnectionSettings: &elb.ConnectionSettings{
+				IdleTimeout: aws.Int64(int64(timeout)),
+			},
+		},
+	})
+	return err
+}
+
+// setupAccessLog enables ELB access logging to S3 when
+// juju:elb:access-log:enabled is true, using the bucket, prefix and emit
+// interval from the juju:elb:access-log settings. It's a no-op when the
+// setting is absent, keeping access logs opt-in.
+func (m *ELBManager) setupAccessLog(client *elb.ELB, balancer string) error {
+	enabled, err := config.GetBool("juju:elb:access-log:enabled")
+	if err != nil || !enabled {
+		return nil
+	}
+	bucket, _ := config.GetString("juju:elb:access-log:bucket")
+	if bucket == "" {
+		return errors.New("juju: elb:access-log:bucket must be defined when access logs are enabled")
+	}
+	accessLog := elb.AccessLog{
+		Enabled:      aws.Bool(true),
+		S3BucketName: aws.String(bucket),
+	}
+	if prefix, _ := config.GetString("juju:elb:access-log:prefix"); prefix != "" {
+		accessLog.S3BucketPrefix = aws.String(prefix)
+	}
+	if interval, err := config.GetInt("juju:elb:access-log:interval"); err == nil {
+		accessLog.EmitInterval = aws.Int64(int64(interval))
+	}
+	_, err = client.ModifyLoadBalancerAttributes(&elb.ModifyLoadBalancerAttributesInput{
+		LoadBalancerName: aws.String(balancer),
+		LoadBalancerAttributes: &elb.LoadBalancerAttributes{
+			AccessLog: &accessLog,
+		},
+	})
+	return err
+}
+
+// UpdateListeners converges the listeners of the app's default load balancer
+// to the desired set, creating missing listeners and removing extraneous
+// ones. Unlike a destroy/recreate cycle, updating in place preserves the
+// balancer's DNS name.
+func (m *ELBManager) UpdateListeners(app provision.Named, listeners []*elb.Listener) error {
+	desc, err := m.Describe(app)
+	if err != nil {
+		return err
+	}
+	client, err := m.client()
+	if err != nil {
+		return err
+	}
+	current := make(map[int64]*elb.Listener, len(desc.ListenerDescriptions))
+	for _, ld := range desc.ListenerDescriptions {
+		if ld.Listener != nil {
+			current[aws.Int64Value(ld.Listener.LoadBalancerPort)] = ld.Listener
+		}
+	}
+	desired := make(map[int64]*elb.Listener, len(listeners))
+	for _, l := range listeners {
+		desired[aws.Int64Value(l.LoadBalancerPort)] = l
+	}
+	var toDelete []*int64
+	var toCreate []*elb.Listener
+	for port, l := range current {
+		if d, ok := desired[port]; !ok || !listenerEqual(l, d) {
+			port := port
+			toDelete = append(toDelete, &port)
+		}
+	}
+	for port, d := range desired {
+		if l, ok := current[port]; !ok || !listenerEqual(l, d) {
+			toCreate = append(toCreate, d)
+		}
+	}
+	// Deletions go first so a listener that changed settings on the same port
+	// can be recreated.
+	if len(toDelete) > 0 {
+		sort.Slice(toDelete, func(i, j int) bool { return *toDelete[i] < *toDelete[j] })
+		_, err = client.DeleteLoadBalancerListeners(&elb.DeleteLoadBalancerListenersInput{
+			LoadBalancerName:  aws.String(app.GetName()),
+			LoadBalancerPorts: toDelete,
+		})
+		if err != nil {
+			return elbError(err)
+		}
+	}
+	if len(toCreate) > 0 {
+		sort.Slice(toCreate, func(i, j int) bool {
+			return aws.Int64Value(toCreate[i].LoadBalancerPort) < aws.Int64Value(toCreate[j].LoadBalancerPort)
+		})
+		_, err = client.CreateLoadBalancerListeners(&elb.CreateLoadBalancerListenersInput{
+			LoadBalancerName: aws.String(app.GetName()),
+			Listeners:        toCreate,
+		})
+		if err != nil {
+			return elbError(err)
+		}
+	}
+	return nil
+}
+
+// listenerEqual tells whether two listeners route the same way: same ports,
+// protocols and SSL certificate.
+func listenerEqual(a, b *elb.Listener) bool {
+	return aws.Int64Value(a.InstancePort) == aws.Int64Value(b.InstancePort) &&
+		strings.EqualFold(aws.StringValue(a.InstanceProtocol), aws.StringValue(b.InstanceProtocol)) &&
+		strings.EqualFold(aws.StringValue(a.Protocol), aws.StringValue(b.Protocol)) &&
+		aws.StringValue(a.SSLCertificateId) == aws.StringValue(b.SSLCertificateId)
+}
+
+// Destroy removes the app's default load balancer and invalidates any cached
+// DNS name, so a subsequent Addr doesn't return a stale address.
+func (m *ELBManager) Destroy(app provision.Named) error {
+	return m.destroy(app.GetName())
+}
+
+// DestroyNamed removes the app's balancer identified by the logical name.
+func (m *ELBManager) DestroyNamed(app provision.Named, name string) error {
+	return m.destroy(lbName(app, name))
+}
+
+func (m *ELBManager) destroy(balancer string) error {
+	invalidateAddr(balancer)
+	client, err := m.client()
+	if err != nil {
+		return err
+	}
+	_, err = client.DeleteLoadBalancer(&elb.DeleteLoadBalancerInput{
+		LoadBalancerName: aws.String(balancer),
+	})
+	return err
+}
+
+// Register adds instances to the app's load balancer.
+func (m *ELBManager) Register(app provision.Named, instanceIDs ...string) error {
+	client, err := m.client()
+	if err != nil {
+		return err
+	}
+	_, err = client.RegisterInstancesWithLoadBalancer(&elb.RegisterInstancesWithLoadBalancerInput{
+		LoadBalancerName: aws.String(app.GetName()),
+		Instances:        elbInstances(instanceIDs),
+	})
+	return elbError(err)
+}
+
+// Deregister removes instances from the app's load balancer.
+func (m *ELBManager) Deregister(app provision.Named, instanceIDs ...string) error {
+	client, err := m.client()
+	if err != nil {
+		return err
+	}
+	_, err = client.DeregisterInstancesFromLoadBalancer(&elb.DeregisterInstancesFromLoadBalancerInput{
+		LoadBalancerName: aws.String(app.GetName()),
+		Instances:        elbInstances(instanceIDs),
+	})
+	return elbError(err)
+}
+
+// Addr returns the DNS name of the app's default load balancer, from the
+// cache when possible.
+func (m *ELBManager) Addr(app provision.Named) (string, error) {
+	return m.addr(app.GetName())
+}
+
+// AddrNamed returns the DNS name of the app's balancer identified by the
+// logical name.
+func (m *ELBManager) AddrNamed(app provision.Named, name string) (string, error) {
+	return m.addr(lbName(app, name))
+}
+
+func (m *ELBManager) addr(balancer string) (string, error) {
+	if addr, ok := cachedAddr(balancer); ok {
+		return addr, nil
+	}
+	client, err := m.client()
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.DescribeLoadBalancers(&elb.DescribeLoadBalancersInput{
+		LoadBalancerNames: []*string{aws.String(balancer)},
+	})
+	if err != nil {
+		return "", elbError(err)
+	}
+	if len(resp.LoadBalancerDescriptions) == 0 || resp.LoadBalancerDescriptions[0].DNSName == nil {
+		return "", ErrLoadBalancerNotFound
+	}
+	addr := *resp.LoadBalancerDescriptions[0].DNSName
+	cacheAddr(balancer, addr)
+	return addr, nil
+}
+
+// Describe returns the full description of the app's load balancer —
+// listeners, zones, health check and registered instances — for admin
+// tooling. It returns ErrLoadBalancerNotFound when the app has no balancer.
+func (m *ELBManager) Describe(app provision.Named) (*elb.LoadBalancerDescription, error) {
+	client, err := m.client()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.DescribeLoadBalancers(&elb.DescribeLoadBalancersInput{
+		LoadBalancerNames: []*string{aws.String(app.GetName())},
+	})
+	if err != nil {
+		return nil, elbError(err)
+	}
+	if len(resp.LoadBalancerDescriptions) == 0 {
+		return nil, ErrLoadBalancerNotFound
+	}
+	return resp.LoadBalancerDescriptions[0], nil
+}
+
+// InstanceHealth describes the health of one instance registered with an
+// app's load balancer, as reported by DescribeInstanceHealth.
+type InstanceHealth struct {
+	InstanceID  string
+	State       string
+	ReasonCode  string
+	Description string
+}
+
+// InstanceHealth returns the health of every instance registered with the
+// app's load balancer, so callers can surface ELB health directly instead of
+// relying on the summary folded into unit status.
+func (m *ELBManager) InstanceHealth(app provision.Named) ([]InstanceHealth, error) {
+	states, err := m.instanceHealth(app.GetName())
+	if err != nil {
+		return nil, err
+	}
+	healths := make([]InstanceHealth, 0, len(states))
+	for id, state := range states {
+		healths = append(healths, InstanceHealth{
+			InstanceID:  id,
+			State:       aws.StringValue(state.State),
+			ReasonCode:  aws.StringValue(state.ReasonCode),
+			Description: aws.StringValue(state.Description),
+		})
+	}
+	sort.Slice(healths, func(i, j int) bool { return healths[i].InstanceID < healths[j].InstanceID })
+	return healths, nil
+}
+
+// instanceHealth returns the health of the instances registered with the
+// app's load balancer, indexed by instance id.
+func (m *ELBManager) instanceHealth(appName string) (map[string]*elb.InstanceState, error) {
+	client, err := m.client()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.DescribeInstanceHealth(&elb.DescribeInstanceHealthInput{
+		LoadBalancerName: aws.String(appName),
+	})
+	if err != nil {
+		return nil, elbError(err)
+	}
+	states := make(map[string]*elb.InstanceState, len(resp.InstanceStates))
+	for _, state := range resp.InstanceStates {
+		if state.InstanceId != nil {
+			states[*state.InstanceId] = state
+		}
+	}
+	return states, nil
+}
+
+// Instances returns the ids of the instances currently registered with the
+// app's load balancer, sorted, for admin inspection and for the read side of
+// Reconcile.
+func (m *ELBManager) Instances(app provision.Named) ([]string, error) {
+	desc, err := m.Describe(app)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(desc.Instances))
+	for _, lbInst := range desc.Instances {
+		if lbInst.InstanceId != nil {
+			ids = append(ids, *lbInst.InstanceId)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Reconcile converges the membership of the app's load balancer to the
+// started units recorded in the units collection, issuing the minimal
+// register/deregister calls. It's a no-op when the balancer is already
+// consistent, so it's safe to run periodically.
+func (m *ELBManager) Reconcile(app provision.Named) error {
+	ids, err := m.Instances(app)
+	if err != nil {
+		return err
+	}
+	registered := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		registered[id] = true
+	}
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	var insts []instance
+	err = coll.Find(bson.M{
+		"app": app.GetName(),
+		// Degraded units stay in the balancer: they're failing checks but
+		// haven't crossed the unhealthy threshold yet and may recover.
+		"status":     bson.M{"$in": []string{provision.StatusStarted.String(), StatusDegraded.String()}},
+		"instanceid": bson.M{"$ne": ""},
+		"cordoned":   bson.M{"$ne": true},
+	}).All(&insts)
+	if err != nil {
+		return err
+	}
+	desired := make(map[string]bool, len(insts))
+	for _, inst := range insts {
+		desired[inst.InstanceID] = true
+	}
+	var toRegister, toDeregister []string
+	for id := range desired {
+		if !registered[id] {
+			toRegister = append(toRegister, id)
+		}
+	}
+	for id := range registered {
+		if !desired[id] {
+			toDeregister = append(toDeregister, id)
+		}
+	}
+	if len(toRegister) > 0 {
+		if err = m.Register(app, toRegister...); err != nil {
+			return err
+		}
+		log.Debugf("juju: event=elb-reconcile app=%s registered=%v", app.GetName(), toRegister)
+	}
+	if len(toDeregister) > 0 {
+		if err = m.Deregister(app, toDeregister...); err != nil {
+			return err
+		}
+		log.Debugf("juju: event=elb-reconcile app=%s deregistered=%v", app.GetName(), toDeregister)
+	}
+	return nil
+}
+
+func elbInstances(ids []string) []*elb.Instance {
+	instances := make([]*elb.Instance, len(ids))
+	for i, id := range ids {
+		instances[i] = &elb.Instance{InstanceId: aws.String(id)}
+	}
+	return instances
+}
+
+// elbError translates AWS not found errors to ErrLoadBalancerNotFound,
+// keeping other errors untouched.
+func elbError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == elb.ErrCodeAccessPointNotFoundException {
+		return ErrLoadBalancerNotFound
+	}
+	return err
+}
@@ -0,0 +1,815 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	check "gopkg.in/check.v1"
+)
+
+const createLBResponse = `<CreateLoadBalancerResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <CreateLoadBalancerResult><DNSName>%s</DNSName></CreateLoadBalancerResult>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</CreateLoadBalancerResponse>`
+
+const deleteLBResponse = `<DeleteLoadBalancerResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <DeleteLoadBalancerResult/>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</DeleteLoadBalancerResponse>`
+
+const describeLBResponse = `<DescribeLoadBalancersResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <DescribeLoadBalancersResult>
+    <LoadBalancerDescriptions>
+      <member>
+        <LoadBalancerName>%s</LoadBalancerName>
+        <DNSName>%s</DNSName>
+        <Instances>%s</Instances>
+        <ListenerDescriptions>%s</ListenerDescriptions>
+      </member>
+    </LoadBalancerDescriptions>
+  </DescribeLoadBalancersResult>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</DescribeLoadBalancersResponse>`
+
+const registerInstancesResponse = `<RegisterInstancesWithLoadBalancerResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <RegisterInstancesWithLoadBalancerResult><Instances/></RegisterInstancesWithLoadBalancerResult>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</RegisterInstancesWithLoadBalancerResponse>`
+
+const deregisterInstancesResponse = `<DeregisterInstancesFromLoadBalancerResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <DeregisterInstancesFromLoadBalancerResult><Instances/></DeregisterInstancesFromLoadBalancerResult>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</DeregisterInstancesFromLoadBalancerResponse>`
+
+const lbNotFoundResponse = `<ErrorResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <Error>
+    <Type>Sender</Type>
+    <Code>LoadBalancerNotFound</Code>
+    <Message>There is no ACTIVE Load Balancer named '%s'</Message>
+  </Error>
+  <RequestId>req-1</RequestId>
+</ErrorResponse>`
+
+const lbCookiePolicyResponse = `<CreateLBCookieStickinessPolicyResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <CreateLBCookieStickinessPolicyResult/>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</CreateLBCookieStickinessPolicyResponse>`
+
+const appCookiePolicyResponse = `<CreateAppCookieStickinessPolicyResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <CreateAppCookieStickinessPolicyResult/>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</CreateAppCookieStickinessPolicyResponse>`
+
+const setPoliciesResponse = `<SetLoadBalancerPoliciesOfListenerResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <SetLoadBalancerPoliciesOfListenerResult/>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</SetLoadBalancerPoliciesOfListenerResponse>`
+
+const createListenersResponse = `<CreateLoadBalancerListenersResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <CreateLoadBalancerListenersResult/>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</CreateLoadBalancerListenersResponse>`
+
+const deleteListenersResponse = `<DeleteLoadBalancerListenersResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <DeleteLoadBalancerListenersResult/>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</DeleteLoadBalancerListenersResponse>`
+
+const modifyAttributesResponse = `<ModifyLoadBalancerAttributesResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <ModifyLoadBalancerAttributesResult/>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</ModifyLoadBalancerAttributesResponse>`
+
+const duplicateLBResponse = `<ErrorResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <Error>
+    <Type>Sender</Type>
+    <Code>DuplicateLoadBalancerName</Code>
+    <Message>Load Balancer named '%s' already exists</Message>
+  </Error>
+  <RequestId>req-1</RequestId>
+</ErrorResponse>`
+
+// fakeELB is an HTTP server that mimics the subset of the ELB API used by
+// ELBManager, recording every request it receives.
+type fakeELB struct {
+	srv            *httptest.Server
+	mu             sync.Mutex
+	reqs           []url.Values
+	delay          time.Duration
+	dnsNames       map[string]string
+	instances      map[string][]string
+	listeners      map[string]string
+	healthResponse string
+	healthQueue    []string
+}
+
+func (s *S) startELBServer() *fakeELB {
+	f := &fakeELB{
+		dnsNames:  make(map[string]string),
+		instances: make(map[string][]string),
+		listeners: make(map[string]string),
+	}
+	f.srv = httptest.NewServer(f)
+	config.Set("juju:elb:endpoint", f.srv.URL)
+	config.Set("juju:elb:access-key", "aws-key")
+	config.Set("juju:elb:secret-key", "aws-secret")
+	return f
+}
+
+func (f *fakeELB) close() {
+	f.srv.Close()
+	config.Unset("juju:elb:endpoint")
+	config.Unset("juju:elb:access-key")
+	config.Unset("juju:elb:secret-key")
+}
+
+func (f *fakeELB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.delay > 0 {
+		time.Sleep(f.delay)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r.ParseForm()
+	f.reqs = append(f.reqs, r.Form)
+	name := r.FormValue("LoadBalancerName")
+	switch r.FormValue("Action") {
+	case "CreateLoadBalancer":
+		if _, ok := f.dnsNames[name]; ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, duplicateLBResponse, name)
+			return
+		}
+		dns := name + ".us-east-1.elb.amazonaws.com"
+		f.dnsNames[name] = dns
+		fmt.Fprintf(w, createLBResponse, dns)
+	case "DeleteLoadBalancer":
+		delete(f.dnsNames, name)
+		fmt.Fprint(w, deleteLBResponse)
+	case "DescribeLoadBalancers":
+		name = r.FormValue("LoadBalancerNames.member.1")
+		dns, ok := f.dnsNames[name]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, lbNotFoundResponse, name)
+			return
+		}
+		var members string
+		for _, id := range f.instances[name] {
+			members += "<member><InstanceId>" + id + "</InstanceId></member>"
+		}
+		fmt.Fprintf(w, describeLBResponse, name, dns, members, f.listeners[name])
+	case "DescribeInstanceHealth":
+		if len(f.healthQueue) > 0 {
+			resp := f.healthQueue[0]
+			f.healthQueue = f.healthQueue[1:]
+			fmt.Fprint(w, resp)
+			return
+		}
+		if f.healthResponse == lbNotFoundResponse {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, lbNotFoundResponse, name)
+			return
+		}
+		fmt.Fprint(w, f.healthResponse)
+	case "CreateLBCookieStickinessPolicy":
+		fmt.Fprint(w, lbCookiePolicyResponse)
+	case "CreateAppCookieStickinessPolicy":
+		fmt.Fprint(w, appCookiePolicyResponse)
+	case "SetLoadBalancerPoliciesOfListener":
+		fmt.Fprint(w, setPoliciesResponse)
+	case "CreateLoadBalancerListeners":
+		fmt.Fprint(w, createListenersResponse)
+	case "DeleteLoadBalancerListeners":
+		fmt.Fprint(w, deleteListenersResponse)
+	case "ModifyLoadBalancerAttributes":
+		fmt.Fprint(w, modifyAttributesResponse)
+	case "RegisterInstancesWithLoadBalancer":
+		fmt.Fprint(w, registerInstancesResponse)
+	case "DeregisterInstancesFromLoadBalancer":
+		fmt.Fprint(w, deregisterInstancesResponse)
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeELB) requests(action string) []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var reqs []url.Values
+	for _, req := range f.reqs {
+		if req.Get("Action") == action {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+func (s *S) TestELBManagerCreate(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:elb:avail-zones", []string{"us-east-1a", "us-east-1b"})
+	defer config.Unset("juju:elb:avail-zones")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	reqs := srv.requests("CreateLoadBalancer")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("LoadBalancerName"), check.Equals, "radiohead")
+	c.Assert(reqs[0].Get("AvailabilityZones.member.1"), check.Equals, "us-east-1a")
+	c.Assert(reqs[0].Get("AvailabilityZones.member.2"), check.Equals, "us-east-1b")
+	c.Assert(reqs[0].Get("Listeners.member.1.LoadBalancerPort"), check.Equals, "80")
+}
+
+func (s *S) TestELBManagerCreateVPC(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:elb:use-vpc", true)
+	config.Set("juju:elb:vpc-subnets", []string{"subnet-a4fc12e0"})
+	defer config.Unset("juju:elb:use-vpc")
+	defer config.Unset("juju:elb:vpc-subnets")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	reqs := srv.requests("CreateLoadBalancer")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("Subnets.member.1"), check.Equals, "subnet-a4fc12e0")
+	c.Assert(reqs[0].Get("Scheme"), check.Equals, "internal")
+}
+
+func (s *S) TestELBManagerRegisterAndDeregister(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Register(app, "i-00000zz6")
+	c.Assert(err, check.IsNil)
+	err = manager.Deregister(app, "i-00000zz6")
+	c.Assert(err, check.IsNil)
+	reqs := srv.requests("RegisterInstancesWithLoadBalancer")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("Instances.member.1.InstanceId"), check.Equals, "i-00000zz6")
+	reqs = srv.requests("DeregisterInstancesFromLoadBalancer")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("Instances.member.1.InstanceId"), check.Equals, "i-00000zz6")
+}
+
+func (s *S) TestELBManagerAddrCachesDNSName(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	addr, err := manager.Addr(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(addr, check.Equals, "radiohead.us-east-1.elb.amazonaws.com")
+	addr, err = manager.Addr(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(addr, check.Equals, "radiohead.us-east-1.elb.amazonaws.com")
+	c.Assert(srv.requests("DescribeLoadBalancers"), check.HasLen, 0)
+}
+
+func (s *S) TestELBManagerDestroyInvalidatesCachedAddr(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	_, err = manager.Addr(app)
+	c.Assert(err, check.IsNil)
+	err = manager.Destroy(app)
+	c.Assert(err, check.IsNil)
+	_, err = manager.Addr(app)
+	c.Assert(err, check.Equals, ErrLoadBalancerNotFound)
+}
+
+func (s *S) TestAddrUsesELBWhenEnabled(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	p := &jujuProvisioner{}
+	manager := p.LoadBalancer()
+	c.Assert(manager, check.NotNil)
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	addr, err := p.Addr(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(addr, check.Equals, "radiohead.us-east-1.elb.amazonaws.com")
+}
+
+func (s *S) TestInstanceHealth(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	srv.healthResponse = outOfServiceHealthResponse
+	manager := ELBManager{}
+	healths, err := manager.InstanceHealth(&namedApp{name: "symfonia"})
+	c.Assert(err, check.IsNil)
+	c.Assert(healths, check.DeepEquals, []InstanceHealth{
+		{
+			InstanceID:  "i-00000zz5",
+			State:       "OutOfService",
+			ReasonCode:  "Instance",
+			Description: "Instance has failed at least the UnhealthyThreshold number of health checks consecutively.",
+		},
+		{
+			InstanceID:  "i-00000zz6",
+			State:       "InService",
+			ReasonCode:  "N/A",
+			Description: "N/A",
+		},
+	})
+	c.Assert(srv.reqs, check.HasLen, 1)
+	c.Assert(srv.reqs[0].Get("Action"), check.Equals, "DescribeInstanceHealth")
+	c.Assert(srv.reqs[0].Get("LoadBalancerName"), check.Equals, "symfonia")
+}
+
+func (s *S) TestInstanceHealthNotFound(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	srv.healthResponse = lbNotFoundResponse
+	manager := ELBManager{}
+	healths, err := manager.InstanceHealth(&namedApp{name: "symfonia"})
+	c.Assert(err, check.Equals, ErrLoadBalancerNotFound)
+	c.Assert(healths, check.IsNil)
+}
+
+func (s *S) TestELBManagerCreateLBCookieStickiness(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:elb:stickiness:policy", "lb-cookie")
+	config.Set("juju:elb:stickiness:expiration", 300)
+	defer config.Unset("juju:elb:stickiness:policy")
+	defer config.Unset("juju:elb:stickiness:expiration")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	reqs := srv.requests("CreateLBCookieStickinessPolicy")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("LoadBalancerName"), check.Equals, "radiohead")
+	c.Assert(reqs[0].Get("PolicyName"), check.Equals, stickinessPolicyName)
+	c.Assert(reqs[0].Get("CookieExpirationPeriod"), check.Equals, "300")
+	reqs = srv.requests("SetLoadBalancerPoliciesOfListener")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("LoadBalancerPort"), check.Equals, "80")
+	c.Assert(reqs[0].Get("PolicyNames.member.1"), check.Equals, stickinessPolicyName)
+}
+
+func (s *S) TestELBManagerCreateAppCookieStickiness(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:elb:stickiness:policy", "app-cookie")
+	config.Set("juju:elb:stickiness:cookie-name", "JSESSIONID")
+	defer config.Unset("juju:elb:stickiness:policy")
+	defer config.Unset("juju:elb:stickiness:cookie-name")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	reqs := srv.requests("CreateAppCookieStickinessPolicy")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("CookieName"), check.Equals, "JSESSIONID")
+	c.Assert(srv.requests("SetLoadBalancerPoliciesOfListener"), check.HasLen, 1)
+}
+
+func (s *S) TestELBManagerCreateAppCookieStickinessMissingCookie(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:elb:stickiness:policy", "app-cookie")
+	defer config.Unset("juju:elb:stickiness:policy")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.ErrorMatches, "juju: elb:stickiness:cookie-name must be defined for app-cookie stickiness")
+}
+
+func (s *S) TestELBManagerDescribe(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	desc, err := manager.Describe(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(desc, check.NotNil)
+	c.Assert(*desc.LoadBalancerName, check.Equals, "radiohead")
+	c.Assert(*desc.DNSName, check.Equals, "radiohead.us-east-1.elb.amazonaws.com")
+}
+
+func (s *S) TestELBManagerDescribeNotFound(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	desc, err := manager.Describe(app)
+	c.Assert(err, check.Equals, ErrLoadBalancerNotFound)
+	c.Assert(desc, check.IsNil)
+}
+
+func (s *S) TestELBManagerCreateIsIdempotent(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	err = manager.Create(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.requests("CreateLoadBalancer"), check.HasLen, 2)
+	addr, err := manager.Addr(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(addr, check.Equals, "radiohead.us-east-1.elb.amazonaws.com")
+}
+
+func (s *S) TestELBManagerNamedBalancers(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:elb:groups:admin:instance-port", 8080)
+	config.Set("juju:elb:groups:admin:port", 8081)
+	defer config.Unset("juju:elb:groups:admin:instance-port")
+	defer config.Unset("juju:elb:groups:admin:port")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.CreateNamed(app, "admin")
+	c.Assert(err, check.IsNil)
+	reqs := srv.requests("CreateLoadBalancer")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("LoadBalancerName"), check.Equals, "radiohead-admin")
+	c.Assert(reqs[0].Get("Listeners.member.1.InstancePort"), check.Equals, "8080")
+	c.Assert(reqs[0].Get("Listeners.member.1.LoadBalancerPort"), check.Equals, "8081")
+	addr, err := manager.AddrNamed(app, "admin")
+	c.Assert(err, check.IsNil)
+	c.Assert(addr, check.Equals, "radiohead-admin.us-east-1.elb.amazonaws.com")
+	err = manager.DestroyNamed(app, "admin")
+	c.Assert(err, check.IsNil)
+	_, err = manager.AddrNamed(app, "admin")
+	c.Assert(err, check.Equals, ErrLoadBalancerNotFound)
+}
+
+func (s *S) TestELBManagerNamedBalancersDefaultListeners(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.CreateNamed(app, "admin")
+	c.Assert(err, check.IsNil)
+	reqs := srv.requests("CreateLoadBalancer")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("Listeners.member.1.LoadBalancerPort"), check.Equals, "80")
+}
+
+func (s *S) TestELBManagerReconcile(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	srv.instances["radiohead"] = []string{"i-stale"}
+	s.addInstances(c,
+		instance{UnitName: "radiohead/0", AppName: "radiohead", InstanceID: "i-fresh", Status: provision.StatusStarted.String()},
+		instance{UnitName: "radiohead/1", AppName: "radiohead", InstanceID: "i-creating", Status: StatusCreating.String()},
+	)
+	err = manager.Reconcile(app)
+	c.Assert(err, check.IsNil)
+	reqs := srv.requests("RegisterInstancesWithLoadBalancer")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("Instances.member.1.InstanceId"), check.Equals, "i-fresh")
+	reqs = srv.requests("DeregisterInstancesFromLoadBalancer")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("Instances.member.1.InstanceId"), check.Equals, "i-stale")
+}
+
+func (s *S) TestELBManagerReconcileNoop(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	srv.instances["radiohead"] = []string{"i-fresh"}
+	s.addInstances(c, instance{UnitName: "radiohead/0", AppName: "radiohead", InstanceID: "i-fresh", Status: provision.StatusStarted.String()})
+	err = manager.Reconcile(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.requests("RegisterInstancesWithLoadBalancer"), check.HasLen, 0)
+	c.Assert(srv.requests("DeregisterInstancesFromLoadBalancer"), check.HasLen, 0)
+}
+
+func (s *S) TestELBManagerCreateAppliesIdleTimeout(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:elb:idle-timeout", 300)
+	defer config.Unset("juju:elb:idle-timeout")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	reqs := srv.requests("ModifyLoadBalancerAttributes")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("LoadBalancerName"), check.Equals, "radiohead")
+	c.Assert(reqs[0].Get("LoadBalancerAttributes.ConnectionSettings.IdleTimeout"), check.Equals, "300")
+}
+
+func (s *S) TestELBManagerCreatePerAppIdleTimeout(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:elb:idle-timeout", 300)
+	config.Set("juju:elb:apps:radiohead:idle-timeout", 3600)
+	defer config.Unset("juju:elb:idle-timeout")
+	defer config.Unset("juju:elb:apps:radiohead:idle-timeout")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	reqs := srv.requests("ModifyLoadBalancerAttributes")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("LoadBalancerAttributes.ConnectionSettings.IdleTimeout"), check.Equals, "3600")
+}
+
+func (s *S) TestELBManagerCreateNoIdleTimeout(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.requests("ModifyLoadBalancerAttributes"), check.HasLen, 0)
+}
+
+func (s *S) TestIdleTimeoutOutOfRange(c *check.C) {
+	config.Set("juju:elb:idle-timeout", 0)
+	defer config.Unset("juju:elb:idle-timeout")
+	_, err := idleTimeout("radiohead")
+	c.Assert(err, check.ErrorMatches, "juju: elb idle timeout must be between 1 and 3600 seconds, got 0")
+	config.Set("juju:elb:idle-timeout", 3601)
+	_, err = idleTimeout("radiohead")
+	c.Assert(err, check.ErrorMatches, "juju: elb idle timeout must be between 1 and 3600 seconds, got 3601")
+}
+
+const httpListenerXML = `<member><Listener><Protocol>HTTP</Protocol><LoadBalancerPort>80</LoadBalancerPort><InstanceProtocol>HTTP</InstanceProtocol><InstancePort>80</InstancePort></Listener></member>`
+
+func (s *S) TestELBManagerUpdateListeners(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	srv.listeners["radiohead"] = httpListenerXML +
+		`<member><Listener><Protocol>HTTP</Protocol><LoadBalancerPort>8080</LoadBalancerPort><InstanceProtocol>HTTP</InstanceProtocol><InstancePort>8080</InstancePort></Listener></member>`
+	desired := []*elb.Listener{
+		{
+			InstancePort:     aws.Int64(80),
+			InstanceProtocol: aws.String("HTTP"),
+			LoadBalancerPort: aws.Int64(80),
+			Protocol:         aws.String("HTTP"),
+		},
+		{
+			InstancePort:     aws.Int64(80),
+			InstanceProtocol: aws.String("HTTP"),
+			LoadBalancerPort: aws.Int64(443),
+			Protocol:         aws.String("HTTPS"),
+			SSLCertificateId: aws.String("arn:aws:iam::123:server-certificate/cert"),
+		},
+	}
+	err = manager.UpdateListeners(app, desired)
+	c.Assert(err, check.IsNil)
+	reqs := srv.requests("DeleteLoadBalancerListeners")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("LoadBalancerPorts.member.1"), check.Equals, "8080")
+	reqs = srv.requests("CreateLoadBalancerListeners")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("Listeners.member.1.LoadBalancerPort"), check.Equals, "443")
+	c.Assert(reqs[0].Get("Listeners.member.1.Protocol"), check.Equals, "HTTPS")
+	c.Assert(reqs[0].Get("Listeners.member.1.SSLCertificateId"), check.Equals, "arn:aws:iam::123:server-certificate/cert")
+}
+
+func (s *S) TestELBManagerUpdateListenersNoop(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	srv.listeners["radiohead"] = httpListenerXML
+	err = manager.UpdateListeners(app, elbListeners())
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.requests("DeleteLoadBalancerListeners"), check.HasLen, 0)
+	c.Assert(srv.requests("CreateLoadBalancerListeners"), check.HasLen, 0)
+}
+
+func (s *S) TestELBManagerUpdateListenersChangedPort(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	srv.listeners["radiohead"] = httpListenerXML
+	desired := []*elb.Listener{{
+		InstancePort:     aws.Int64(8888),
+		InstanceProtocol: aws.String("HTTP"),
+		LoadBalancerPort: aws.Int64(80),
+		Protocol:         aws.String("HTTP"),
+	}}
+	err = manager.UpdateListeners(app, desired)
+	c.Assert(err, check.IsNil)
+	reqs := srv.requests("DeleteLoadBalancerListeners")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("LoadBalancerPorts.member.1"), check.Equals, "80")
+	reqs = srv.requests("CreateLoadBalancerListeners")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("Listeners.member.1.InstancePort"), check.Equals, "8888")
+}
+
+func (s *S) TestELBManagerUpdateListenersNotFound(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.UpdateListeners(app, elbListeners())
+	c.Assert(err, check.Equals, ErrLoadBalancerNotFound)
+}
+
+func (s *S) TestELBManagerCreateVPCSecurityGroups(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:elb:use-vpc", true)
+	config.Set("juju:elb:vpc-subnets", []string{"subnet-a4fc12e0"})
+	config.Set("juju:elb:security-groups", []string{"sg-0ff1ce", "sg-badcafe"})
+	defer config.Unset("juju:elb:use-vpc")
+	defer config.Unset("juju:elb:vpc-subnets")
+	defer config.Unset("juju:elb:security-groups")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.IsNil)
+	reqs := srv.requests("CreateLoadBalancer")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("SecurityGroups.member.1"), check.Equals, "sg-0ff1ce")
+	c.Assert(reqs[0].Get("SecurityGroups.member.2"), check.Equals, "sg-badcafe")
+}
+
+func (s *S) TestELBManagerCreateSecurityGroupsWithoutVPC(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:elb:security-groups", []string{"sg-0ff1ce"})
+	defer config.Unset("juju:elb:security-groups")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.ErrorMatches, `juju: failed to create load balancer for app "radiohead": juju: elb:security-groups requires juju:elb:use-vpc and juju:elb:vpc-subnets`)
+	cerr, ok := err.(*ELBCreateError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(cerr.Timeout, check.Equals, false)
+	c.Assert(cerr.RolledBack, check.Equals, false)
+	c.Assert(srv.requests("CreateLoadBalancer"), check.HasLen, 0)
+	c.Assert(srv.requests("DeleteLoadBalancer"), check.HasLen, 0)
+}
+
+func (s *S) TestELBManagerCreateTimeout(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	srv.delay = 150 * time.Millisecond
+	config.Set("juju:elb:create-timeout", "50ms")
+	defer config.Unset("juju:elb:create-timeout")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.NotNil)
+	cerr, ok := err.(*ELBCreateError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(cerr.AppName, check.Equals, "radiohead")
+	c.Assert(cerr.Timeout, check.Equals, true)
+	c.Assert(cerr.RolledBack, check.Equals, false)
+	c.Assert(err, check.ErrorMatches, `juju: timed out creating load balancer for app "radiohead": no response after 50ms`)
+	// The rollback waits for the in-flight attempt to resolve, so it doesn't
+	// race the creation it's undoing.
+	err = (&jujuProvisioner{}).Shutdown(5 * time.Second)
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.requests("DeleteLoadBalancer"), check.HasLen, 1)
+}
+
+func (s *S) TestELBManagerCreateSetupFailureRollsBack(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:elb:stickiness:policy", "app-cookie")
+	defer config.Unset("juju:elb:stickiness:policy")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.ErrorMatches, `juju: failed to create load balancer for app "radiohead": juju: elb:stickiness:cookie-name must be defined for app-cookie stickiness`)
+	cerr, ok := err.(*ELBCreateError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(cerr.RolledBack, check.Equals, true)
+	c.Assert(srv.requests("DeleteLoadBalancer"), check.HasLen, 1)
+}
+
+func (s *S) TestELBManagerCreateDoesNotRollBackPreexistingBalancer(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	srv.dnsNames["radiohead"] = "radiohead.us-east-1.elb.amazonaws.com"
+	config.Set("juju:elb:stickiness:policy", "app-cookie")
+	defer config.Unset("juju:elb:stickiness:policy")
+	app := provisiontest.NewFakeApp("radiohead", "python", 0)
+	manager := ELBManager{}
+	err := manager.Create(app)
+	c.Assert(err, check.NotNil)
+	cerr, ok := err.(*ELBCreateError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(cerr.RolledBack, check.Equals, false)
+	c.Assert(srv.requests("DeleteLoadBalancer"), check.HasLen, 0)
+}
+
+func (s *S) TestELBManagerInstances(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	srv.dnsNames["symfonia"] = "symfonia.us-east-1.elb.amazonaws.com"
+	srv.instances["symfonia"] = []string{"i-00000zz6", "i-00000zz5"}
+	manager := ELBManager{}
+	ids, err := manager.Instances(&namedApp{name: "symfonia"})
+	c.Assert(err, check.IsNil)
+	c.Assert(ids, check.DeepEquals, []string{"i-00000zz5", "i-00000zz6"})
+}
+
+func (s *S) TestELBManagerInstancesNotFound(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	manager := ELBManager{}
+	ids, err := manager.Instances(&namedApp{name: "symfonia"})
+	c.Assert(err, check.Equals, ErrLoadBalancerNotFound)
+	c.Assert(ids, check.IsNil)
+}
+
+func (s *S) TestELBManagerCreateWithAccessLog(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:elb:access-log:enabled", true)
+	config.Set("juju:elb:access-log:bucket", "tsuru-elb-logs")
+	config.Set("juju:elb:access-log:prefix", "apps")
+	config.Set("juju:elb:access-log:interval", 5)
+	manager := ELBManager{}
+	err := manager.Create(&namedApp{name: "audited"})
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.reqs, check.HasLen, 2)
+	req := srv.reqs[1]
+	c.Assert(req.Get("Action"), check.Equals, "ModifyLoadBalancerAttributes")
+	c.Assert(req.Get("LoadBalancerAttributes.AccessLog.Enabled"), check.Equals, "true")
+	c.Assert(req.Get("LoadBalancerAttributes.AccessLog.S3BucketName"), check.Equals, "tsuru-elb-logs")
+	c.Assert(req.Get("LoadBalancerAttributes.AccessLog.S3BucketPrefix"), check.Equals, "apps")
+	c.Assert(req.Get("LoadBalancerAttributes.AccessLog.EmitInterval"), check.Equals, "5")
+}
+
+func (s *S) TestELBManagerCreateAccessLogWithoutBucket(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:elb:access-log:enabled", true)
+	manager := ELBManager{}
+	err := manager.Create(&namedApp{name: "audited"})
+	c.Assert(err, check.ErrorMatches, "juju: elb:access-log:bucket must be defined when access logs are enabled")
+}
+
+func (s *S) TestELBManagerCreateAccessLogDisabled(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	manager := ELBManager{}
+	err := manager.Create(&namedApp{name: "audited"})
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.reqs, check.HasLen, 1)
+}
+
+func (s *S) TestELBManagerReconcileSkipsCordonedUnits(c *check.C) {
+	server := s.startELBServer()
+	defer server.close()
+	server.dnsNames["symbolic"] = "symbolic.us-east-1.elb.amazonaws.com"
+	s.addInstances(c,
+		instance{UnitName: "symbolic/0", AppName: "symbolic", Machine: 1, InstanceID: "i-00000zz5", Status: provision.StatusStarted.String()},
+		instance{UnitName: "symbolic/1", AppName: "symbolic", Machine: 2, InstanceID: "i-00000zz6", Status: provision.StatusStarted.String(), Cordoned: true},
+	)
+	manager := ELBManager{}
+	err := manager.Reconcile(&namedApp{name: "symbolic"})
+	c.Assert(err, check.IsNil)
+	reqs := server.requests("RegisterInstancesWithLoadBalancer")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("Instances.member.1.InstanceId"), check.Equals, "i-00000zz5")
+	c.Assert(reqs[0].Get("Instances.member.2.InstanceId"), check.Equals, "")
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"github.com/tsuru/tsuru/provision"
+)
+
+// UnitMetrics holds a point-in-time sample of the resource usage of one
+// unit, as read from the machine itself. Memory and disk figures are in
+// bytes.
+type UnitMetrics struct {
+	Load1       float64
+	Load5       float64
+	Load15      float64
+	MemoryTotal uint64
+	MemoryUsed  uint64
+	DiskTotal   uint64
+	DiskUsed    uint64
+}
+
+// metricsScript samples load, memory and root filesystem usage on a unit.
+// Each probe is prefixed with a marker line so the parser can split the
+// output without guessing at formats.
+const metricsScript = "echo ===load===; cat /proc/loadavg; echo ===mem===; free -b | grep Mem; echo ===disk===; df -k / | tail -1"
+
+// CollectMetrics samples the resource usage of every unit of the app,
+// indexed by unit name. It reuses the command fan-out, so units that are
+// down are skipped, like any other command would skip them.
+func (p *jujuProvisioner) CollectMetrics(app provision.App) (map[string]UnitMetrics, error) {
+	results, err := p.ExecuteCommandResults(provision.ExecOptions{
+		App:  app,
+		Cmds: []string{"/bin/sh", "-c", shellQuote(metricsScript)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	metrics := make(map[string]UnitMetrics, len(results))
+	for unitName, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		m, err := parseUnitMetrics(result.Stdout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse metrics of unit %q", unitName)
+		}
+		metrics[unitName] = m
+	}
+	return metrics, nil
+}
+
+// parseUnitMetrics parses the output of metricsScript. It takes the first
+// non-empty line after each marker, so extra noise from shell profiles
+// doesn't break the parsing.
+func parseUnitMetrics(output string) (UnitMetrics, error) {
+	var m UnitMetrics
+	sections := make(map[string]string)
+	var current string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "===") && strings.HasSuffix(line, "===") {
+			current = strings.Trim(line, "=")
+			continue
+		}
+		if current != "" && line != "" && sections[current] == "" {
+			sections[current] = line
+		}
+	}
+	load := strings.Fields(sections["load"])
+	if len(load) < 3 {
+		return m, errors.Errorf("juju: invalid loadavg output %q", sections["load"])
+	}
+	m.Load1, _ = strconv.ParseFloat(load[0], 64)
+	m.Load5, _ = strconv.ParseFloat(load[1], 64)
+	m.Load15, _ = strconv.ParseFloat(load[2], 64)
+	mem := strings.Fields(sections["mem"])
+	if len(mem) < 3 {
+		return m, errors.Errorf("juju: invalid free output %q", sections["mem"])
+	}
+	m.MemoryTotal, _ = strconv.ParseUint(mem[1], 10, 64)
+	m.MemoryUsed, _ = strconv.ParseUint(mem[2], 10, 64)
+	disk := strings.Fields(sections["disk"])
+	if len(disk) < 3 {
+		return m, errors.Errorf("juju: invalid df output %q", sections["disk"])
+	}
+	blocks, _ := strconv.ParseUint(disk[1], 10, 64)
+	used, _ := strconv.ParseUint(disk[2], 10, 64)
+	m.DiskTotal = blocks * 1024
+	m.DiskUsed = used * 1024
+	return m, nil
+}
+
+// lastCollectStatus records how long the most recent full CollectStatus run
+// took, so Metrics can report it without running "juju status" itself.
+var lastCollectStatus = struct {
+	sync.Mutex
+	duration time.Duration
+}{}
+
+func recordCollectStatusDuration(d time.Duration) {
+	lastCollectStatus.Lock()
+	defer lastCollectStatus.Unlock()
+	lastCollectStatus.duration = d
+}
+
+func collectStatusDuration() time.Duration {
+	lastCollectStatus.Lock()
+	defer lastCollectStatus.Unlock()
+	return lastCollectStatus.duration
+}
+
+// Metrics reports the provisioner gauges — provisioned apps, units in total
+// and by status, instances registered with a load balancer, and the duration
+// of the last status collection — keyed by metric name, for the metrics
+// endpoint to expose. Everything comes from the units collection and cached
+// values, so scraping stays cheap.
+func (p *jujuProvisioner) Metrics() (map[string]float64, error) {
+	coll, err := unitsCollection()
+	if err != nil {
+		return nil, err
+	}
+	defer coll.Close()
+	metrics := map[string]float64{
+		"collect_status_duration_seconds": collectStatusDuration().Seconds(),
+	}
+	var apps []string
+	err = coll.Find(nil).Distinct("app", &apps)
+	if err != nil {
+		return nil, err
+	}
+	metrics["apps"] = float64(len(apps))
+	var counts []struct {
+		Status string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+	err = coll.Pipe([]bson.M{{"$group": bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}}}).All(&counts)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, count := range counts {
+		metrics["units_status_"+count.Status] = float64(count.Count)
+		total += count.Count
+	}
+	metrics["units"] = float64(total)
+	registered, err := coll.Find(bson.M{"elbstate": bson.M{"$exists": true, "$ne": ""}}).Count()
+	if err != nil {
+		return nil, err
+	}
+	metrics["elb_registered_instances"] = float64(registered)
+	return metrics, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"time"
+
+	"github.com/tsuru/tsuru/exec/exectest"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	check "gopkg.in/check.v1"
+)
+
+const metricsOutput = `===load===
+0.42 0.30 0.24 1/120 4567
+===mem===
+Mem: 2090188800 1045094400 1045094400
+===disk===
+/dev/xvda1 8256952 2048312 5789216 27% /
+`
+
+func (s *S) TestParseUnitMetrics(c *check.C) {
+	m, err := parseUnitMetrics(metricsOutput)
+	c.Assert(err, check.IsNil)
+	c.Assert(m, check.DeepEquals, UnitMetrics{
+		Load1:       0.42,
+		Load5:       0.30,
+		Load15:      0.24,
+		MemoryTotal: 2090188800,
+		MemoryUsed:  1045094400,
+		DiskTotal:   8256952 * 1024,
+		DiskUsed:    2048312 * 1024,
+	})
+}
+
+func (s *S) TestParseUnitMetricsInvalid(c *check.C) {
+	_, err := parseUnitMetrics("garbage")
+	c.Assert(err, check.ErrorMatches, `juju: invalid loadavg output ""`)
+}
+
+func (s *S) TestCollectMetrics(c *check.C) {
+	output := map[string][][]byte{"*": {[]byte(metricsOutput)}}
+	fexec := exectest.FakeExecutor{Output: output}
+	execut = &fexec
+	s.addInstances(c,
+		instance{UnitName: "vigil/0", AppName: "vigil", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "vigil/1", AppName: "vigil", Machine: 2, Status: StatusDown.String()},
+	)
+	app := provisiontest.NewFakeApp("vigil", "python", 2)
+	p := &jujuProvisioner{}
+	metrics, err := p.CollectMetrics(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(metrics, check.HasLen, 1)
+	c.Assert(metrics["vigil/0"].Load1, check.Equals, 0.42)
+	c.Assert(metrics["vigil/0"].MemoryTotal, check.Equals, uint64(2090188800))
+	args := append(sshArgs("1"), "/bin/sh", "-c", shellQuote(metricsScript))
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestCollectMetricsEmptyApp(c *check.C) {
+	app := provisiontest.NewFakeApp("vigil", "python", 0)
+	p := &jujuProvisioner{}
+	metrics, err := p.CollectMetrics(app)
+	c.Assert(err, check.Equals, provision.ErrEmptyApp)
+	c.Assert(metrics, check.IsNil)
+}
+
+func (s *S) TestMetrics(c *check.C) {
+	s.addInstances(c,
+		instance{
+			UnitName: "lostkeys/0", AppName: "lostkeys", Machine: 0,
+			Status: provision.StatusStarted.String(), ELBState: "InService",
+		},
+		instance{
+			UnitName: "lostkeys/1", AppName: "lostkeys", Machine: 1,
+			Status: provision.StatusStarted.String(),
+		},
+		instance{
+			UnitName: "symfonia/0", AppName: "symfonia", Machine: 2,
+			Status: provision.StatusError.String(),
+		},
+	)
+	recordCollectStatusDuration(1500 * time.Millisecond)
+	p := &jujuProvisioner{}
+	metrics, err := p.Metrics()
+	c.Assert(err, check.IsNil)
+	c.Assert(metrics["apps"], check.Equals, 2.0)
+	c.Assert(metrics["units"], check.Equals, 3.0)
+	c.Assert(metrics["units_status_started"], check.Equals, 2.0)
+	c.Assert(metrics["units_status_error"], check.Equals, 1.0)
+	c.Assert(metrics["elb_registered_instances"], check.Equals, 1.0)
+	c.Assert(metrics["collect_status_duration_seconds"], check.Equals, 1.5)
+}
+
+func (s *S) TestMetricsEmptyEnvironment(c *check.C) {
+	recordCollectStatusDuration(0)
+	p := &jujuProvisioner{}
+	metrics, err := p.Metrics()
+	c.Assert(err, check.IsNil)
+	c.Assert(metrics["apps"], check.Equals, 0.0)
+	c.Assert(metrics["units"], check.Equals, 0.0)
+	c.Assert(metrics["elb_registered_instances"], check.Equals, 0.0)
+}
+
+func (s *S) TestCollectStatusRecordsDuration(c *check.C) {
+	recordCollectStatusDuration(0)
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(collectOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	_, err := p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	c.Assert(collectStatusDuration() > 0, check.Equals, true)
+}
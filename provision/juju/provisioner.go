@@ -0,0 +1,2820 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package juju provides a provisioner implementation that talks to a juju
+// environment, mapping each tsuru app to a juju service and each unit to a
+// juju unit backed by a cloud machine.
+package juju
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/db/storage"
+	"github.com/tsuru/tsuru/exec"
+	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/repository"
+	appTypes "github.com/tsuru/tsuru/types/app"
+)
+
+const (
+	provisionerName        = "juju"
+	defaultUnitsCollection = "juju_units"
+
+	restartHook       = "/var/lib/tsuru/hooks/restart"
+	startHook         = "/var/lib/tsuru/hooks/start"
+	stopHook          = "/var/lib/tsuru/hooks/stop"
+	defaultDeployHook = "/var/lib/tsuru/hooks/deploy"
+)
+
+// StatusDown is the status of units whose juju agent stopped responding. It
+// complements the set of statuses defined in the provision package.
+const StatusDown = provision.Status("down")
+
+// StatusDegraded is the status of units that juju reports as started but
+// whose instances are failing the load balancer health check, for fewer
+// consecutive checks than the unhealthy threshold. It's an early warning:
+// degraded units stay registered with the balancer so they can recover.
+const StatusDegraded = provision.Status("degraded")
+
+var unitAddedRegexp = regexp.MustCompile(`Unit '(\S+/\d+)' added to machine (\d+)`)
+
+func init() {
+	provision.Register(provisionerName, func() (provision.Provisioner, error) {
+		return &jujuProvisioner{}, nil
+	})
+}
+
+// background tracks the goroutines spawned by the provisioner (machine
+// terminations, instance id updates), so Shutdown can drain them during a
+// graceful restart.
+var background sync.WaitGroup
+
+// spawn runs fn in a goroutine tracked by the background wait group.
+func spawn(fn func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		fn()
+	}()
+}
+
+var execut exec.Executor
+
+func executor() exec.Executor {
+	if execut == nil {
+		execut = exec.OsExecutor{}
+	}
+	return execut
+}
+
+// instance is the document kept in the units collection, mapping a juju unit
+// to the IaaS instance that backs it.
+type instance struct {
+	UnitName       string `bson:"_id"`
+	AppName        string `bson:"app"`
+	Service        string `bson:"service,omitempty"`
+	Machine        int    `bson:"machine"`
+	Container      string `bson:"container,omitempty"`
+	InstanceID     string `bson:"instanceid"`
+	InstanceType   string `bson:"instancetype,omitempty"`
+	Type           string `bson:"type,omitempty"`
+	Process        string `bson:"process,omitempty"`
+	Zone           string `bson:"zone,omitempty"`
+	PublicAddress  string `bson:"publicaddress"`
+	PrivateAddress string `bson:"privateaddress,omitempty"`
+	Status         string `bson:"status"`
+	Exposed        bool   `bson:"exposed,omitempty"`
+	Transient      bool   `bson:"transient,omitempty"`
+
+	// PreStartPending blocks Start for the whole app while a PreStart command
+	// hasn't succeeded. See PreStart.
+	PreStartPending bool `bson:"prestartpending,omitempty"`
+
+	// Frozen suppresses the side effects of status collection for this unit
+	// while its fields keep being updated. See Freeze.
+	Frozen bool `bson:"frozen,omitempty"`
+
+	// Cordoned marks the unit as drained for host maintenance: it's kept out
+	// of the load balancer (including by Reconcile) until the machine is
+	// uncordoned.
+	Cordoned bool `bson:"cordoned,omitempty"`
+
+	// KeysInjected marks that the operator ssh keys were already pushed to
+	// this unit, so the injection task doesn't run twice on it.
+	KeysInjected bool `bson:"keysinjected,omitempty"`
+
+	// CreatedAt records when the provisioner first saw the unit, so stuck
+	// units can be told apart from ones that are still legitimately booting.
+	CreatedAt time.Time `bson:"createdat,omitempty"`
+
+	// ELB health data, filled by CollectStatus when ELB support is enabled.
+	// The reason code and description are only present while the instance is
+	// OutOfService.
+	ELBState       string `bson:"elbstate,omitempty"`
+	ELBReasonCode  string `bson:"elbreasoncode,omitempty"`
+	ELBDescription string `bson:"elbdescription,omitempty"`
+
+	// Pool is the machine pool the unit was placed on, for apps pinned to a
+	// pool of pre-provisioned machines. Empty for units on cloud machines.
+	Pool string `bson:"pool,omitempty"`
+
+	// ConfigHash is the hash of the app configuration the unit last applied,
+	// recorded when the unit is added or restarted. It lets the collector
+	// skip the restart of units whose instance id rotated under unchanged
+	// config.
+	ConfigHash string `bson:"confighash,omitempty"`
+
+	// ELBFailedChecks counts the consecutive status collections that found
+	// the instance failing its health check; it resets when the instance is
+	// back InService.
+	ELBFailedChecks int `bson:"elbfailedchecks,omitempty"`
+}
+
+func unitsCollection() (*storage.Collection, error) {
+	name, err := config.GetString("juju:units-collection")
+	if err != nil {
+		name = defaultUnitsCollection
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Collection(name), nil
+}
+
+type jujuProvisioner struct {
+	elb     bool
+	elbOnce sync.Once
+}
+
+// elbSupport tells whether the provisioner should manage an Elastic Load
+// Balancer per app, as defined by the juju:use-elb setting. The flag is read
+// once and kept for the provisioner lifetime; the sync.Once makes the lazy
+// read safe for the concurrent callers of CollectStatus.
+func (p *jujuProvisioner) elbSupport() bool {
+	p.elbOnce.Do(func() {
+		p.elb, _ = config.GetBool("juju:use-elb")
+	})
+	return p.elb
+}
+
+// elbAutoRegister tells whether the provisioner should manage the membership
+// of units in the app's load balancer, as defined by juju:elb:auto-register
+// (default true). When disabled, balancers are still created and destroyed
+// with the app, but registration is left to external automation.
+func (p *jujuProvisioner) elbAutoRegister() bool {
+	if auto, err := config.GetBool("juju:elb:auto-register"); err == nil {
+		return auto
+	}
+	return true
+}
+
+// LoadBalancer returns the manager of the load balancers used by apps, or nil
+// when ELB support is disabled.
+func (p *jujuProvisioner) LoadBalancer() *ELBManager {
+	if p.elbSupport() {
+		return &ELBManager{}
+	}
+	return nil
+}
+
+var (
+	_ provision.Provisioner              = &jujuProvisioner{}
+	_ provision.ExecutableProvisioner    = &jujuProvisioner{}
+	_ provision.InitializableProvisioner = &jujuProvisioner{}
+)
+
+func (p *jujuProvisioner) GetName() string {
+	return provisionerName
+}
+
+// Name returns the name under which the provisioner is registered. It's an
+// alias of GetName kept for introspection alongside Capabilities.
+func (p *jujuProvisioner) Name() string {
+	return provisionerName
+}
+
+// Capabilities lists the features the provisioner supports with the current
+// configuration, so the API can advertise them to clients. The "elb" flag is
+// only present when load balancer support is enabled.
+func (p *jujuProvisioner) Capabilities() []string {
+	caps := []string{"exec", "expose", "restart"}
+	if p.elbSupport() {
+		caps = append(caps, "elb")
+	}
+	return caps
+}
+
+// runCmd runs the juju command line tool with the given arguments, connecting
+// the subprocess output to the given writers.
+func runCmd(stdout, stderr io.Writer, args ...string) error {
+	return executor().Execute(exec.ExecuteOptions{
+		Cmd:    "juju",
+		Args:   args,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+}
+
+// execWithTimeout runs the juju command line tool like runCmd, but gives up
+// after the given timeout. The timeout is also handed to the executor, which
+// kills the subprocess when it expires, so a hung juju command doesn't outlive
+// the call. Output is copied to the given writers only when the command
+// finishes in time, keeping them out of reach of an abandoned attempt.
+func execWithTimeout(timeout time.Duration, stdout, stderr io.Writer, args ...string) error {
+	var outBuf, errBuf bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		done <- executor().Execute(exec.ExecuteOptions{
+			Cmd:     "juju",
+			Args:    args,
+			Stdout:  &outBuf,
+			Stderr:  &errBuf,
+			Timeout: timeout,
+		})
+	}()
+	select {
+	case err := <-done:
+		stdout.Write(outBuf.Bytes())
+		stderr.Write(errBuf.Bytes())
+		return err
+	case <-time.After(timeout):
+		return errors.Errorf("%q did not finish within %s", "juju "+strings.Join(args, " "), timeout)
+	}
+}
+
+func (p *jujuProvisioner) Provision(app provision.App) error {
+	return p.provision(app, nil)
+}
+
+// ProvisionWithProgress works like Provision, but streams the output of the
+// juju deploy to the given writer as it's produced, so clients pushing code
+// can watch the deploy progress instead of staring at a silent terminal.
+func (p *jujuProvisioner) ProvisionWithProgress(app provision.App, w io.Writer) error {
+	return p.provision(app, w)
+}
+
+func (p *jujuProvisioner) provision(app provision.App, w io.Writer) error {
+	start := time.Now()
+	log.Debugf("juju: event=provision-start app=%s", app.GetName())
+	err := p.deployService(app.GetName(), app.GetPlatform(), appEnvironment(app), w)
+	defer func() {
+		log.Debugf("juju: event=provision-end app=%s duration=%s", app.GetName(), time.Since(start))
+	}()
+	if err == nil {
+		return p.postDeploySetup(app)
+	}
+	if _, ok := err.(*provision.Error); !ok {
+		// Configuration errors won't go away by themselves, so there is no
+		// point in retrying.
+		return err
+	}
+	if qErr := p.enqueueProvisionRetry(app.GetName(), app.GetPlatform(), appEnvironment(app), 1); qErr != nil {
+		log.Errorf("juju: failed to enqueue provision retry for %q: %s", app.GetName(), qErr)
+		return err
+	}
+	log.Errorf("juju: provision of %q failed, retry enqueued: %s", app.GetName(), err)
+	return nil
+}
+
+// postDeploySetup runs the steps that follow a successful service deploy:
+// creating the app's load balancer and enqueueing ssh key injection and DNS
+// registration. Provision and the provision retry task share it, so a deploy
+// that only succeeded on retry ends up with the same surroundings as one that
+// succeeded first try.
+func (p *jujuProvisioner) postDeploySetup(app provision.Named) error {
+	if p.elbSupport() {
+		if err := p.LoadBalancer().Create(app); err != nil {
+			return err
+		}
+	}
+	if len(authorizedKeys()) > 0 {
+		if err := enqueueSSHKeys(app.GetName()); err != nil {
+			return errors.Wrapf(err, "failed to enqueue ssh key injection for app %q", app.GetName())
+		}
+	}
+	if p.dnsSupport() {
+		return enqueueDNSRegister(app.GetName())
+	}
+	return nil
+}
+
+// ErrCharmsPathUndefined is the error returned by Provision when charm
+// deploys need juju:charms-path and it's not defined in the configuration.
+var ErrCharmsPathUndefined = errors.New("juju: charms-path must be defined in config")
+
+// platformConstraints returns the default juju constraints of services
+// deployed from the platform, as defined by the
+// juju:platform-defaults:<platform>:constraints setting.
+func platformConstraints(platform string) string {
+	constraints, _ := config.GetString("juju:platform-defaults:" + platform + ":constraints")
+	return constraints
+}
+
+// platformEnv returns the default environment variables of apps deployed
+// from the platform, as defined by the juju:platform-defaults:<platform>:env
+// section.
+func platformEnv(platform string) map[string]string {
+	raw, err := config.Get("juju:platform-defaults:" + platform + ":env")
+	if err != nil {
+		return nil
+	}
+	m, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	env := make(map[string]string, len(m))
+	for k, v := range m {
+		env[fmt.Sprintf("%v", k)] = fmt.Sprintf("%v", v)
+	}
+	return env
+}
+
+// appEnvValue renders an environment map as the value of the app-env charm
+// option, with the variables sorted for a deterministic command line.
+func appEnvValue(env map[string]string) string {
+	pairs := make([]string, 0, len(env))
+	for k, v := range env {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// mergeConstraints merges two juju constraints strings. Pairs in override
+// win over pairs with the same key in defaults.
+func mergeConstraints(defaults, override string) string {
+	merged := make([]string, 0, 4)
+	for _, pair := range strings.Fields(defaults) {
+		key := pair
+		if i := strings.Index(pair, "="); i >= 0 {
+			key = pair[:i]
+		}
+		if constraintValue(override, key) == "" {
+			merged = append(merged, pair)
+		}
+	}
+	merged = append(merged, strings.Fields(override)...)
+	return strings.Join(merged, " ")
+}
+
+// deployService runs the juju commands that create the service backing an
+// app, streaming the deploy output to the given writer (which may be nil).
+// It's called by Provision and retried by the provisionRetry queue task.
+func (p *jujuProvisioner) deployService(appName, platform, env string, w io.Writer) error {
+	serviceName, err := jujuServiceName(appName)
+	if err != nil {
+		return err
+	}
+	return p.deployNamedService(serviceName, appName, platform, env, w)
+}
+
+// deployNamedService is deployService with an explicit service name, shared
+// with ProvisionProcess, which deploys extra services for an app.
+func (p *jujuProvisioner) deployNamedService(serviceName, appName, platform, env string, w io.Writer) error {
+	if w == nil {
+		w = ioutil.Discard
+	}
+	args := append(environmentArgs(env), "deploy")
+	if charmSource() == "local" {
+		charmsPath, err := config.GetString("juju:charms-path")
+		if err != nil {
+			return ErrCharmsPathUndefined
+		}
+		args = append(args, "--repository", charmsPath)
+	}
+	if constraints := platformConstraints(platform); constraints != "" {
+		args = append(args, "--constraints", constraints)
+	}
+	revision, err := charmRevisionFor(appName)
+	if err != nil {
+		return err
+	}
+	charm := charmURL(platform)
+	if revision >= 0 {
+		// Pinned deploys name the revision explicitly ("local:python-5");
+		// otherwise juju picks the latest, as it always did.
+		charm = fmt.Sprintf("%s-%d", charm, revision)
+	}
+	args = append(args, charm, serviceName)
+	// The output goes to the writer as the subprocess produces it, and to the
+	// buffer for the error report on failure.
+	var buf bytes.Buffer
+	err = runCmd(io.MultiWriter(&buf, w), io.MultiWriter(&buf, w), args...)
+	if err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	buf.Reset()
+	args = append(environmentArgs(env), "set", serviceName, "app-repo="+repositoryURL(appName))
+	if defaults := platformEnv(platform); len(defaults) > 0 {
+		// The charm exports app-env into the unit environment before the
+		// app's own variables, so per-app settings take precedence.
+		args = append(args, "app-env="+appEnvValue(defaults))
+	}
+	err = runCmd(&buf, &buf, args...)
+	if err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	if revision >= 0 {
+		if err = recordDeployedCharmRevision(appName, revision); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// versionCache caches the output of "juju version". The juju binary doesn't
+// change while tsuru runs, so it's only queried once.
+var versionCache = struct {
+	sync.Mutex
+	version string
+	fetched bool
+}{}
+
+var jujuVersionRegexp = regexp.MustCompile(`^(\d+)\.(\d+)`)
+
+// jujuVersion returns the version of the installed juju binary (e.g.
+// "1.16.3-precise-amd64"), caching it after the first call. Newer binaries
+// answer "juju version"; older ones only understand "juju --version".
+func jujuVersion() (string, error) {
+	versionCache.Lock()
+	defer versionCache.Unlock()
+	if versionCache.fetched {
+		return versionCache.version, nil
+	}
+	var buf bytes.Buffer
+	err := runCmd(&buf, &buf, "version")
+	if err != nil {
+		buf.Reset()
+		if err = runCmd(&buf, &buf, "--version"); err != nil {
+			return "", &provision.Error{Reason: buf.String(), Err: err}
+		}
+	}
+	versionCache.version = strings.TrimSpace(buf.String())
+	versionCache.fetched = true
+	return versionCache.version, nil
+}
+
+// jujuVersionAtLeast reports whether the installed juju is at least
+// major.minor, so version-dependent argv — charm series requirements, status
+// format flags — can switch automatically instead of requiring manual
+// config. When the version can't be determined or parsed it reports false,
+// keeping the conservative behavior.
+func jujuVersionAtLeast(major, minor int) bool {
+	version, err := jujuVersion()
+	if err != nil {
+		return false
+	}
+	matches := jujuVersionRegexp.FindStringSubmatch(version)
+	if matches == nil {
+		return false
+	}
+	gotMajor, _ := strconv.Atoi(matches[1])
+	gotMinor, _ := strconv.Atoi(matches[2])
+	return gotMajor > major || (gotMajor == major && gotMinor >= minor)
+}
+
+// charmSource tells where charms are deployed from: "local" (the default)
+// uses the charms directory pointed to by juju:charms-path, while "store"
+// deploys community charms straight from the charm store.
+func charmSource() string {
+	if source, _ := config.GetString("juju:charm-source"); source == "store" {
+		return "store"
+	}
+	return "local"
+}
+
+// CharmHooks lists the hook scripts shipped by the platform's charm, read
+// from <charms-path>/<platform>/hooks, so callers can validate that a hook
+// exists before trying to run it on units.
+func (p *jujuProvisioner) CharmHooks(platform string) ([]string, error) {
+	charmsPath, err := config.GetString("juju:charms-path")
+	if err != nil {
+		return nil, ErrCharmsPathUndefined
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(charmsPath, platform, "hooks"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("juju: charm of platform %q not found in %s", platform, charmsPath)
+		}
+		return nil, err
+	}
+	hooks := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		hooks = append(hooks, entry.Name())
+	}
+	return hooks, nil
+}
+
+// charmURL returns the URL of the charm for the platform, in the local
+// repository or in the charm store, according to juju:charm-source. Newer
+// juju versions require the series in the URL; the juju:charm-series setting
+// adds it without breaking older setups, where the setting is simply absent.
+func charmURL(platform string) string {
+	scheme := charmSource() + ":"
+	if scheme == "store:" {
+		scheme = "cs:"
+	}
+	series, _ := config.GetString("juju:charm-series")
+	if series == "" && jujuVersionAtLeast(1, 16) {
+		// juju 1.16 started requiring the series in charm URLs; precise was
+		// its default series.
+		series = "precise"
+	}
+	if series != "" {
+		return fmt.Sprintf("%s%s/%s", scheme, series, platform)
+	}
+	return scheme + platform
+}
+
+// appCharm records the charm revision state of an app: the revision pinned
+// for its deploys and the revision last deployed, for charm upgrade
+// bookkeeping. A revision of -1 means "not set".
+type appCharm struct {
+	AppName  string `bson:"_id"`
+	Pinned   int    `bson:"pinned"`
+	Deployed int    `bson:"deployed"`
+}
+
+func appCharmsCollection() (*storage.Collection, error) {
+	name, err := config.GetString("juju:app-charms-collection")
+	if err != nil {
+		name = "juju_app_charms"
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Collection(name), nil
+}
+
+// PinCharmRevision pins the charm revision deployed for the app, overriding
+// the juju:charm-revision setting, so charm changes can be rolled out app by
+// app. A negative revision removes the pin.
+func (p *jujuProvisioner) PinCharmRevision(app provision.Named, revision int) error {
+	coll, err := appCharmsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	if revision < 0 {
+		revision = -1
+	}
+	_, err = coll.UpsertId(app.GetName(), bson.M{
+		"$set":         bson.M{"pinned": revision},
+		"$setOnInsert": bson.M{"deployed": -1},
+	})
+	return err
+}
+
+// DeployedCharmRevision returns the charm revision last deployed for the
+// app, or -1 when no pinned revision was ever deployed.
+func (p *jujuProvisioner) DeployedCharmRevision(app provision.Named) (int, error) {
+	coll, err := appCharmsCollection()
+	if err != nil {
+		return -1, err
+	}
+	defer coll.Close()
+	var stored appCharm
+	err = coll.FindId(app.GetName()).One(&stored)
+	if err == mgo.ErrNotFound {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return stored.Deployed, nil
+}
+
+// recordDeployedCharmRevision stores the charm revision a deploy just used.
+func recordDeployedCharmRevision(appName string, revision int) error {
+	coll, err := appCharmsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	_, err = coll.UpsertId(appName, bson.M{
+		"$set":         bson.M{"deployed": revision},
+		"$setOnInsert": bson.M{"pinned": -1},
+	})
+	return err
+}
+
+// charmRevisionFor returns the charm revision to deploy for the app: the
+// app's pin wins over the global juju:charm-revision setting. It returns -1
+// when neither is set, leaving revision selection to juju as before.
+func charmRevisionFor(appName string) (int, error) {
+	coll, err := appCharmsCollection()
+	if err != nil {
+		return -1, err
+	}
+	defer coll.Close()
+	var stored appCharm
+	err = coll.FindId(appName).One(&stored)
+	if err != nil && err != mgo.ErrNotFound {
+		return -1, err
+	}
+	if err == nil && stored.Pinned >= 0 {
+		return stored.Pinned, nil
+	}
+	if revision, err := config.GetInt("juju:charm-revision"); err == nil {
+		return revision, nil
+	}
+	return -1, nil
+}
+
+// environmentApp is the optional interface implemented by apps that declare
+// which juju environment they live in, when multiple environments share one
+// tsuru installation.
+type environmentApp interface {
+	Environment() string
+}
+
+// appEnvironment returns the juju environment of the app, or an empty string
+// for the default environment.
+func appEnvironment(app provision.App) string {
+	if ea, ok := app.(environmentApp); ok {
+		return ea.Environment()
+	}
+	return ""
+}
+
+// environmentArgs returns the flags that select the juju environment to run a
+// command against. It returns nothing for the default environment.
+func environmentArgs(env string) []string {
+	if env == "" {
+		return nil
+	}
+	return []string{"-e", env}
+}
+
+// serviceNameRegexp matches valid juju service names, which are stricter
+// than tsuru app names.
+var serviceNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9-]*[a-z0-9]$|^[a-z]$`)
+
+// jujuServiceName returns the name of the juju service backing the app,
+// normalizing characters juju doesn't accept (underscores become hyphens) and
+// validating the result. The juju:service-prefix setting allows multiple
+// tsuru installations to share a juju environment without name collisions.
+func jujuServiceName(appName string) (string, error) {
+	prefix, _ := config.GetString("juju:service-prefix")
+	name := prefix + strings.Replace(strings.ToLower(appName), "_", "-", -1)
+	if !serviceNameRegexp.MatchString(name) {
+		return "", errors.Errorf("juju: app name %q maps to invalid service name %q", appName, name)
+	}
+	return name, nil
+}
+
+// appNameFromService maps a juju service name back to the tsuru app name,
+// stripping the configured service prefix.
+func appNameFromService(serviceName string) string {
+	prefix, _ := config.GetString("juju:service-prefix")
+	if prefix != "" {
+		return strings.TrimPrefix(serviceName, prefix)
+	}
+	return serviceName
+}
+
+// processServiceName returns the name of the juju service backing one of the
+// app's processes, derived from the main service name and the process name.
+func processServiceName(appName, process string) (string, error) {
+	serviceName, err := jujuServiceName(appName)
+	if err != nil {
+		return "", err
+	}
+	name := serviceName + "-" + strings.Replace(strings.ToLower(process), "_", "-", -1)
+	if !serviceNameRegexp.MatchString(name) {
+		return "", errors.Errorf("juju: process %q maps to invalid service name %q", process, name)
+	}
+	return name, nil
+}
+
+// ProvisionProcess deploys an extra juju service for one of the app's
+// processes — a worker tier next to the web tier, for example. Units added
+// to the process (AddUnits with the process name) are tracked with the
+// Process field and can be targeted with ExecuteCommandOnProcess.
+func (p *jujuProvisioner) ProvisionProcess(app provision.App, process string) error {
+	if process == "" {
+		return errors.New("juju: process name cannot be empty")
+	}
+	serviceName, err := processServiceName(app.GetName(), process)
+	if err != nil {
+		return err
+	}
+	return p.deployNamedService(serviceName, app.GetName(), app.GetPlatform(), appEnvironment(app), nil)
+}
+
+// repositoryURL returns the URL of the app's repository, to be set in the
+// app-repo charm option. The juju:repo-scheme setting picks which form of
+// the URL the charm gets: anonymous read-only (the default), read-write or
+// ssh. An empty string is returned when the repository manager doesn't know
+// the app.
+func repositoryURL(appName string) string {
+	repo, err := repository.Manager().GetRepository(appName)
+	if err != nil {
+		log.Errorf("juju: failed to get repository for app %q: %s", appName, err)
+		return ""
+	}
+	var url string
+	scheme, _ := config.GetString("juju:repo-scheme")
+	switch scheme {
+	case "rw":
+		url = repo.ReadWriteURL
+	case "ssh":
+		url = sshRepoURL(repo.ReadWriteURL)
+	default:
+		url = readOnlyRepoURL(repo.ReadWriteURL)
+	}
+	return rewriteRepoURL(url)
+}
+
+// rewriteRepoURL applies the juju:repo-rewrite:from/to prefix replacement to
+// the repository URL, for air-gapped environments where units fetch code
+// from a mirror instead of the canonical repository host. URLs that don't
+// start with the configured prefix pass through untouched.
+func rewriteRepoURL(url string) string {
+	from, _ := config.GetString("juju:repo-rewrite:from")
+	if from == "" || !strings.HasPrefix(url, from) {
+		return url
+	}
+	to, _ := config.GetString("juju:repo-rewrite:to")
+	return to + strings.TrimPrefix(url, from)
+}
+
+// readOnlyRepoURL derives the anonymous read-only URL from the read-write
+// one (git@host:app.git becomes git://host/app.git).
+func readOnlyRepoURL(rwURL string) string {
+	i := strings.Index(rwURL, "@")
+	if i < 0 {
+		return rwURL
+	}
+	return "git://" + strings.Replace(rwURL[i+1:], ":", "/", 1)
+}
+
+// sshRepoURL normalizes the read-write URL to the explicit ssh:// form
+// (git@host:app.git becomes ssh://git@host/app.git).
+func sshRepoURL(rwURL string) string {
+	if strings.Contains(rwURL, "://") {
+		return rwURL
+	}
+	return "ssh://" + strings.Replace(rwURL, ":", "/", 1)
+}
+
+func (p *jujuProvisioner) Destroy(app provision.App) error {
+	err := p.removeRelations(app)
+	if err != nil {
+		return err
+	}
+	serviceName, err := jujuServiceName(app.GetName())
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	args := append(environmentArgs(appEnvironment(app)), "destroy-service", serviceName)
+	err = runCmd(&buf, &buf, args...)
+	if err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	insts, err := p.appInstances(app.GetName())
+	if err != nil {
+		return err
+	}
+	machines := make([]int, len(insts))
+	for i, inst := range insts {
+		machines[i] = inst.Machine
+	}
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	_, err = coll.RemoveAll(bson.M{"app": app.GetName()})
+	if err != nil {
+		return err
+	}
+	if err = removeUnitCount(app.GetName()); err != nil {
+		return err
+	}
+	if p.elbSupport() {
+		if preserve, _ := config.GetBool("juju:elb:preserve-on-destroy"); preserve {
+			// Keeping the empty balancer around preserves its DNS name for a
+			// future redeploy of the same app name.
+			var ids []string
+			for _, inst := range insts {
+				if inst.InstanceID != "" {
+					ids = append(ids, inst.InstanceID)
+				}
+			}
+			if len(ids) > 0 {
+				err = p.LoadBalancer().Deregister(app, ids...)
+				if err != nil && err != ErrLoadBalancerNotFound {
+					return err
+				}
+			}
+		} else if err = p.LoadBalancer().Destroy(app); err != nil {
+			return err
+		}
+	}
+	return p.terminateAppMachines(appEnvironment(app), machines)
+}
+
+// destroyStatusPolls bounds how many terminate/verify rounds Destroy runs
+// before giving up on straggler machines.
+const destroyStatusPolls = 3
+
+// destroyPollInterval is how long Destroy waits between verification rounds.
+// It's a variable so tests don't have to sleep.
+var destroyPollInterval = 3 * time.Second
+
+// terminateAppMachines terminates the app's machines and verifies, with a
+// bounded poll of "juju status", that they're actually gone, retrying
+// terminate-machine for stragglers. Machines still standing after the last
+// round are returned in the error, so an operator can intervene instead of
+// the machines silently leaking.
+func (p *jujuProvisioner) terminateAppMachines(env string, machines []int) error {
+	if len(machines) == 0 {
+		return nil
+	}
+	pending := machines
+	for attempt := 0; attempt < destroyStatusPolls; attempt++ {
+		if attempt > 0 {
+			time.Sleep(destroyPollInterval)
+		}
+		terminateMachines(env, pending...)
+		if machineAction() == "none" {
+			// The machines are meant to stay; there's nothing to verify.
+			return nil
+		}
+		var buf bytes.Buffer
+		err := execWithTimeout(statusTimeout(), &buf, &buf, "status")
+		if err != nil {
+			return &provision.Error{Reason: buf.String(), Err: err}
+		}
+		output, err := parseStatus(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		var stragglers []int
+		for _, machine := range pending {
+			if _, ok := output.Machines[machine]; ok {
+				stragglers = append(stragglers, machine)
+			}
+		}
+		if len(stragglers) == 0 {
+			return nil
+		}
+		pending = stragglers
+	}
+	return errors.Errorf("juju: failed to terminate machines %v, operator intervention required", pending)
+}
+
+// ForgetELB deletes the app's load balancer without touching anything else.
+// It's the admin counterpart of juju:elb:preserve-on-destroy, for when a
+// balancer kept through a Destroy is no longer wanted.
+func (p *jujuProvisioner) ForgetELB(appName string) error {
+	if !p.elbSupport() {
+		return errors.New("juju: ELB support is disabled")
+	}
+	err := elbError(p.LoadBalancer().Destroy(&namedApp{name: appName}))
+	if err != nil && err != ErrLoadBalancerNotFound {
+		return err
+	}
+	return nil
+}
+
+// Platform returns the platform of the app as captured from the charm of its
+// units during status collection, so callers can reconcile apps whose stored
+// platform metadata drifted from what is actually deployed.
+func (p *jujuProvisioner) Platform(app provision.App) (string, error) {
+	insts, err := p.appInstances(app.GetName())
+	if err != nil {
+		return "", err
+	}
+	for _, inst := range insts {
+		if inst.Type != "" {
+			return inst.Type, nil
+		}
+	}
+	if len(insts) == 0 {
+		return "", errors.Errorf("app %q has no units to infer the platform from", app.GetName())
+	}
+	return "", errors.Errorf("the platform of app %q is not known yet", app.GetName())
+}
+
+// ForgetApp removes the app's state tracked by the provisioner — instance
+// documents and the load balancer, when there is one — without talking to
+// juju. It's an admin escape hatch for apps whose service is already gone but
+// whose documents lingered.
+func (p *jujuProvisioner) ForgetApp(appName string) error {
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	_, err = coll.RemoveAll(bson.M{"app": appName})
+	if err != nil {
+		return err
+	}
+	if err = removeUnitCount(appName); err != nil {
+		return err
+	}
+	if p.elbSupport() {
+		err = elbError(p.LoadBalancer().Destroy(&namedApp{name: appName}))
+		if err != nil && err != ErrLoadBalancerNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// terminateDelay is how long terminateMachines waits before terminating, as
+// set by juju:terminate-delay (in seconds). A small delay gives juju time to
+// finish its own cleanup after remove-unit, avoiding races that leave errors
+// in the juju logs. The default is no delay.
+func terminateDelay() time.Duration {
+	seconds, err := config.GetInt("juju:terminate-delay")
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// machineAction returns what to do with a machine once its last unit is
+// gone, from the juju:machine-action setting: "terminate" (the default)
+// destroys it, "stop" shuts it down but keeps it allocated, and "none"
+// leaves it alone — the choice for reserved or on-premise machines that must
+// not be returned to the provider.
+func machineAction() string {
+	switch action, _ := config.GetString("juju:machine-action"); action {
+	case "stop", "none":
+		return action
+	}
+	return "terminate"
+}
+
+// terminateConcurrency returns how many machines terminateMachines processes
+// at once, from juju:terminate-concurrency. Unset or non-positive means no
+// bound, matching the historical behavior; operators with large apps can set
+// it to avoid hammering the bootstrap node with terminate-machine calls.
+func terminateConcurrency() int {
+	n, err := config.GetInt("juju:terminate-concurrency")
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n
+}
+
+// terminateMachines processes the given machines through a worker pool
+// bounded by juju:terminate-concurrency and returns the result of each
+// machine, keyed by machine number.
+func terminateMachines(env string, machines ...int) map[int]error {
+	action := machineAction()
+	var cmd string
+	switch action {
+	case "stop":
+		cmd = "stop-machine"
+	case "terminate":
+		cmd = "terminate-machine"
+	}
+	if delay := terminateDelay(); delay > 0 {
+		time.Sleep(delay)
+	}
+	limit := terminateConcurrency()
+	if limit < 1 || limit > len(machines) {
+		limit = len(machines)
+	}
+	results := make(map[int]error, len(machines))
+	var mut sync.Mutex
+	var wg sync.WaitGroup
+	ch := make(chan int)
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for machine := range ch {
+				err := terminateMachine(env, machine, cmd, action)
+				mut.Lock()
+				results[machine] = err
+				mut.Unlock()
+			}
+		}()
+	}
+	for _, machine := range machines {
+		ch <- machine
+	}
+	close(ch)
+	wg.Wait()
+	return results
+}
+
+func terminateMachine(env string, machine int, cmd, action string) error {
+	start := time.Now()
+	if cmd != "" {
+		var buf bytes.Buffer
+		args := append(environmentArgs(env), cmd, strconv.Itoa(machine))
+		err := runCmd(&buf, &buf, args...)
+		if err != nil {
+			log.Errorf("juju: event=%s machine=%d error=%q output=%q", cmd, machine, err, buf.String())
+			return &provision.Error{Reason: buf.String(), Err: err}
+		}
+	}
+	recordMachineAction(machine, action)
+	log.Debugf("juju: event=machine-action machine=%d action=%s duration=%s", machine, action, time.Since(start))
+	return nil
+}
+
+// machineActionLog is the audit record kept for every machine processed by
+// terminateMachines, telling which action was actually taken.
+type machineActionLog struct {
+	Machine int       `bson:"machine"`
+	Action  string    `bson:"action"`
+	At      time.Time `bson:"at"`
+}
+
+func machineActionsCollection() (*storage.Collection, error) {
+	name, err := config.GetString("juju:machine-actions-collection")
+	if err != nil {
+		name = "juju_machine_actions"
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Collection(name), nil
+}
+
+// recordMachineAction persists the audit record. terminateMachines runs in
+// the background, so failures are logged instead of returned.
+func recordMachineAction(machine int, action string) {
+	coll, err := machineActionsCollection()
+	if err == nil {
+		defer coll.Close()
+		err = coll.Insert(machineActionLog{Machine: machine, Action: action, At: time.Now().UTC()})
+	}
+	if err != nil {
+		log.Errorf("juju: failed to record %s of machine %d: %s", action, machine, err)
+	}
+}
+
+func (p *jujuProvisioner) AddUnits(app provision.App, n uint, process string, version appTypes.AppVersion, w io.Writer) error {
+	return p.addUnits(app, n, process, "", w)
+}
+
+// AddUnitsWithConstraints works like AddUnits, but passes the given
+// constraints (e.g. "instance-type=m1.large") to "juju add-unit", so
+// operators can choose the hardware backing the new units.
+func (p *jujuProvisioner) AddUnitsWithConstraints(app provision.App, n uint, constraints string, w io.Writer) error {
+	return p.addUnits(app, n, "", constraints, w)
+}
+
+// waitForUnitsPollInterval is how long WaitForUnits sleeps between polls.
+// It's a variable so tests can shrink it.
+var waitForUnitsPollInterval = 3 * time.Second
+
+// WaitForUnits blocks until at least n units of the app are started, polling
+// status collection, or until the timeout elapses, in which case the
+// returned error reports the counts last seen.
+func (p *jujuProvisioner) WaitForUnits(app provision.App, n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		units, err := p.CollectStatusApp(app)
+		if err != nil {
+			return err
+		}
+		started := 0
+		for _, unit := range units {
+			if unit.Status == provision.StatusStarted {
+				started++
+			}
+		}
+		if started >= n {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("timed out waiting for %d started units of app %q: %d of %d started after %s", n, app.GetName(), started, len(units), timeout)
+		}
+		time.Sleep(waitForUnitsPollInterval)
+	}
+}
+
+// appLocks serializes mutating operations per app. Concurrent AddUnits and
+// RemoveUnits calls interleave juju commands and collection writes, which can
+// leave the units collection and the ELB membership inconsistent; the lock
+// keeps each operation whole. The locks only guard a single tsuru server —
+// multi-server deployments still rely on the conditional updates.
+var appLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+// lockApp acquires the mutex serializing mutating operations on the app,
+// creating it on first use, and returns the function that releases it.
+func lockApp(appName string) func() {
+	appLocks.Lock()
+	mut, ok := appLocks.m[appName]
+	if !ok {
+		mut = new(sync.Mutex)
+		appLocks.m[appName] = mut
+	}
+	appLocks.Unlock()
+	mut.Lock()
+	return mut.Unlock
+}
+
+func (p *jujuProvisioner) addUnits(app provision.App, n uint, process, constraints string, w io.Writer) error {
+	start := time.Now()
+	if n < 1 {
+		return errors.New("cannot add zero units")
+	}
+	defer lockApp(app.GetName())()
+	if w == nil {
+		w = ioutil.Discard
+	}
+	if err := recordAppConfigHash(app.GetName(), appConfigHash(app)); err != nil {
+		return err
+	}
+	var serviceName string
+	var err error
+	if process != "" {
+		serviceName, err = processServiceName(app.GetName(), process)
+	} else {
+		serviceName, err = jujuServiceName(app.GetName())
+	}
+	if err != nil {
+		return err
+	}
+	pool, err := p.appPool(app.GetName())
+	if err != nil {
+		return err
+	}
+	if pool != "" {
+		// Pooled apps reuse pre-provisioned machines; constraints and zone
+		// spreading only make sense when juju provisions new ones.
+		if err = p.addUnitsToPool(app, serviceName, process, pool, n, w, start); err != nil {
+			return err
+		}
+		return p.waitAddedUnits(app, w)
+	}
+	// Platform defaults apply under the caller's constraints, which win on
+	// conflicting keys.
+	constraints = mergeConstraints(platformConstraints(app.GetPlatform()), constraints)
+	zones := spreadZones()
+	if len(zones) == 0 || constraintValue(constraints, "zones") != "" {
+		if err = p.addUnitsBatch(app, serviceName, process, n, constraints, w, start); err != nil {
+			return err
+		}
+		return p.waitAddedUnits(app, w)
+	}
+	// Adding units one at a time with alternating zone constraints keeps juju
+	// from bunching them all into a single availability zone.
+	for i := uint(0); i < n; i++ {
+		zoned := strings.TrimSpace(constraints + " zones=" + zones[int(i)%len(zones)])
+		if err = p.addUnitsBatch(app, serviceName, process, 1, zoned, w, start); err != nil {
+			return err
+		}
+	}
+	return p.waitAddedUnits(app, w)
+}
+
+// waitAddedUnits blocks until every unit of the app is started when
+// juju:add-units-wait (in seconds) is set, streaming a progress line to the
+// writer. With the setting absent AddUnits returns as soon as juju accepts
+// the new units, as it always did.
+func (p *jujuProvisioner) waitAddedUnits(app provision.App, w io.Writer) error {
+	seconds, err := config.GetInt("juju:add-units-wait")
+	if err != nil || seconds < 1 {
+		return nil
+	}
+	total, err := p.UnitCount(app)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Waiting for %d units to start...\n", total)
+	return p.WaitForUnits(app, total, time.Duration(seconds)*time.Second)
+}
+
+// spreadZones returns the availability zones to spread new units across, or
+// nil when zone spreading is disabled. The zones come from juju:zones,
+// falling back to juju:elb:avail-zones for setups that already list their
+// zones there.
+func spreadZones() []string {
+	if spread, _ := config.GetBool("juju:spread-zones"); !spread {
+		return nil
+	}
+	zones, err := config.GetList("juju:zones")
+	if err != nil {
+		zones, _ = config.GetList("juju:elb:avail-zones")
+	}
+	return zones
+}
+
+func (p *jujuProvisioner) addUnitsBatch(app provision.App, serviceName, process string, n uint, constraints string, w io.Writer, start time.Time) error {
+	args := append(environmentArgs(appEnvironment(app)), "add-unit", serviceName, "--num-units", strconv.FormatUint(uint64(n), 10))
+	if constraints != "" {
+		args = append(args, "--constraints", constraints)
+	}
+	var buf bytes.Buffer
+	err := runCmd(&buf, &buf, args...)
+	if err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	var setBuf bytes.Buffer
+	setArgs := append(environmentArgs(appEnvironment(app)), "set", serviceName, "app-repo="+repositoryURL(app.GetName()))
+	err = runCmd(&setBuf, &setBuf, setArgs...)
+	if err != nil {
+		return &provision.Error{Reason: setBuf.String(), Err: err}
+	}
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	newUnits := make(map[string]int)
+	for _, match := range unitAddedRegexp.FindAllStringSubmatch(buf.String(), -1) {
+		machine, _ := strconv.Atoi(match[2])
+		newUnits[match[1]] = machine
+	}
+	if len(newUnits) == 0 {
+		// juju variants don't all print the "Unit 'x/y' added" lines this
+		// code was written against. Compute the expected names instead; the
+		// machine numbers stay unknown until the next status collection
+		// reconciles the documents.
+		names, err := allocateUnitNames(coll, app.GetName(), serviceName, n)
+		if err != nil {
+			return err
+		}
+		log.Debugf("juju: event=add-unit-fallback app=%s units=%v", app.GetName(), names)
+		for _, name := range names {
+			newUnits[name] = 0
+		}
+	}
+	for unitName, machine := range newUnits {
+		inst := instance{
+			UnitName:     unitName,
+			AppName:      app.GetName(),
+			Service:      serviceName,
+			Process:      process,
+			Machine:      machine,
+			InstanceType: constraintValue(constraints, "instance-type"),
+			Zone:         constraintValue(constraints, "zones"),
+			Status:       provision.StatusCreated.String(),
+			ConfigHash:   appConfigHash(app),
+			CreatedAt:    time.Now().UTC(),
+		}
+		if err = p.registerAddedUnit(app, inst, coll, w, start); err != nil {
+			return err
+		}
+	}
+	return p.enqueuePostAddTasks(app)
+}
+
+// registerAddedUnit records one freshly added unit: it inserts the instance
+// document, bumps the unit counter and enqueues the load balancer
+// registration when enabled.
+func (p *jujuProvisioner) registerAddedUnit(app provision.App, inst instance, coll *storage.Collection, w io.Writer, start time.Time) error {
+	if err := coll.Insert(inst); err != nil {
+		return err
+	}
+	if err := adjustUnitCount(app.GetName(), 1); err != nil {
+		return err
+	}
+	if p.elbSupport() && p.elbAutoRegister() {
+		err := enqueueUnitToLoadBalancer(app.GetName(), inst.UnitName)
+		if err != nil {
+			// Surfacing the failure beats silently leaving a unit out of
+			// the load balancer: the caller can retry the whole AddUnits,
+			// which is idempotent on the juju side.
+			return errors.Wrapf(err, "failed to enqueue ELB registration of unit %q", inst.UnitName)
+		}
+	}
+	log.Debugf("juju: event=add-unit app=%s unit=%s machine=%d duration=%s", app.GetName(), inst.UnitName, inst.Machine, time.Since(start))
+	fmt.Fprintf(w, "Unit %q added\n", inst.UnitName)
+	return nil
+}
+
+// enqueuePostAddTasks enqueues the background work that follows a batch of
+// new units: ssh key injection and DNS registration, when configured.
+func (p *jujuProvisioner) enqueuePostAddTasks(app provision.App) error {
+	if len(authorizedKeys()) > 0 {
+		if err := enqueueSSHKeys(app.GetName()); err != nil {
+			return errors.Wrapf(err, "failed to enqueue ssh key injection for app %q", app.GetName())
+		}
+	}
+	if p.dnsSupport() {
+		if err := enqueueDNSRegister(app.GetName()); err != nil {
+			return errors.Wrapf(err, "failed to enqueue DNS registration of app %q", app.GetName())
+		}
+	}
+	return nil
+}
+
+// allocateUnitNames computes the names juju gives to n new units of the
+// service, from the highest unit index currently recorded for the app. It's
+// the fallback for juju variants whose add-unit output can't be parsed.
+func allocateUnitNames(coll *storage.Collection, appName, serviceName string, n uint) ([]string, error) {
+	var insts []instance
+	err := coll.Find(bson.M{"app": appName}).All(&insts)
+	if err != nil {
+		return nil, err
+	}
+	max := -1
+	for _, inst := range insts {
+		if !strings.HasPrefix(inst.UnitName, serviceName+"/") {
+			continue
+		}
+		if i := strings.LastIndex(inst.UnitName, "/"); i >= 0 {
+			if idx, err := strconv.Atoi(inst.UnitName[i+1:]); err == nil && idx > max {
+				max = idx
+			}
+		}
+	}
+	names := make([]string, 0, n)
+	for i := 1; i <= int(n); i++ {
+		names = append(names, fmt.Sprintf("%s/%d", serviceName, max+i))
+	}
+	return names, nil
+}
+
+// appConfigHash hashes the app's environment variables, so the configuration
+// a unit applied can be compared with the app's current one without storing
+// the variables themselves.
+func appConfigHash(app provision.App) string {
+	envs := app.Envs()
+	names := make([]string, 0, len(envs))
+	for name := range envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha1.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%s\n", name, envs[name].Value)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// appConfig records the hash of the app's current configuration, written by
+// the flows that apply it, so the collector can tell whether a unit with a
+// rotated instance id came back running stale config.
+type appConfig struct {
+	AppName string `bson:"_id"`
+	Hash    string `bson:"hash"`
+}
+
+func appConfigsCollection() (*storage.Collection, error) {
+	name, err := config.GetString("juju:app-configs-collection")
+	if err != nil {
+		name = "juju_app_configs"
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Collection(name), nil
+}
+
+// recordAppConfigHash stores the hash of the app's current configuration.
+func recordAppConfigHash(appName, hash string) error {
+	coll, err := appConfigsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	_, err = coll.UpsertId(appName, appConfig{AppName: appName, Hash: hash})
+	return err
+}
+
+// storedAppConfigHash returns the last recorded configuration hash of the
+// app, or empty when none was recorded yet.
+func storedAppConfigHash(appName string) (string, error) {
+	coll, err := appConfigsCollection()
+	if err != nil {
+		return "", err
+	}
+	defer coll.Close()
+	var stored appConfig
+	err = coll.FindId(appName).One(&stored)
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return stored.Hash, nil
+}
+
+// markConfigApplied records that the given units — or every unit of the app,
+// when no names are given — are running the given configuration hash.
+func markConfigApplied(appName, hash string, unitNames ...string) error {
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	query := bson.M{"app": appName}
+	if len(unitNames) > 0 {
+		query["_id"] = bson.M{"$in": unitNames}
+	}
+	_, err = coll.UpdateAll(query, bson.M{"$set": bson.M{"confighash": hash}})
+	return err
+}
+
+// appPool is the pool assignment of an app, kept in its own collection so
+// the pinning survives unit churn.
+type appPool struct {
+	AppName string `bson:"_id"`
+	Pool    string `bson:"pool"`
+}
+
+func appPoolsCollection() (*storage.Collection, error) {
+	name, err := config.GetString("juju:app-pools-collection")
+	if err != nil {
+		name = "juju_app_pools"
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Collection(name), nil
+}
+
+// poolMachines returns the numbers of the pre-provisioned machines that make
+// up the pool, from the juju:pools:<name> setting.
+func poolMachines(pool string) ([]int, error) {
+	values, err := config.GetList("juju:pools:" + pool)
+	if err != nil {
+		return nil, errors.Errorf("juju: pool %q is not defined in config", pool)
+	}
+	machines := make([]int, 0, len(values))
+	for _, value := range values {
+		machine, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.Errorf("juju: pool %q lists invalid machine number %q", pool, value)
+		}
+		machines = append(machines, machine)
+	}
+	return machines, nil
+}
+
+// AssignPool pins the app to a machine pool: from then on AddUnits places its
+// units on free machines of the pool, with "add-unit --to", instead of
+// provisioning new cloud machines. An empty pool name removes the pinning.
+func (p *jujuProvisioner) AssignPool(app provision.Named, pool string) error {
+	coll, err := appPoolsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	if pool == "" {
+		err = coll.RemoveId(app.GetName())
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	if _, err = poolMachines(pool); err != nil {
+		return err
+	}
+	_, err = coll.UpsertId(app.GetName(), appPool{AppName: app.GetName(), Pool: pool})
+	return err
+}
+
+// appPool returns the name of the pool the app is pinned to, or empty when
+// the app isn't pooled.
+func (p *jujuProvisioner) appPool(appName string) (string, error) {
+	coll, err := appPoolsCollection()
+	if err != nil {
+		return "", err
+	}
+	defer coll.Close()
+	var assignment appPool
+	err = coll.FindId(appName).One(&assignment)
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return assignment.Pool, nil
+}
+
+// addUnitsToPool places n new units on free machines of the app's pool. A
+// machine is free while no unit document references it; when the pool runs
+// out the whole call fails before any unit is added.
+func (p *jujuProvisioner) addUnitsToPool(app provision.App, serviceName, process, pool string, n uint, w io.Writer, start time.Time) error {
+	machines, err := poolMachines(pool)
+	if err != nil {
+		return err
+	}
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	var insts []instance
+	err = coll.Find(bson.M{"machine": bson.M{"$in": machines}}).All(&insts)
+	if err != nil {
+		return err
+	}
+	used := make(map[int]bool, len(insts))
+	for _, inst := range insts {
+		used[inst.Machine] = true
+	}
+	free := make([]int, 0, len(machines))
+	for _, machine := range machines {
+		if !used[machine] {
+			free = append(free, machine)
+		}
+	}
+	if uint(len(free)) < n {
+		return errors.Errorf("juju: pool %q has %d free machine(s), %d needed", pool, len(free), n)
+	}
+	for i := uint(0); i < n; i++ {
+		if err = p.addUnitToMachine(coll, app, serviceName, process, pool, free[i], w, start); err != nil {
+			return err
+		}
+	}
+	return p.enqueuePostAddTasks(app)
+}
+
+// addUnitToMachine adds one unit to a pre-provisioned machine with
+// "add-unit --to" and records it like addUnitsBatch does for cloud machines.
+func (p *jujuProvisioner) addUnitToMachine(coll *storage.Collection, app provision.App, serviceName, process, pool string, machine int, w io.Writer, start time.Time) error {
+	args := append(environmentArgs(appEnvironment(app)), "add-unit", serviceName, "--to", strconv.Itoa(machine))
+	var buf bytes.Buffer
+	err := runCmd(&buf, &buf, args...)
+	if err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	var setBuf bytes.Buffer
+	setArgs := append(environmentArgs(appEnvironment(app)), "set", serviceName, "app-repo="+repositoryURL(app.GetName()))
+	err = runCmd(&setBuf, &setBuf, setArgs...)
+	if err != nil {
+		return &provision.Error{Reason: setBuf.String(), Err: err}
+	}
+	var unitName string
+	if match := unitAddedRegexp.FindStringSubmatch(buf.String()); match != nil {
+		unitName = match[1]
+	} else {
+		names, err := allocateUnitNames(coll, app.GetName(), serviceName, 1)
+		if err != nil {
+			return err
+		}
+		unitName = names[0]
+	}
+	inst := instance{
+		UnitName:   unitName,
+		AppName:    app.GetName(),
+		Service:    serviceName,
+		Process:    process,
+		Machine:    machine,
+		Pool:       pool,
+		Status:     provision.StatusCreated.String(),
+		ConfigHash: appConfigHash(app),
+		CreatedAt:  time.Now().UTC(),
+	}
+	return p.registerAddedUnit(app, inst, coll, w, start)
+}
+
+// appCount is the per-app unit counter kept alongside the instance
+// documents. It exists so billing can read a single small document instead of
+// counting a large collection on every request.
+type appCount struct {
+	AppName string `bson:"_id"`
+	Count   int    `bson:"count"`
+}
+
+func appCountsCollection() (*storage.Collection, error) {
+	name, err := config.GetString("juju:app-counts-collection")
+	if err != nil {
+		name = "juju_app_counts"
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Collection(name), nil
+}
+
+// adjustUnitCount applies a delta to the app's unit counter. It's called in
+// the same flow as each instance insert or removal, so the counter follows
+// the collection; units discovered by status collection bypass it, which is
+// what ReconcileUnitCount is for.
+func adjustUnitCount(appName string, delta int) error {
+	coll, err := appCountsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	_, err = coll.UpsertId(appName, bson.M{"$inc": bson.M{"count": delta}})
+	return err
+}
+
+// removeUnitCount drops the app's unit counter, for when the app itself is
+// gone.
+func removeUnitCount(appName string) error {
+	coll, err := appCountsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	err = coll.RemoveId(appName)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// UnitCount returns the persisted number of units of the app. When the
+// counter doesn't exist yet the count is recomputed from the units
+// collection and persisted on the way out.
+func (p *jujuProvisioner) UnitCount(app provision.App) (int, error) {
+	coll, err := appCountsCollection()
+	if err != nil {
+		return 0, err
+	}
+	defer coll.Close()
+	var count appCount
+	err = coll.FindId(app.GetName()).One(&count)
+	if err == mgo.ErrNotFound {
+		return p.ReconcileUnitCount(app.GetName())
+	}
+	if err != nil {
+		return 0, err
+	}
+	return count.Count, nil
+}
+
+// ReconcileUnitCount recomputes the app's unit counter from the units
+// collection and persists it, fixing drift caused by units that appeared or
+// vanished outside AddUnits/RemoveUnits.
+func (p *jujuProvisioner) ReconcileUnitCount(appName string) (int, error) {
+	units, err := unitsCollection()
+	if err != nil {
+		return 0, err
+	}
+	defer units.Close()
+	n, err := units.Find(bson.M{"app": appName}).Count()
+	if err != nil {
+		return 0, err
+	}
+	counts, err := appCountsCollection()
+	if err != nil {
+		return 0, err
+	}
+	defer counts.Close()
+	_, err = counts.UpsertId(appName, bson.M{"$set": bson.M{"count": n}})
+	return n, err
+}
+
+// constraintValue extracts the value of the given key from a juju constraints
+// string ("key=value key=value ...").
+func constraintValue(constraints, key string) string {
+	for _, pair := range strings.Fields(constraints) {
+		if strings.HasPrefix(pair, key+"=") {
+			return pair[len(key)+1:]
+		}
+	}
+	return ""
+}
+
+func (p *jujuProvisioner) RemoveUnits(app provision.App, n uint, process string, version appTypes.AppVersion, w io.Writer) error {
+	start := time.Now()
+	defer lockApp(app.GetName())()
+	if w == nil {
+		w = ioutil.Discard
+	}
+	insts, err := p.appInstances(app.GetName())
+	if err != nil {
+		return err
+	}
+	if process != "" {
+		filtered := insts[:0]
+		for _, inst := range insts {
+			if inst.Process == process {
+				filtered = append(filtered, inst)
+			}
+		}
+		insts = filtered
+	}
+	if int(n) > len(insts) {
+		return errors.Errorf("cannot remove %d units: app %q has only %d", n, app.GetName(), len(insts))
+	}
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	var machines []int
+	for _, inst := range insts[len(insts)-int(n):] {
+		if p.elbSupport() && p.elbAutoRegister() && inst.InstanceID != "" {
+			err = p.LoadBalancer().Deregister(app, inst.InstanceID)
+			if err != nil && err != ErrLoadBalancerNotFound {
+				return err
+			}
+		}
+		var buf bytes.Buffer
+		args := append(environmentArgs(appEnvironment(app)), "remove-unit", inst.UnitName)
+		err = runCmd(&buf, &buf, args...)
+		if err != nil {
+			return &provision.Error{Reason: buf.String(), Err: err}
+		}
+		if inst.Machine != 0 {
+			// Units created through the name allocator fallback keep machine
+			// 0 until status collection reconciles them; terminating machine
+			// 0 would take down the bootstrap node.
+			machines = append(machines, inst.Machine)
+		}
+		if err = coll.RemoveId(inst.UnitName); err != nil {
+			return err
+		}
+		if err = adjustUnitCount(app.GetName(), -1); err != nil {
+			return err
+		}
+		log.Debugf("juju: event=remove-unit app=%s unit=%s machine=%d duration=%s", app.GetName(), inst.UnitName, inst.Machine, time.Since(start))
+		fmt.Fprintf(w, "Unit %q removed\n", inst.UnitName)
+	}
+	env := appEnvironment(app)
+	spawn(func() { terminateMachines(env, machines...) })
+	return nil
+}
+
+// RecycleMachine terminates the machine backing the unit and asks juju to
+// provision a fresh one in its place, keeping the unit and its name. It's
+// the recovery path for bad hardware: the instance is rebuilt without
+// renumbering units. The stored machine data is cleared so status collection
+// picks up the replacement.
+func (p *jujuProvisioner) RecycleMachine(app provision.App, unitName string) error {
+	defer lockApp(app.GetName())()
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	var inst instance
+	err = coll.Find(bson.M{"_id": unitName, "app": app.GetName()}).One(&inst)
+	if err == mgo.ErrNotFound {
+		return errors.Errorf("app %q has no unit %q", app.GetName(), unitName)
+	} else if err != nil {
+		return err
+	}
+	if inst.Machine == 0 {
+		return errors.Errorf("machine of unit %q is not known yet", unitName)
+	}
+	if p.elbSupport() && inst.InstanceID != "" {
+		err = p.LoadBalancer().Deregister(app, inst.InstanceID)
+		if err != nil && err != ErrLoadBalancerNotFound {
+			return err
+		}
+	}
+	env := appEnvironment(app)
+	if err = terminateMachine(env, inst.Machine, "terminate-machine", "terminate"); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	args := append(environmentArgs(env), "retry-provisioning", strconv.Itoa(inst.Machine))
+	if err = runCmd(&buf, &buf, args...); err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	err = coll.UpdateId(unitName, bson.M{"$set": bson.M{
+		"instanceid":     "",
+		"publicaddress":  "",
+		"privateaddress": "",
+		"status":         StatusCreating.String(),
+		"elbstate":       "",
+		"elbreasoncode":  "",
+		"elbdescription": "",
+	}})
+	if err != nil {
+		return err
+	}
+	log.Debugf("juju: event=recycle-machine app=%s unit=%s machine=%d", app.GetName(), unitName, inst.Machine)
+	return nil
+}
+
+// RemoveUnit removes one specific unit of the app. Machine numbers are not
+// 1:1 with unit indices, so the machine to terminate comes strictly from the
+// stored instance document; removing a unit whose machine is not known yet
+// (still provisioning, or never collected) is an error rather than a guess.
+func (p *jujuProvisioner) RemoveUnit(app provision.App, unitName string) error {
+	start := time.Now()
+	defer lockApp(app.GetName())()
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	var inst instance
+	err = coll.Find(bson.M{"_id": unitName, "app": app.GetName()}).One(&inst)
+	if err == mgo.ErrNotFound {
+		return errors.Errorf("app %q has no unit %q", app.GetName(), unitName)
+	} else if err != nil {
+		return err
+	}
+	if inst.Machine == 0 {
+		return errors.Errorf("machine of unit %q is not known yet", unitName)
+	}
+	if p.elbSupport() && p.elbAutoRegister() && inst.InstanceID != "" {
+		err = p.LoadBalancer().Deregister(app, inst.InstanceID)
+		if err != nil && err != ErrLoadBalancerNotFound {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	args := append(environmentArgs(appEnvironment(app)), "remove-unit", inst.UnitName)
+	err = runCmd(&buf, &buf, args...)
+	if err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	if err = coll.RemoveId(inst.UnitName); err != nil {
+		return err
+	}
+	if err = adjustUnitCount(app.GetName(), -1); err != nil {
+		return err
+	}
+	log.Debugf("juju: event=remove-unit app=%s unit=%s machine=%d duration=%s", app.GetName(), inst.UnitName, inst.Machine, time.Since(start))
+	env := appEnvironment(app)
+	machine := inst.Machine
+	spawn(func() { terminateMachines(env, machine) })
+	return nil
+}
+
+// RunOnce runs a one-off command on a transient unit of the app, writing the
+// output to w. The unit is added just for the command and torn down
+// afterwards, even when the command fails. While alive the unit is tracked in
+// the units collection with the transient flag, so leftovers from a crashed
+// tsuru can be spotted and reaped.
+func (p *jujuProvisioner) RunOnce(app provision.App, cmd string, w io.Writer) error {
+	if w == nil {
+		w = ioutil.Discard
+	}
+	env := appEnvironment(app)
+	serviceName, err := jujuServiceName(app.GetName())
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	args := append(environmentArgs(env), "add-unit", serviceName, "--num-units", "1")
+	err = runCmd(&buf, &buf, args...)
+	if err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	inst := instance{
+		AppName:   app.GetName(),
+		Service:   serviceName,
+		Status:    provision.StatusCreated.String(),
+		Transient: true,
+	}
+	matches := unitAddedRegexp.FindStringSubmatch(buf.String())
+	if matches != nil {
+		inst.UnitName = matches[1]
+		inst.Machine, _ = strconv.Atoi(matches[2])
+	} else {
+		// The unit exists even when the output can't be parsed, so fall back
+		// to the name allocator instead of leaking it. The machine stays 0
+		// until status collection reconciles it.
+		names, err := allocateUnitNames(coll, app.GetName(), serviceName, 1)
+		if err != nil {
+			return errors.Wrapf(err, "could not determine the unit added for app %q", app.GetName())
+		}
+		inst.UnitName = names[0]
+	}
+	cleanup := func() {
+		var rmBuf bytes.Buffer
+		rmArgs := append(environmentArgs(env), "remove-unit", inst.UnitName)
+		if rmErr := runCmd(&rmBuf, &rmBuf, rmArgs...); rmErr != nil {
+			log.Errorf("juju: failed to remove transient unit %q: %s: %s", inst.UnitName, rmErr, rmBuf.String())
+		}
+		if rmErr := coll.RemoveId(inst.UnitName); rmErr != nil && rmErr != mgo.ErrNotFound {
+			log.Errorf("juju: failed to forget transient unit %q: %s", inst.UnitName, rmErr)
+		}
+		if inst.Machine != 0 {
+			spawn(func() { terminateMachines(env, inst.Machine) })
+		}
+	}
+	if err = coll.Insert(inst); err != nil {
+		cleanup()
+		return err
+	}
+	defer cleanup()
+	target := inst.sshTarget()
+	if inst.Machine == 0 && inst.Container == "" {
+		// The machine is unknown until status collection reconciles the
+		// unit; "juju ssh" also takes unit names, so target the unit
+		// directly instead of machine 0 — the bootstrap node.
+		target = inst.UnitName
+	}
+	runArgs := append(environmentArgs(env), sshArgs(target)...)
+	runArgs = append(runArgs, cmd)
+	return runCmd(w, w, runArgs...)
+}
+
+// UnitCommandResult holds the outcome of a command run on one unit by
+// ExecuteCommandResults, with stdout and stderr captured separately.
+type UnitCommandResult struct {
+	Stdout string
+	Stderr string
+	Err    error
+}
+
+// ExecuteCommandResults runs a command like ExecuteCommand, but collects the
+// per-unit output in a map instead of interleaving everything in the writers,
+// keeping stderr apart from stdout so callers can tell a failing command's
+// error output from its normal output. Down units get an error result
+// without running anything.
+func (p *jujuProvisioner) ExecuteCommandResults(opts provision.ExecOptions) (map[string]UnitCommandResult, error) {
+	insts, err := p.appInstances(opts.App.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Units) > 0 {
+		wanted := make(map[string]struct{}, len(opts.Units))
+		for _, name := range opts.Units {
+			wanted[name] = struct{}{}
+		}
+		var filtered []instance
+		for _, inst := range insts {
+			if _, ok := wanted[inst.UnitName]; ok {
+				filtered = append(filtered, inst)
+			}
+		}
+		insts = filtered
+	}
+	if len(insts) == 0 {
+		return nil, provision.ErrEmptyApp
+	}
+	results := make(map[string]UnitCommandResult, len(insts))
+	for _, inst := range insts {
+		if inst.Status == StatusDown.String() {
+			results[inst.UnitName] = UnitCommandResult{
+				Err: errors.Errorf("unit %q is down, it won't run any command", inst.UnitName),
+			}
+			continue
+		}
+		var stdout, stderr bytes.Buffer
+		args := append(environmentArgs(appEnvironment(opts.App)), sshArgs(inst.sshTarget())...)
+		args = append(args, opts.Cmds...)
+		err := runCmd(&stdout, &stderr, args...)
+		results[inst.UnitName] = UnitCommandResult{
+			Stdout: stdout.String(),
+			Stderr: stderr.String(),
+			Err:    err,
+		}
+	}
+	return results, nil
+}
+
+const defaultLogPath = "/var/log/tsuru/app.log"
+
+// UnitLog tails the last lines of the app's log file on the given unit,
+// writing them to w. The log file location comes from the juju:log-path
+// setting. Down units don't run commands, mirroring ExecuteCommand.
+func (p *jujuProvisioner) UnitLog(app provision.App, unitName string, lines int, w io.Writer) error {
+	insts, err := p.appInstances(app.GetName())
+	if err != nil {
+		return err
+	}
+	var target *instance
+	for i := range insts {
+		if insts[i].UnitName == unitName {
+			target = &insts[i]
+			break
+		}
+	}
+	if target == nil {
+		return errors.Errorf("app %q has no unit %q", app.GetName(), unitName)
+	}
+	if target.Status == StatusDown.String() {
+		return errors.Errorf("unit %q is down, it won't run any command", unitName)
+	}
+	logPath, err := config.GetString("juju:log-path")
+	if err != nil {
+		logPath = defaultLogPath
+	}
+	if w == nil {
+		w = ioutil.Discard
+	}
+	args := append(environmentArgs(appEnvironment(app)), sshArgs(target.sshTarget())...)
+	args = append(args, "tail", "-n", strconv.Itoa(lines), logPath)
+	return runCmd(w, w, args...)
+}
+
+// Scale reconciles the number of units of the app to exactly n, adding or
+// removing units as needed. Scaling down to zero is allowed and keeps the
+// juju service deployed, so scaling back up doesn't pay the deploy cost. For
+// ELB-backed apps the juju:elb:min-units setting, when defined, sets a floor
+// under n.
+func (p *jujuProvisioner) Scale(app provision.App, n int) error {
+	if n < 0 {
+		return errors.Errorf("cannot scale app %q to %d units", app.GetName(), n)
+	}
+	if p.elbSupport() {
+		if min, err := config.GetInt("juju:elb:min-units"); err == nil && n < min {
+			return errors.Errorf("cannot scale app %q below %d units: it's behind a load balancer", app.GetName(), min)
+		}
+	}
+	insts, err := p.appInstances(app.GetName())
+	if err != nil {
+		return err
+	}
+	switch current := len(insts); {
+	case n > current:
+		return p.addUnits(app, uint(n-current), "", "", nil)
+	case n < current:
+		return p.RemoveUnits(app, uint(current-n), "", nil, nil)
+	}
+	return nil
+}
+
+func (p *jujuProvisioner) Restart(app provision.App, process string, version appTypes.AppVersion, w io.Writer) error {
+	return p.restart(app, w, false)
+}
+
+// RollingRestart restarts the app one unit at a time, draining each unit from
+// the load balancer before restarting it and re-registering it afterwards, so
+// ELB-backed apps can be restarted without dropping requests.
+func (p *jujuProvisioner) RollingRestart(app provision.App, w io.Writer) error {
+	return p.restart(app, w, true)
+}
+
+func (p *jujuProvisioner) restart(app provision.App, w io.Writer, rolling bool) error {
+	hash := appConfigHash(app)
+	if err := recordAppConfigHash(app.GetName(), hash); err != nil {
+		return err
+	}
+	if !rolling || !p.elbSupport() {
+		if err := p.runHook(app, restartHook, w); err != nil {
+			return err
+		}
+		return markConfigApplied(app.GetName(), hash)
+	}
+	if w == nil {
+		w = ioutil.Discard
+	}
+	insts, err := p.appInstances(app.GetName())
+	if err != nil {
+		return err
+	}
+	if len(insts) == 0 {
+		return provision.ErrEmptyApp
+	}
+	manager := p.LoadBalancer()
+	for _, inst := range insts {
+		drained := false
+		if inst.InstanceID != "" {
+			err = manager.Deregister(app, inst.InstanceID)
+			if err != nil && err != ErrLoadBalancerNotFound {
+				return err
+			}
+			drained = err == nil
+		}
+		if drained {
+			if err = p.waitELBState(app.GetName(), inst.InstanceID, "OutOfService"); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(w, "Restarting unit %q\n", inst.UnitName)
+		err = p.ExecuteCommand(provision.ExecOptions{
+			App:    app,
+			Stdout: w,
+			Stderr: w,
+			Units:  []string{inst.UnitName},
+			Cmds:   []string{restartHook},
+		})
+		if err != nil {
+			return err
+		}
+		if err = markConfigApplied(app.GetName(), hash, inst.UnitName); err != nil {
+			return err
+		}
+		if drained {
+			if err = manager.Register(app, inst.InstanceID); err != nil {
+				return err
+			}
+			if err = p.waitELBState(app.GetName(), inst.InstanceID, "InService"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// elbDrainPolls bounds how many times waitELBState polls instance health.
+const elbDrainPolls = 20
+
+// elbDrainPollInterval is how long waitELBState waits between health polls.
+// It's a variable so tests don't have to sleep.
+var elbDrainPollInterval = 3 * time.Second
+
+// waitELBState polls the app's load balancer until the instance reports the
+// given state. An instance the balancer no longer knows counts as
+// OutOfService, since a deregistered instance receives no traffic.
+func (p *jujuProvisioner) waitELBState(appName, instanceID, state string) error {
+	manager := p.LoadBalancer()
+	for attempt := 0; attempt < elbDrainPolls; attempt++ {
+		if attempt > 0 {
+			time.Sleep(elbDrainPollInterval)
+		}
+		states, err := manager.instanceHealth(appName)
+		if err != nil {
+			return err
+		}
+		current := states[instanceID]
+		if current == nil {
+			if state == "OutOfService" {
+				return nil
+			}
+			continue
+		}
+		if current.State != nil && *current.State == state {
+			return nil
+		}
+	}
+	return errors.Errorf("juju: instance %q of app %q did not reach ELB state %q", instanceID, appName, state)
+}
+
+func (p *jujuProvisioner) Start(app provision.App, process string, version appTypes.AppVersion) error {
+	pending, err := preStartPending(app.GetName())
+	if err != nil {
+		return err
+	}
+	if pending {
+		return errors.Errorf("pre-start of app %q has not succeeded yet", app.GetName())
+	}
+	return p.runHook(app, startHook, nil)
+}
+
+// PreStart runs the command on exactly one unit of the app and blocks Start
+// until it succeeds — the canonical "run the database migration once before
+// the fleet starts" primitive. The pending flag lives on the instance
+// documents, so concurrent tsuru servers observe it too, and claiming it is
+// a conditional update, so two concurrent PreStarts can't both run.
+func (p *jujuProvisioner) PreStart(app provision.App, cmd string, w io.Writer) error {
+	if w == nil {
+		w = ioutil.Discard
+	}
+	insts, err := p.appInstances(app.GetName())
+	if err != nil {
+		return err
+	}
+	if len(insts) == 0 {
+		return provision.ErrEmptyApp
+	}
+	var target *instance
+	for i := range insts {
+		if insts[i].Status != StatusDown.String() {
+			target = &insts[i]
+			break
+		}
+	}
+	if target == nil {
+		return errors.Errorf("no unit of app %q is able to run the command", app.GetName())
+	}
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	change, err := coll.UpdateAll(
+		bson.M{"app": app.GetName(), "prestartpending": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"prestartpending": true}},
+	)
+	if err != nil {
+		return err
+	}
+	if change.Updated == 0 {
+		return errors.Errorf("a pre-start command is already running for app %q", app.GetName())
+	}
+	args := append(environmentArgs(appEnvironment(app)), sshArgs(target.sshTarget())...)
+	args = append(args, cmd)
+	err = runCmd(w, w, args...)
+	if err != nil {
+		// The flag stays set on failure, keeping Start blocked until a
+		// successful retry.
+		return &provision.Error{Reason: "pre-start command failed", Err: err}
+	}
+	_, err = coll.UpdateAll(
+		bson.M{"app": app.GetName()},
+		bson.M{"$unset": bson.M{"prestartpending": ""}},
+	)
+	return err
+}
+
+// Freeze marks every instance of the app so status collection keeps updating
+// their fields but stops triggering side effects — status change
+// notifications and the like — until Unfreeze. Operators freeze an app
+// before sensitive migrations, when a spurious reaction to an instance
+// change could restart units mid-operation.
+func (p *jujuProvisioner) Freeze(appName string) error {
+	return setFrozen(appName, bson.M{"$set": bson.M{"frozen": true}})
+}
+
+// Unfreeze reverts Freeze, resuming the side effects of status collection
+// for the app's instances.
+func (p *jujuProvisioner) Unfreeze(appName string) error {
+	return setFrozen(appName, bson.M{"$unset": bson.M{"frozen": ""}})
+}
+
+// CordonMachine drains every unit hosted on the machine for maintenance:
+// their instances are deregistered from the apps' load balancers — without
+// terminating anything — and marked cordoned, which keeps ELB reconciliation
+// from registering them back. UncordonMachine reverts it.
+func (p *jujuProvisioner) CordonMachine(machine int) error {
+	return p.setCordoned(machine, true)
+}
+
+// UncordonMachine reverts CordonMachine, registering the started units of
+// the machine back with their load balancers.
+func (p *jujuProvisioner) UncordonMachine(machine int) error {
+	return p.setCordoned(machine, false)
+}
+
+func (p *jujuProvisioner) setCordoned(machine int, cordoned bool) error {
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	var insts []instance
+	err = coll.Find(bson.M{"machine": machine}).All(&insts)
+	if err != nil {
+		return err
+	}
+	if len(insts) == 0 {
+		return errors.Errorf("no units found on machine %d", machine)
+	}
+	if p.elbSupport() {
+		for _, inst := range insts {
+			if inst.InstanceID == "" {
+				continue
+			}
+			if cordoned {
+				err = p.LoadBalancer().Deregister(&namedApp{name: inst.AppName}, inst.InstanceID)
+			} else if inst.Status == provision.StatusStarted.String() {
+				err = p.LoadBalancer().Register(&namedApp{name: inst.AppName}, inst.InstanceID)
+			} else {
+				continue
+			}
+			if err != nil && err != ErrLoadBalancerNotFound {
+				return err
+			}
+		}
+	}
+	update := bson.M{"$unset": bson.M{"cordoned": ""}}
+	action := "uncordon"
+	if cordoned {
+		update = bson.M{"$set": bson.M{"cordoned": true}}
+		action = "cordon"
+	}
+	if _, err = coll.UpdateAll(bson.M{"machine": machine}, update); err != nil {
+		return err
+	}
+	recordMachineAction(machine, action)
+	return nil
+}
+
+func setFrozen(appName string, update bson.M) error {
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	_, err = coll.UpdateAll(bson.M{"app": appName}, update)
+	return err
+}
+
+// preStartPending tells whether the app has a pre-start command that hasn't
+// succeeded yet.
+func preStartPending(appName string) (bool, error) {
+	coll, err := unitsCollection()
+	if err != nil {
+		return false, err
+	}
+	defer coll.Close()
+	n, err := coll.Find(bson.M{"app": appName, "prestartpending": true}).Count()
+	return n > 0, err
+}
+
+func (p *jujuProvisioner) Stop(app provision.App, process string, version appTypes.AppVersion) error {
+	return p.runHook(app, stopHook, nil)
+}
+
+// deployHook returns the charm hook invoked to refresh the app's code on its
+// units. Charms for different platforms name this hook differently, so the
+// juju:deploy-hook setting lets operators point to the one theirs uses.
+func deployHook() string {
+	if hook, err := config.GetString("juju:deploy-hook"); err == nil && hook != "" {
+		return hook
+	}
+	return defaultDeployHook
+}
+
+// Refresh runs the deploy hook on every unit of the app, making the units
+// fetch and serve the current code of the app's repository.
+func (p *jujuProvisioner) Refresh(app provision.App, w io.Writer) error {
+	return p.runHook(app, deployHook(), w)
+}
+
+func (p *jujuProvisioner) runHook(app provision.App, hook string, w io.Writer) error {
+	if w == nil {
+		w = ioutil.Discard
+	}
+	return p.ExecuteCommand(provision.ExecOptions{
+		App:    app,
+		Stdout: w,
+		Stderr: w,
+		Cmds:   []string{hook},
+	})
+}
+
+func (p *jujuProvisioner) Units(apps ...provision.App) ([]provision.Unit, error) {
+	names := make([]string, len(apps))
+	for i, app := range apps {
+		names[i] = app.GetName()
+	}
+	coll, err := unitsCollection()
+	if err != nil {
+		return nil, err
+	}
+	defer coll.Close()
+	var insts []instance
+	err = coll.Find(bson.M{"app": bson.M{"$in": names}}).Sort("_id").All(&insts)
+	if err != nil {
+		return nil, err
+	}
+	units := make([]provision.Unit, len(insts))
+	for i, inst := range insts {
+		units[i] = inst.unit()
+	}
+	return units, nil
+}
+
+func (inst *instance) unit() provision.Unit {
+	var addr *url.URL
+	if inst.PublicAddress != "" {
+		addr = &url.URL{Scheme: "http", Host: inst.PublicAddress}
+	}
+	return provision.Unit{
+		ID:      inst.UnitName,
+		Name:    inst.UnitName,
+		AppName: inst.AppName,
+		IP:      inst.PublicAddress,
+		Status:  provision.Status(inst.Status),
+		Address: addr,
+	}
+}
+
+func (p *jujuProvisioner) RoutableAddresses(app provision.App) ([]appTypes.RoutableAddresses, error) {
+	insts, err := p.appInstances(app.GetName())
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*url.URL
+	for _, inst := range insts {
+		if inst.PublicAddress == "" {
+			continue
+		}
+		addrs = append(addrs, &url.URL{Scheme: "http", Host: inst.PublicAddress})
+	}
+	return []appTypes.RoutableAddresses{{Addresses: addrs}}, nil
+}
+
+// Expose makes the app reachable from the internet through juju's own
+// exposure mechanism, for apps that don't sit behind a load balancer.
+func (p *jujuProvisioner) Expose(app provision.App) error {
+	var buf bytes.Buffer
+	serviceName, err := jujuServiceName(app.GetName())
+	if err != nil {
+		return err
+	}
+	args := append(environmentArgs(appEnvironment(app)), "expose", serviceName)
+	err = runCmd(&buf, &buf, args...)
+	if err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	return p.setExposed(app.GetName(), true)
+}
+
+// Unexpose undoes Expose, blocking external access to the app's units.
+func (p *jujuProvisioner) Unexpose(app provision.App) error {
+	var buf bytes.Buffer
+	serviceName, err := jujuServiceName(app.GetName())
+	if err != nil {
+		return err
+	}
+	args := append(environmentArgs(appEnvironment(app)), "unexpose", serviceName)
+	err = runCmd(&buf, &buf, args...)
+	if err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	return p.setExposed(app.GetName(), false)
+}
+
+func (p *jujuProvisioner) setExposed(appName string, exposed bool) error {
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	_, err = coll.UpdateAll(bson.M{"app": appName}, bson.M{"$set": bson.M{"exposed": exposed}})
+	return err
+}
+
+// Addr returns the address used to access the app: the DNS name of its load
+// balancer when ELB support is enabled, otherwise the public address of one
+// of its units, which is only disclosed after the app has been exposed.
+func (p *jujuProvisioner) Addr(app provision.App) (string, error) {
+	router, err := p.router()
+	if err != nil {
+		return "", err
+	}
+	return router.Addr(app)
+}
+
+func (p *jujuProvisioner) RegisterUnit(app provision.App, unitID string, customData map[string]interface{}) error {
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	return coll.Update(
+		bson.M{"_id": unitID, "app": app.GetName()},
+		bson.M{"$set": bson.M{"status": provision.StatusStarted.String()}},
+	)
+}
+
+func (p *jujuProvisioner) appInstances(appName string) ([]instance, error) {
+	coll, err := unitsCollection()
+	if err != nil {
+		return nil, err
+	}
+	defer coll.Close()
+	var insts []instance
+	err = coll.Find(bson.M{"app": appName}).Sort("_id").All(&insts)
+	return insts, err
+}
+
+// Shutdown stops the ELB reconcile worker and waits for outstanding
+// background operations to finish, giving up after the timeout. Callers
+// should stop enqueueing work (i.e. stop serving requests) before calling
+// it.
+func (p *jujuProvisioner) Shutdown(timeout time.Duration) error {
+	stopELBReconcileLoop()
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return errors.Errorf("juju: shutdown timed out after %s waiting for background operations", timeout)
+	}
+}
+
+// ErrMachineNotFound is the error returned by AppForMachine when no unit
+// lives on the given machine.
+var ErrMachineNotFound = errors.New("juju: machine not found")
+
+// AppForMachine tells which app has a unit on the given machine. It's a
+// debugging helper for operators tailing juju logs, where only the machine
+// number shows up.
+func (p *jujuProvisioner) AppForMachine(machine int) (string, error) {
+	coll, err := unitsCollection()
+	if err != nil {
+		return "", err
+	}
+	defer coll.Close()
+	var inst instance
+	err = coll.Find(bson.M{"machine": machine}).One(&inst)
+	if err == mgo.ErrNotFound {
+		return "", ErrMachineNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return inst.AppName, nil
+}
+
+// Apps returns the name of every app with at least one unit tracked in the
+// units collection. It's meant for admin tooling and cleanup jobs, and
+// doesn't shell out to juju.
+func (p *jujuProvisioner) Apps() ([]string, error) {
+	coll, err := unitsCollection()
+	if err != nil {
+		return nil, err
+	}
+	defer coll.Close()
+	var names []string
+	err = coll.Find(nil).Distinct("app", &names)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// sshUser returns the user commands should log in as on the unit's machine,
+// from juju:platform-defaults:<platform>:ssh-user or, failing that, the
+// global juju:ssh:user. An empty string keeps the default user configured by
+// juju (ubuntu).
+func sshUser(platform string) string {
+	if platform != "" {
+		if user, err := config.GetString("juju:platform-defaults:" + platform + ":ssh-user"); err == nil && user != "" {
+			return user
+		}
+	}
+	user, _ := config.GetString("juju:ssh:user")
+	return user
+}
+
+// sshTarget returns the identifier passed to "juju ssh" to reach the unit.
+// By default it's the machine number (or the container path for units nested
+// in LXC containers), letting juju resolve the address; the
+// juju:ssh:address-type setting can force the stored public or private
+// address instead, for setups where juju's resolution doesn't work. When a
+// custom ssh user is configured it's prepended as user@, for charms that run
+// the app under a user other than juju's default.
+func (inst *instance) sshTarget() string {
+	target := inst.sshAddress()
+	if user := sshUser(inst.Type); user != "" {
+		target = user + "@" + target
+	}
+	return target
+}
+
+func (inst *instance) sshAddress() string {
+	addrType, _ := config.GetString("juju:ssh:address-type")
+	switch addrType {
+	case "public":
+		if inst.PublicAddress != "" {
+			return inst.PublicAddress
+		}
+	case "private":
+		if inst.PrivateAddress != "" {
+			return inst.PrivateAddress
+		}
+	}
+	if inst.Container != "" {
+		return inst.Container
+	}
+	return strconv.Itoa(inst.Machine)
+}
+
+// sshArgs builds the argument list used to run commands on the given machine
+// or container through "juju ssh". When juju:ssh:jump-host is defined, the
+// connection is tunneled through the bastion with an ssh ProxyCommand,
+// allowing access to units living in private subnets.
+func sshArgs(target string) []string {
+	args := []string{"ssh", "-o", "StrictHostKeyChecking no", "-q"}
+	if jumpHost, _ := config.GetString("juju:ssh:jump-host"); jumpHost != "" {
+		args = append(args, "-o", fmt.Sprintf("ProxyCommand=ssh -W %%h:%%p %s", jumpHost))
+	}
+	return append(args, target)
+}
+
+func (p *jujuProvisioner) ExecuteCommand(opts provision.ExecOptions) error {
+	return p.ExecuteCommandFiltered(opts)
+}
+
+// ExecuteCommandOnMachine runs the command on the given juju machine, which
+// must back one of the app's units. Targeting the machine directly is useful
+// when units are colocated or when the problem is the machine itself rather
+// than a unit.
+func (p *jujuProvisioner) ExecuteCommandOnMachine(w io.Writer, app provision.App, machine int, cmd string, args ...string) error {
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	n, err := coll.Find(bson.M{"app": app.GetName(), "machine": machine}).Count()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.Errorf("machine %d does not belong to app %q", machine, app.GetName())
+	}
+	if w == nil {
+		w = ioutil.Discard
+	}
+	cmdArgs := append(environmentArgs(appEnvironment(app)), sshArgs(strconv.Itoa(machine))...)
+	cmdArgs = append(cmdArgs, cmd)
+	cmdArgs = append(cmdArgs, args...)
+	return runCmd(w, w, cmdArgs...)
+}
+
+// shellQuote quotes s as a single shell word, wrapping it in single quotes
+// and escaping any embedded single quote.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// authorizedKeys returns the public keys that should be present on every
+// unit, from juju:ssh:authorized-keys, so support staff can log into the
+// machines. An empty list disables key injection.
+func authorizedKeys() []string {
+	keys, _ := config.GetList("juju:ssh:authorized-keys")
+	return keys
+}
+
+// injectSSHKeys appends the given keys to the unit's authorized_keys file,
+// skipping keys that are already there, and marks the unit, so the injection
+// task can tell re-provisioned units from untouched ones.
+func (p *jujuProvisioner) injectSSHKeys(inst instance, keys []string) error {
+	cmds := []string{"mkdir -p ~/.ssh", "touch ~/.ssh/authorized_keys"}
+	for _, key := range keys {
+		quoted := shellQuote(key)
+		cmds = append(cmds, fmt.Sprintf("grep -qxF %s ~/.ssh/authorized_keys || echo %s >> ~/.ssh/authorized_keys", quoted, quoted))
+	}
+	script := strings.Join(cmds, "; ")
+	var buf bytes.Buffer
+	args := append(sshArgs(inst.sshTarget()), "/bin/sh", "-c", shellQuote(script))
+	if err := runCmd(&buf, &buf, args...); err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	return coll.UpdateId(inst.UnitName, bson.M{"$set": bson.M{"keysinjected": true}})
+}
+
+// restartUnit runs the restart hook on a single unit over ssh, outside the
+// ExecuteCommand flow, for background tasks that only carry the unit name.
+func (p *jujuProvisioner) restartUnit(inst instance) error {
+	var buf bytes.Buffer
+	args := append(sshArgs(inst.sshTarget()), restartHook)
+	if err := runCmd(&buf, &buf, args...); err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	return nil
+}
+
+// ExecuteCommandShell runs the script through /bin/sh -c on each unit, so
+// compound commands — pipes, redirects, && chains — work. "juju ssh" hands
+// its argv to the remote shell, so the script is quoted into a single word to
+// survive that extra round of word splitting.
+func (p *jujuProvisioner) ExecuteCommandShell(opts provision.ExecOptions, script string) error {
+	opts.Cmds = []string{"/bin/sh", "-c", shellQuote(script)}
+	return p.ExecuteCommandFiltered(opts)
+}
+
+// Values of juju:exec:output-format, controlling how the per-unit headers of
+// ExecuteCommand are written.
+const (
+	execFormatText      = "text"
+	execFormatDelimiter = "delimiter"
+	execFormatJSON      = "json"
+)
+
+// execOutputFormat returns the configured header format, falling back to
+// text for unknown values.
+func execOutputFormat() string {
+	format, _ := config.GetString("juju:exec:output-format")
+	switch format {
+	case execFormatDelimiter, execFormatJSON:
+		return format
+	}
+	return execFormatText
+}
+
+// execHeader is the per-unit header emitted in the json output format, one
+// object per line before the unit's output.
+type execHeader struct {
+	Unit string `json:"unit"`
+	Down bool   `json:"down,omitempty"`
+}
+
+// ExecuteCommandOnProcess runs a command like ExecuteCommand, but only on
+// the units of the given process ("" targets the main web tier).
+func (p *jujuProvisioner) ExecuteCommandOnProcess(opts provision.ExecOptions, process string) error {
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	query := bson.M{"app": opts.App.GetName(), "process": process}
+	if process == "" {
+		// Older documents don't carry the field at all.
+		query["process"] = bson.M{"$in": []interface{}{"", nil}}
+	}
+	var insts []instance
+	err = coll.Find(query).All(&insts)
+	if err != nil {
+		return err
+	}
+	if len(insts) == 0 {
+		return errors.Errorf("app %q has no units of process %q", opts.App.GetName(), process)
+	}
+	opts.Units = make([]string, len(insts))
+	for i, inst := range insts {
+		opts.Units[i] = inst.UnitName
+	}
+	return p.ExecuteCommandFiltered(opts)
+}
+
+// ExecuteCommandFiltered runs a command like ExecuteCommand, but only on the
+// units currently in one of the given statuses. It returns an error when no
+// unit matches, so maintenance commands don't silently run on nothing. With no
+// statuses it behaves exactly like ExecuteCommand.
+func (p *jujuProvisioner) ExecuteCommandFiltered(opts provision.ExecOptions, statuses ...provision.Status) error {
+	insts, err := p.appInstances(opts.App.GetName())
+	if err != nil {
+		return err
+	}
+	if len(opts.Units) > 0 {
+		wanted := make(map[string]struct{}, len(opts.Units))
+		for _, name := range opts.Units {
+			wanted[name] = struct{}{}
+		}
+		var filtered []instance
+		for _, inst := range insts {
+			if _, ok := wanted[inst.UnitName]; ok {
+				filtered = append(filtered, inst)
+			}
+		}
+		insts = filtered
+	}
+	if len(insts) == 0 {
+		return provision.ErrEmptyApp
+	}
+	if len(statuses) > 0 {
+		allowed := make(map[string]struct{}, len(statuses))
+		for _, status := range statuses {
+			allowed[status.String()] = struct{}{}
+		}
+		var filtered []instance
+		for _, inst := range insts {
+			if _, ok := allowed[inst.Status]; ok {
+				filtered = append(filtered, inst)
+			}
+		}
+		if len(filtered) == 0 {
+			return errors.Errorf("no unit of app %q matches the given statuses", opts.App.GetName())
+		}
+		insts = filtered
+	}
+	stdout, stderr := opts.Stdout, opts.Stderr
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	format := execOutputFormat()
+	for _, inst := range insts {
+		down := inst.Status == StatusDown.String()
+		switch format {
+		case execFormatDelimiter:
+			fmt.Fprintf(stdout, "----- unit %s -----\n", inst.UnitName)
+		case execFormatJSON:
+			header, _ := json.Marshal(execHeader{Unit: inst.UnitName, Down: down})
+			fmt.Fprintf(stdout, "%s\n", header)
+		default:
+			// The text format predates the others and scripts parse it; it
+			// must stay byte-for-byte identical.
+			if len(insts) > 1 {
+				fmt.Fprintf(stdout, "Output from unit %q:\n\n", inst.UnitName)
+			}
+		}
+		if down {
+			if format == execFormatText {
+				fmt.Fprintf(stdout, "Unit %q is down, it won't run any command.\n", inst.UnitName)
+			}
+			continue
+		}
+		args := append(environmentArgs(appEnvironment(opts.App)), sshArgs(inst.sshTarget())...)
+		args = append(args, opts.Cmds...)
+		err = runCmd(stdout, stderr, args...)
+	}
+	return err
+}
@@ -0,0 +1,2078 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/app/bind"
+	"github.com/tsuru/tsuru/exec/exectest"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	"github.com/tsuru/tsuru/repository"
+	_ "github.com/tsuru/tsuru/repository/repositorytest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *S) TestRegistered(c *check.C) {
+	p, err := provision.Get("juju")
+	c.Assert(err, check.IsNil)
+	c.Assert(p, check.FitsTypeOf, &jujuProvisioner{})
+}
+
+func (s *S) TestSSHArgs(c *check.C) {
+	args := sshArgs("4")
+	c.Assert(args, check.DeepEquals, []string{"ssh", "-o", "StrictHostKeyChecking no", "-q", "4"})
+}
+
+func (s *S) TestSSHArgsJumpHost(c *check.C) {
+	config.Set("juju:ssh:jump-host", "bastion")
+	args := sshArgs("4")
+	expected := []string{
+		"ssh", "-o", "StrictHostKeyChecking no", "-q",
+		"-o", "ProxyCommand=ssh -W %h:%p bastion",
+		"4",
+	}
+	c.Assert(args, check.DeepEquals, expected)
+}
+
+func (s *S) TestExecuteCommand(c *check.C) {
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	app := provisiontest.NewFakeApp("almah", "static", 0)
+	s.addInstances(c, instance{
+		UnitName: "almah/0",
+		AppName:  "almah",
+		Machine:  1,
+		Status:   provision.StatusStarted.String(),
+	})
+	var buf bytes.Buffer
+	p := &jujuProvisioner{}
+	err := p.ExecuteCommand(provision.ExecOptions{
+		App:    app,
+		Stdout: &buf,
+		Stderr: &buf,
+		Cmds:   []string{"ls", "-lh"},
+	})
+	c.Assert(err, check.IsNil)
+	args := []string{"ssh", "-o", "StrictHostKeyChecking no", "-q", "1", "ls", "-lh"}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestExecuteCommandJumpHost(c *check.C) {
+	config.Set("juju:ssh:jump-host", "bastion.internal")
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	app := provisiontest.NewFakeApp("almah", "static", 0)
+	s.addInstances(c, instance{
+		UnitName: "almah/0",
+		AppName:  "almah",
+		Machine:  1,
+		Status:   provision.StatusStarted.String(),
+	})
+	var buf bytes.Buffer
+	p := &jujuProvisioner{}
+	err := p.ExecuteCommand(provision.ExecOptions{
+		App:    app,
+		Stdout: &buf,
+		Stderr: &buf,
+		Cmds:   []string{"uname", "-a"},
+	})
+	c.Assert(err, check.IsNil)
+	args := []string{
+		"ssh", "-o", "StrictHostKeyChecking no", "-q",
+		"-o", "ProxyCommand=ssh -W %h:%p bastion.internal",
+		"1", "uname", "-a",
+	}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestExecuteCommandSkipsDownUnits(c *check.C) {
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	app := provisiontest.NewFakeApp("almah", "static", 0)
+	s.addInstances(c,
+		instance{UnitName: "almah/0", AppName: "almah", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "almah/1", AppName: "almah", Machine: 2, Status: StatusDown.String()},
+	)
+	var buf bytes.Buffer
+	p := &jujuProvisioner{}
+	err := p.ExecuteCommand(provision.ExecOptions{
+		App:    app,
+		Stdout: &buf,
+		Stderr: &buf,
+		Cmds:   []string{"ls"},
+	})
+	c.Assert(err, check.IsNil)
+	downArgs := []string{"ssh", "-o", "StrictHostKeyChecking no", "-q", "2", "ls"}
+	c.Assert(fexec.ExecutedCmd("juju", downArgs), check.Equals, false)
+	c.Assert(buf.String(), check.Matches, `(?s).*Unit "almah/1" is down, it won't run any command\..*`)
+}
+
+func (s *S) TestExpose(c *check.C) {
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	app := provisiontest.NewFakeApp("sumday", "python", 0)
+	s.addInstances(c, instance{
+		UnitName:      "sumday/0",
+		AppName:       "sumday",
+		Machine:       1,
+		PublicAddress: "sumday.cloud.tsuru.io",
+		Status:        provision.StatusStarted.String(),
+	})
+	p := &jujuProvisioner{}
+	err := p.Expose(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"expose", "sumday"}), check.Equals, true)
+	c.Assert(s.getInstance(c, "sumday/0").Exposed, check.Equals, true)
+}
+
+func (s *S) TestUnexpose(c *check.C) {
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	app := provisiontest.NewFakeApp("sumday", "python", 0)
+	s.addInstances(c, instance{
+		UnitName: "sumday/0",
+		AppName:  "sumday",
+		Machine:  1,
+		Status:   provision.StatusStarted.String(),
+		Exposed:  true,
+	})
+	p := &jujuProvisioner{}
+	err := p.Unexpose(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"unexpose", "sumday"}), check.Equals, true)
+	c.Assert(s.getInstance(c, "sumday/0").Exposed, check.Equals, false)
+}
+
+func (s *S) TestAddrReturnsPublicAddressWhenExposed(c *check.C) {
+	app := provisiontest.NewFakeApp("sumday", "python", 0)
+	s.addInstances(c, instance{
+		UnitName:      "sumday/0",
+		AppName:       "sumday",
+		PublicAddress: "sumday.cloud.tsuru.io",
+		Status:        provision.StatusStarted.String(),
+		Exposed:       true,
+	})
+	p := &jujuProvisioner{}
+	addr, err := p.Addr(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(addr, check.Equals, "sumday.cloud.tsuru.io")
+}
+
+func (s *S) TestAddrNotExposed(c *check.C) {
+	app := provisiontest.NewFakeApp("sumday", "python", 0)
+	s.addInstances(c, instance{
+		UnitName:      "sumday/0",
+		AppName:       "sumday",
+		PublicAddress: "sumday.cloud.tsuru.io",
+		Status:        provision.StatusStarted.String(),
+	})
+	p := &jujuProvisioner{}
+	_, err := p.Addr(app)
+	c.Assert(err, check.ErrorMatches, `app "sumday" is not exposed`)
+}
+
+func (s *S) TestELBSupportIsConcurrencySafe(c *check.C) {
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	p := &jujuProvisioner{}
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.Check(p.elbSupport(), check.Equals, true)
+		}()
+		go func() {
+			defer wg.Done()
+			c.Check(p.LoadBalancer(), check.NotNil)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *S) TestRepositoryURLSchemes(c *check.C) {
+	if old, err := config.Get("repo-manager"); err == nil {
+		defer config.Set("repo-manager", old)
+	} else {
+		defer config.Unset("repo-manager")
+	}
+	config.Set("repo-manager", "fake")
+	defer config.Unset("juju:repo-scheme")
+	err := repository.Manager().CreateRepository("highway", nil)
+	c.Assert(err, check.IsNil)
+	defer repository.Manager().RemoveRepository("highway")
+	c.Assert(repositoryURL("highway"), check.Equals, "git://git.tsuru.io/highway.git")
+	config.Set("juju:repo-scheme", "ro")
+	c.Assert(repositoryURL("highway"), check.Equals, "git://git.tsuru.io/highway.git")
+	config.Set("juju:repo-scheme", "rw")
+	c.Assert(repositoryURL("highway"), check.Equals, "git@git.tsuru.io:highway.git")
+	config.Set("juju:repo-scheme", "ssh")
+	c.Assert(repositoryURL("highway"), check.Equals, "ssh://git@git.tsuru.io/highway.git")
+}
+
+func (s *S) TestNameAndCapabilities(c *check.C) {
+	p := &jujuProvisioner{}
+	c.Assert(p.Name(), check.Equals, "juju")
+	c.Assert(p.Capabilities(), check.DeepEquals, []string{"exec", "expose", "restart"})
+}
+
+func (s *S) TestCapabilitiesWithELB(c *check.C) {
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	p := &jujuProvisioner{}
+	c.Assert(p.Capabilities(), check.DeepEquals, []string{"exec", "expose", "restart", "elb"})
+}
+
+func (s *S) TestExecuteCommandFiltered(c *check.C) {
+	var buf bytes.Buffer
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c,
+		instance{UnitName: "myapp/0", AppName: "myapp", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "myapp/1", AppName: "myapp", Machine: 2, Status: StatusInstalling.String()},
+	)
+	app := provisiontest.NewFakeApp("myapp", "python", 2)
+	p := &jujuProvisioner{}
+	err := p.ExecuteCommandFiltered(provision.ExecOptions{
+		App:    app,
+		Stdout: &buf,
+		Cmds:   []string{"ls"},
+	}, provision.StatusStarted)
+	c.Assert(err, check.IsNil)
+	args := append(sshArgs("1"), "ls")
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+	args = append(sshArgs("2"), "ls")
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, false)
+}
+
+func (s *S) TestExecuteCommandFilteredNoMatch(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c,
+		instance{UnitName: "myapp/0", AppName: "myapp", Machine: 1, Status: StatusInstalling.String()},
+	)
+	app := provisiontest.NewFakeApp("myapp", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.ExecuteCommandFiltered(provision.ExecOptions{
+		App:  app,
+		Cmds: []string{"ls"},
+	}, provision.StatusStarted)
+	c.Assert(err, check.ErrorMatches, `no unit of app "myapp" matches the given statuses`)
+}
+
+func (s *S) TestAddUnitsWithConstraints(c *check.C) {
+	output := []byte("Unit 'chemistry/1' added to machine 3\nUnit 'chemistry/2' added to machine 4\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("chemistry", "python", 1)
+	p := &jujuProvisioner{}
+	var buf bytes.Buffer
+	err := p.AddUnitsWithConstraints(app, 2, "instance-type=m1.large", &buf)
+	c.Assert(err, check.IsNil)
+	args := []string{"add-unit", "chemistry", "--num-units", "2", "--constraints", "instance-type=m1.large"}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+	inst := s.getInstance(c, "chemistry/1")
+	c.Assert(inst.Machine, check.Equals, 3)
+	c.Assert(inst.InstanceType, check.Equals, "m1.large")
+	inst = s.getInstance(c, "chemistry/2")
+	c.Assert(inst.Machine, check.Equals, 4)
+	c.Assert(inst.InstanceType, check.Equals, "m1.large")
+}
+
+func (s *S) TestConstraintValue(c *check.C) {
+	c.Assert(constraintValue("instance-type=m1.large", "instance-type"), check.Equals, "m1.large")
+	c.Assert(constraintValue("mem=4G instance-type=m1.large", "instance-type"), check.Equals, "m1.large")
+	c.Assert(constraintValue("mem=4G", "instance-type"), check.Equals, "")
+	c.Assert(constraintValue("", "instance-type"), check.Equals, "")
+}
+
+func (s *S) TestJujuServiceName(c *check.C) {
+	name, err := jujuServiceName("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(name, check.Equals, "myapp")
+	name, err = jujuServiceName("as_i_rise")
+	c.Assert(err, check.IsNil)
+	c.Assert(name, check.Equals, "as-i-rise")
+	_, err = jujuServiceName("-bad-")
+	c.Assert(err, check.ErrorMatches, `juju: app name "-bad-" maps to invalid service name "-bad-"`)
+	config.Set("juju:service-prefix", "tsuru-")
+	defer config.Unset("juju:service-prefix")
+	name, err = jujuServiceName("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(name, check.Equals, "tsuru-myapp")
+	c.Assert(appNameFromService("tsuru-myapp"), check.Equals, "myapp")
+	c.Assert(appNameFromService("myapp"), check.Equals, "myapp")
+}
+
+func (s *S) TestDestroyUsesServicePrefix(c *check.C) {
+	config.Set("juju:service-prefix", "tsuru-")
+	defer config.Unset("juju:service-prefix")
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("myapp", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Destroy(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"destroy-service", "tsuru-myapp"}), check.Equals, true)
+}
+
+func (s *S) TestForgetApp(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c,
+		instance{UnitName: "ghost/0", AppName: "ghost", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "ghost/1", AppName: "ghost", Machine: 2, Status: provision.StatusStarted.String()},
+	)
+	p := &jujuProvisioner{}
+	err := p.ForgetApp("ghost")
+	c.Assert(err, check.IsNil)
+	insts, err := p.appInstances("ghost")
+	c.Assert(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 0)
+	c.Assert(fexec.GetCommands("juju"), check.HasLen, 0)
+}
+
+func (s *S) TestForgetAppDestroysELB(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	s.addInstances(c, instance{UnitName: "ghost/0", AppName: "ghost", Machine: 1})
+	p := &jujuProvisioner{}
+	err := p.ForgetApp("ghost")
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.reqs, check.HasLen, 1)
+	c.Assert(srv.reqs[0].Get("Action"), check.Equals, "DeleteLoadBalancer")
+	c.Assert(srv.reqs[0].Get("LoadBalancerName"), check.Equals, "ghost")
+}
+
+// envApp wraps a fake app declaring a juju environment, exercising the
+// environmentApp optional interface.
+type envApp struct {
+	*provisiontest.FakeApp
+	env string
+}
+
+func (a *envApp) Environment() string {
+	return a.env
+}
+
+func (s *S) TestAppEnvironment(c *check.C) {
+	app := provisiontest.NewFakeApp("plain", "python", 1)
+	c.Assert(appEnvironment(app), check.Equals, "")
+	c.Assert(appEnvironment(&envApp{FakeApp: app, env: "staging"}), check.Equals, "staging")
+}
+
+func (s *S) TestDestroyUsesAppEnvironment(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := &envApp{FakeApp: provisiontest.NewFakeApp("myapp", "python", 1), env: "staging"}
+	p := &jujuProvisioner{}
+	err := p.Destroy(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"-e", "staging", "destroy-service", "myapp"}), check.Equals, true)
+}
+
+func (s *S) TestRemoveUnitUsesAppEnvironment(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "two/0", AppName: "two", Machine: 3, Status: provision.StatusStarted.String()})
+	app := &envApp{FakeApp: provisiontest.NewFakeApp("two", "python", 1), env: "staging"}
+	p := &jujuProvisioner{}
+	err := p.RemoveUnit(app, "two/0")
+	c.Assert(err, check.IsNil)
+	err = p.Shutdown(5 * time.Second)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"-e", "staging", "remove-unit", "two/0"}), check.Equals, true)
+}
+
+func (s *S) TestExposeUsesAppEnvironment(c *check.C) {
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	app := &envApp{FakeApp: provisiontest.NewFakeApp("sumday", "python", 0), env: "staging"}
+	p := &jujuProvisioner{}
+	err := p.Expose(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"-e", "staging", "expose", "sumday"}), check.Equals, true)
+	err = p.Unexpose(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"-e", "staging", "unexpose", "sumday"}), check.Equals, true)
+}
+
+func (s *S) TestScaleUp(c *check.C) {
+	output := []byte("Unit 'stairs/1' added to machine 3\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "stairs/0", AppName: "stairs", Machine: 1, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("stairs", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Scale(app, 2)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"add-unit", "stairs", "--num-units", "1"}), check.Equals, true)
+}
+
+func (s *S) TestScaleDownToZeroKeepsService(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c,
+		instance{UnitName: "stairs/0", AppName: "stairs", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "stairs/1", AppName: "stairs", Machine: 2, Status: provision.StatusStarted.String()},
+	)
+	app := provisiontest.NewFakeApp("stairs", "python", 2)
+	p := &jujuProvisioner{}
+	err := p.Scale(app, 0)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"remove-unit", "stairs/0"}), check.Equals, true)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"remove-unit", "stairs/1"}), check.Equals, true)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"destroy-service", "stairs"}), check.Equals, false)
+	insts, err := p.appInstances("stairs")
+	c.Assert(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 0)
+}
+
+func (s *S) TestScaleNoop(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "stairs/0", AppName: "stairs", Machine: 1, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("stairs", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Scale(app, 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.GetCommands("juju"), check.HasLen, 0)
+}
+
+func (s *S) TestScaleBelowELBMinimum(c *check.C) {
+	config.Set("juju:use-elb", true)
+	config.Set("juju:elb:min-units", 1)
+	defer config.Unset("juju:use-elb")
+	defer config.Unset("juju:elb:min-units")
+	app := provisiontest.NewFakeApp("stairs", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Scale(app, 0)
+	c.Assert(err, check.ErrorMatches, `cannot scale app "stairs" below 1 units: it's behind a load balancer`)
+}
+
+func (s *S) TestAppForMachine(c *check.C) {
+	s.addInstances(c, instance{UnitName: "physics/0", AppName: "physics", Machine: 42})
+	p := &jujuProvisioner{}
+	appName, err := p.AppForMachine(42)
+	c.Assert(err, check.IsNil)
+	c.Assert(appName, check.Equals, "physics")
+	_, err = p.AppForMachine(43)
+	c.Assert(err, check.Equals, ErrMachineNotFound)
+}
+
+func (s *S) TestRunOnce(c *check.C) {
+	output := []byte("Unit 'clock/3' added to machine 9\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("clock", "python", 1)
+	p := &jujuProvisioner{}
+	var buf bytes.Buffer
+	err := p.RunOnce(app, "python manage.py clearsessions", &buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"add-unit", "clock", "--num-units", "1"}), check.Equals, true)
+	args := append(sshArgs("9"), "python manage.py clearsessions")
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"remove-unit", "clock/3"}), check.Equals, true)
+	insts, err := p.appInstances("clock")
+	c.Assert(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 0)
+}
+
+func (s *S) TestRunOnceCleansUpOnFailure(c *check.C) {
+	output := []byte("Unit 'clock/3' added to machine 9\n")
+	fexec := exectest.FailLaterExecutor{
+		Succeeds: 1,
+		FakeExecutor: exectest.FakeExecutor{
+			Output: map[string][][]byte{"*": {output}},
+		},
+	}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("clock", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.RunOnce(app, "boom", nil)
+	c.Assert(err, check.NotNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"remove-unit", "clock/3"}), check.Equals, true)
+	insts, err := p.appInstances("clock")
+	c.Assert(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 0)
+}
+
+func (s *S) TestShutdownWaitsForBackgroundWork(c *check.C) {
+	release := make(chan struct{})
+	spawn(func() { <-release })
+	p := &jujuProvisioner{}
+	err := p.Shutdown(10 * time.Millisecond)
+	c.Assert(err, check.ErrorMatches, "juju: shutdown timed out after 10ms waiting for background operations")
+	close(release)
+	err = p.Shutdown(time.Second)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestDestroyTerminatesMachines(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "doomed/0", AppName: "doomed", Machine: 7})
+	app := provisiontest.NewFakeApp("doomed", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Destroy(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"terminate-machine", "7"}), check.Equals, true)
+}
+
+func (s *S) TestDestroyRetriesStragglerMachines(c *check.C) {
+	oldInterval := destroyPollInterval
+	destroyPollInterval = 0
+	defer func() { destroyPollInterval = oldInterval }()
+	straggler := []byte("machines:\n  7:\n    agent-state: running\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{
+		"status": {straggler, []byte("machines: {}\n")},
+	}}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "doomed/0", AppName: "doomed", Machine: 7})
+	app := provisiontest.NewFakeApp("doomed", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Destroy(app)
+	c.Assert(err, check.IsNil)
+	var terminations int
+	for _, cmd := range fexec.GetCommands("juju") {
+		if args := cmd.GetArgs(); len(args) == 2 && args[0] == "terminate-machine" {
+			terminations++
+		}
+	}
+	c.Assert(terminations, check.Equals, 2)
+}
+
+func (s *S) TestDestroyReportsUnterminatedMachines(c *check.C) {
+	oldInterval := destroyPollInterval
+	destroyPollInterval = 0
+	defer func() { destroyPollInterval = oldInterval }()
+	straggler := []byte("machines:\n  7:\n    agent-state: running\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {straggler}}}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "doomed/0", AppName: "doomed", Machine: 7})
+	app := provisiontest.NewFakeApp("doomed", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Destroy(app)
+	c.Assert(err, check.ErrorMatches, `juju: failed to terminate machines \[7\], operator intervention required`)
+}
+
+func (s *S) TestCharmURL(c *check.C) {
+	c.Assert(charmURL("python"), check.Equals, "local:python")
+	config.Set("juju:charm-series", "trusty")
+	defer config.Unset("juju:charm-series")
+	c.Assert(charmURL("python"), check.Equals, "local:trusty/python")
+}
+
+func (s *S) TestCharmURLStoreSource(c *check.C) {
+	config.Set("juju:charm-source", "store")
+	defer config.Unset("juju:charm-source")
+	c.Assert(charmURL("python"), check.Equals, "cs:python")
+	config.Set("juju:charm-series", "trusty")
+	defer config.Unset("juju:charm-series")
+	c.Assert(charmURL("python"), check.Equals, "cs:trusty/python")
+}
+
+func (s *S) TestCharmSource(c *check.C) {
+	c.Assert(charmSource(), check.Equals, "local")
+	config.Set("juju:charm-source", "bogus")
+	defer config.Unset("juju:charm-source")
+	c.Assert(charmSource(), check.Equals, "local")
+	config.Set("juju:charm-source", "store")
+	c.Assert(charmSource(), check.Equals, "store")
+}
+
+func (s *S) TestProvisionFromCharmStore(c *check.C) {
+	config.Set("juju:charm-source", "store")
+	defer config.Unset("juju:charm-source")
+	config.Unset("juju:charms-path")
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("stored", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Provision(app)
+	c.Assert(err, check.IsNil)
+	args := []string{"deploy", "cs:python", "stored"}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestProvisionUsesCharmSeries(c *check.C) {
+	config.Set("juju:charm-series", "trusty")
+	defer config.Unset("juju:charm-series")
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("series", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Provision(app)
+	c.Assert(err, check.IsNil)
+	args := []string{"deploy", "--repository", "/home/charms", "local:trusty/python", "series"}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestUnitLog(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "diary/0", AppName: "diary", Machine: 4, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("diary", "python", 1)
+	p := &jujuProvisioner{}
+	var buf bytes.Buffer
+	err := p.UnitLog(app, "diary/0", 50, &buf)
+	c.Assert(err, check.IsNil)
+	args := append(sshArgs("4"), "tail", "-n", "50", defaultLogPath)
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestUnitLogUnknownUnit(c *check.C) {
+	app := provisiontest.NewFakeApp("diary", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.UnitLog(app, "diary/9", 50, nil)
+	c.Assert(err, check.ErrorMatches, `app "diary" has no unit "diary/9"`)
+}
+
+func (s *S) TestUnitLogDownUnit(c *check.C) {
+	s.addInstances(c, instance{UnitName: "diary/0", AppName: "diary", Machine: 4, Status: StatusDown.String()})
+	app := provisiontest.NewFakeApp("diary", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.UnitLog(app, "diary/0", 50, nil)
+	c.Assert(err, check.ErrorMatches, `unit "diary/0" is down, it won't run any command`)
+}
+
+func (s *S) TestUnitLogCustomPath(c *check.C) {
+	config.Set("juju:log-path", "/var/log/myapp.log")
+	defer config.Unset("juju:log-path")
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "diary/0", AppName: "diary", Machine: 4, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("diary", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.UnitLog(app, "diary/0", 10, nil)
+	c.Assert(err, check.IsNil)
+	args := append(sshArgs("4"), "tail", "-n", "10", "/var/log/myapp.log")
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestApps(c *check.C) {
+	s.addInstances(c,
+		instance{UnitName: "zenith/0", AppName: "zenith"},
+		instance{UnitName: "zenith/1", AppName: "zenith"},
+		instance{UnitName: "argo/0", AppName: "argo"},
+	)
+	p := &jujuProvisioner{}
+	apps, err := p.Apps()
+	c.Assert(err, check.IsNil)
+	c.Assert(apps, check.DeepEquals, []string{"argo", "zenith"})
+}
+
+func (s *S) TestAppsEmpty(c *check.C) {
+	p := &jujuProvisioner{}
+	apps, err := p.Apps()
+	c.Assert(err, check.IsNil)
+	c.Assert(apps, check.HasLen, 0)
+}
+
+func (s *S) TestSSHTargetAddressType(c *check.C) {
+	inst := instance{
+		UnitName:       "myapp/0",
+		Machine:        4,
+		PublicAddress:  "ec2-10-10-10-10.compute-1.amazonaws.com",
+		PrivateAddress: "ip-10-10-10-10.ec2.internal",
+	}
+	c.Assert(inst.sshTarget(), check.Equals, "4")
+	config.Set("juju:ssh:address-type", "public")
+	defer config.Unset("juju:ssh:address-type")
+	c.Assert(inst.sshTarget(), check.Equals, "ec2-10-10-10-10.compute-1.amazonaws.com")
+	config.Set("juju:ssh:address-type", "private")
+	c.Assert(inst.sshTarget(), check.Equals, "ip-10-10-10-10.ec2.internal")
+	inst.PrivateAddress = ""
+	c.Assert(inst.sshTarget(), check.Equals, "4")
+}
+
+func (s *S) TestTerminateDelay(c *check.C) {
+	c.Assert(terminateDelay(), check.Equals, time.Duration(0))
+	config.Set("juju:terminate-delay", 30)
+	defer config.Unset("juju:terminate-delay")
+	c.Assert(terminateDelay(), check.Equals, 30*time.Second)
+}
+
+func (s *S) TestTerminateMachinesWaitsForDelay(c *check.C) {
+	config.Set("juju:terminate-delay", 1)
+	defer config.Unset("juju:terminate-delay")
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	start := time.Now()
+	terminateMachines("", 3)
+	c.Assert(time.Since(start) >= time.Second, check.Equals, true)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"terminate-machine", "3"}), check.Equals, true)
+}
+
+func (s *S) TestExecuteCommandResults(c *check.C) {
+	output := map[string][][]byte{"*": {[]byte("hello\n")}}
+	fexec := exectest.FakeExecutor{Output: output}
+	execut = &fexec
+	s.addInstances(c,
+		instance{UnitName: "quiet/0", AppName: "quiet", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "quiet/1", AppName: "quiet", Machine: 2, Status: StatusDown.String()},
+	)
+	app := provisiontest.NewFakeApp("quiet", "python", 2)
+	p := &jujuProvisioner{}
+	results, err := p.ExecuteCommandResults(provision.ExecOptions{
+		App:  app,
+		Cmds: []string{"echo", "hello"},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 2)
+	c.Assert(results["quiet/0"].Err, check.IsNil)
+	c.Assert(results["quiet/0"].Stdout, check.Equals, "hello\n")
+	c.Assert(results["quiet/0"].Stderr, check.Equals, "")
+	c.Assert(results["quiet/1"].Err, check.ErrorMatches, `unit "quiet/1" is down, it won't run any command`)
+}
+
+func (s *S) TestExecuteCommandResultsEmptyApp(c *check.C) {
+	app := provisiontest.NewFakeApp("quiet", "python", 0)
+	p := &jujuProvisioner{}
+	results, err := p.ExecuteCommandResults(provision.ExecOptions{App: app, Cmds: []string{"ls"}})
+	c.Assert(err, check.Equals, provision.ErrEmptyApp)
+	c.Assert(results, check.IsNil)
+}
+
+func (s *S) TestRemoveUnit(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c,
+		instance{UnitName: "two/0", AppName: "two", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "two/2", AppName: "two", Machine: 3, Status: provision.StatusStarted.String()},
+	)
+	app := provisiontest.NewFakeApp("two", "python", 2)
+	p := &jujuProvisioner{}
+	err := p.RemoveUnit(app, "two/2")
+	c.Assert(err, check.IsNil)
+	err = p.Shutdown(5 * time.Second)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"remove-unit", "two/2"}), check.Equals, true)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"terminate-machine", "3"}), check.Equals, true)
+	insts, err := p.appInstances("two")
+	c.Assert(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 1)
+	c.Assert(insts[0].UnitName, check.Equals, "two/0")
+}
+
+func (s *S) TestRemoveUnitUnknownUnit(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("two", "python", 2)
+	p := &jujuProvisioner{}
+	err := p.RemoveUnit(app, "two/9")
+	c.Assert(err, check.ErrorMatches, `app "two" has no unit "two/9"`)
+	c.Assert(fexec.GetCommands("juju"), check.HasLen, 0)
+}
+
+func (s *S) TestRemoveUnitUnknownMachine(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "two/2", AppName: "two", Status: StatusCreating.String()})
+	app := provisiontest.NewFakeApp("two", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.RemoveUnit(app, "two/2")
+	c.Assert(err, check.ErrorMatches, `machine of unit "two/2" is not known yet`)
+	c.Assert(fexec.GetCommands("juju"), check.HasLen, 0)
+}
+
+func (s *S) TestExecuteCommandShell(c *check.C) {
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	app := provisiontest.NewFakeApp("almah", "static", 0)
+	s.addInstances(c, instance{
+		UnitName: "almah/0",
+		AppName:  "almah",
+		Machine:  1,
+		Status:   provision.StatusStarted.String(),
+	})
+	var buf bytes.Buffer
+	p := &jujuProvisioner{}
+	err := p.ExecuteCommandShell(provision.ExecOptions{
+		App:    app,
+		Stdout: &buf,
+		Stderr: &buf,
+	}, "ls -lh | grep log > /tmp/out")
+	c.Assert(err, check.IsNil)
+	args := []string{
+		"ssh", "-o", "StrictHostKeyChecking no", "-q", "1",
+		"/bin/sh", "-c", "'ls -lh | grep log > /tmp/out'",
+	}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestShellQuote(c *check.C) {
+	c.Assert(shellQuote("ls -lh"), check.Equals, "'ls -lh'")
+	c.Assert(shellQuote(`echo 'hi there'`), check.Equals, `'echo '\''hi there'\'''`)
+	c.Assert(shellQuote(`echo "hi"`), check.Equals, `'echo "hi"'`)
+}
+
+func (s *S) TestAddUnitsSpreadZones(c *check.C) {
+	config.Set("juju:spread-zones", true)
+	config.Set("juju:zones", []string{"us-east-1a", "us-east-1b"})
+	defer config.Unset("juju:spread-zones")
+	defer config.Unset("juju:zones")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{
+		"add-unit spread --num-units 1 --constraints zones=us-east-1a": {
+			[]byte("Unit 'spread/0' added to machine 3\n"),
+			[]byte("Unit 'spread/2' added to machine 5\n"),
+		},
+		"add-unit spread --num-units 1 --constraints zones=us-east-1b": {
+			[]byte("Unit 'spread/1' added to machine 4\n"),
+		},
+	}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("spread", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.AddUnits(app, 3, "", nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.getInstance(c, "spread/0").Zone, check.Equals, "us-east-1a")
+	c.Assert(s.getInstance(c, "spread/1").Zone, check.Equals, "us-east-1b")
+	c.Assert(s.getInstance(c, "spread/2").Zone, check.Equals, "us-east-1a")
+}
+
+func (s *S) TestAddUnitsSpreadZonesKeepsExplicitZoneConstraint(c *check.C) {
+	config.Set("juju:spread-zones", true)
+	config.Set("juju:zones", []string{"us-east-1a", "us-east-1b"})
+	defer config.Unset("juju:spread-zones")
+	defer config.Unset("juju:zones")
+	output := []byte("Unit 'spread/0' added to machine 3\nUnit 'spread/1' added to machine 4\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("spread", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.AddUnitsWithConstraints(app, 2, "zones=us-east-1c", nil)
+	c.Assert(err, check.IsNil)
+	args := []string{"add-unit", "spread", "--num-units", "2", "--constraints", "zones=us-east-1c"}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+	c.Assert(s.getInstance(c, "spread/0").Zone, check.Equals, "us-east-1c")
+}
+
+func (s *S) TestSpreadZonesDisabled(c *check.C) {
+	c.Assert(spreadZones(), check.IsNil)
+	config.Set("juju:spread-zones", true)
+	defer config.Unset("juju:spread-zones")
+	c.Assert(spreadZones(), check.HasLen, 0)
+	config.Set("juju:elb:avail-zones", []string{"us-east-1a"})
+	defer config.Unset("juju:elb:avail-zones")
+	c.Assert(spreadZones(), check.DeepEquals, []string{"us-east-1a"})
+	config.Set("juju:zones", []string{"sa-east-1a"})
+	defer config.Unset("juju:zones")
+	c.Assert(spreadZones(), check.DeepEquals, []string{"sa-east-1a"})
+}
+
+func (s *S) TestRefresh(c *check.C) {
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "vision/0", AppName: "vision", Machine: 3, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("vision", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Refresh(app, nil)
+	c.Assert(err, check.IsNil)
+	args := append(sshArgs("3"), "/var/lib/tsuru/hooks/deploy")
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestRefreshCustomDeployHook(c *check.C) {
+	config.Set("juju:deploy-hook", "/var/lib/tsuru/hooks/refresh")
+	defer config.Unset("juju:deploy-hook")
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "vision/0", AppName: "vision", Machine: 3, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("vision", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Refresh(app, nil)
+	c.Assert(err, check.IsNil)
+	args := append(sshArgs("3"), "/var/lib/tsuru/hooks/refresh")
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestDeployHook(c *check.C) {
+	c.Assert(deployHook(), check.Equals, defaultDeployHook)
+	config.Set("juju:deploy-hook", "/hooks/update")
+	defer config.Unset("juju:deploy-hook")
+	c.Assert(deployHook(), check.Equals, "/hooks/update")
+}
+
+func (s *S) TestPreStart(c *check.C) {
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	s.addInstances(c,
+		instance{UnitName: "migrator/0", AppName: "migrator", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "migrator/1", AppName: "migrator", Machine: 2, Status: provision.StatusStarted.String()},
+	)
+	app := provisiontest.NewFakeApp("migrator", "python", 2)
+	p := &jujuProvisioner{}
+	err := p.PreStart(app, "rake db:migrate", nil)
+	c.Assert(err, check.IsNil)
+	args := append(sshArgs("1"), "rake db:migrate")
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+	c.Assert(fexec.GetCommands("juju"), check.HasLen, 1)
+	c.Assert(s.getInstance(c, "migrator/0").PreStartPending, check.Equals, false)
+	c.Assert(s.getInstance(c, "migrator/1").PreStartPending, check.Equals, false)
+}
+
+func (s *S) TestPreStartFailureKeepsStartBlocked(c *check.C) {
+	execut = &exectest.ErrorExecutor{}
+	s.addInstances(c,
+		instance{UnitName: "migrator/0", AppName: "migrator", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "migrator/1", AppName: "migrator", Machine: 2, Status: provision.StatusStarted.String()},
+	)
+	app := provisiontest.NewFakeApp("migrator", "python", 2)
+	p := &jujuProvisioner{}
+	err := p.PreStart(app, "rake db:migrate", nil)
+	c.Assert(err, check.NotNil)
+	c.Assert(s.getInstance(c, "migrator/0").PreStartPending, check.Equals, true)
+	err = p.Start(app, "", nil)
+	c.Assert(err, check.ErrorMatches, `pre-start of app "migrator" has not succeeded yet`)
+}
+
+func (s *S) TestPreStartAlreadyRunning(c *check.C) {
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "migrator/0", AppName: "migrator", Machine: 1, Status: provision.StatusStarted.String(), PreStartPending: true})
+	app := provisiontest.NewFakeApp("migrator", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.PreStart(app, "rake db:migrate", nil)
+	c.Assert(err, check.ErrorMatches, `a pre-start command is already running for app "migrator"`)
+	c.Assert(fexec.GetCommands("juju"), check.HasLen, 0)
+}
+
+func (s *S) TestPreStartEmptyApp(c *check.C) {
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	app := provisiontest.NewFakeApp("migrator", "python", 0)
+	p := &jujuProvisioner{}
+	err := p.PreStart(app, "rake db:migrate", nil)
+	c.Assert(err, check.Equals, provision.ErrEmptyApp)
+}
+
+func (s *S) TestPreStartSkipsDownUnits(c *check.C) {
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	s.addInstances(c,
+		instance{UnitName: "migrator/0", AppName: "migrator", Machine: 1, Status: StatusDown.String()},
+		instance{UnitName: "migrator/1", AppName: "migrator", Machine: 2, Status: provision.StatusStarted.String()},
+	)
+	app := provisiontest.NewFakeApp("migrator", "python", 2)
+	p := &jujuProvisioner{}
+	err := p.PreStart(app, "rake db:migrate", nil)
+	c.Assert(err, check.IsNil)
+	args := append(sshArgs("2"), "rake db:migrate")
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestJujuVersion(c *check.C) {
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{
+		"version": {[]byte("1.16.3-precise-amd64\n")},
+	}}
+	execut = &fexec
+	version, err := jujuVersion()
+	c.Assert(err, check.IsNil)
+	c.Assert(version, check.Equals, "1.16.3-precise-amd64")
+	version, err = jujuVersion()
+	c.Assert(err, check.IsNil)
+	c.Assert(version, check.Equals, "1.16.3-precise-amd64")
+	c.Assert(fexec.GetCommands("juju"), check.HasLen, 1)
+}
+
+func (s *S) TestJujuVersionAtLeast(c *check.C) {
+	versionCache.Lock()
+	versionCache.version = "1.16.3-precise-amd64"
+	versionCache.fetched = true
+	versionCache.Unlock()
+	c.Assert(jujuVersionAtLeast(1, 16), check.Equals, true)
+	c.Assert(jujuVersionAtLeast(1, 14), check.Equals, true)
+	c.Assert(jujuVersionAtLeast(1, 18), check.Equals, false)
+	c.Assert(jujuVersionAtLeast(2, 0), check.Equals, false)
+}
+
+func (s *S) TestJujuVersionAtLeastUnparsable(c *check.C) {
+	versionCache.Lock()
+	versionCache.version = "devel"
+	versionCache.fetched = true
+	versionCache.Unlock()
+	c.Assert(jujuVersionAtLeast(1, 0), check.Equals, false)
+}
+
+func (s *S) TestCharmURLSeriesFromJujuVersion(c *check.C) {
+	versionCache.Lock()
+	versionCache.version = "1.16.3-precise-amd64"
+	versionCache.fetched = true
+	versionCache.Unlock()
+	c.Assert(charmURL("python"), check.Equals, "local:precise/python")
+	config.Set("juju:charm-series", "trusty")
+	defer config.Unset("juju:charm-series")
+	c.Assert(charmURL("python"), check.Equals, "local:trusty/python")
+}
+
+func (s *S) TestMachineAction(c *check.C) {
+	c.Assert(machineAction(), check.Equals, "terminate")
+	config.Set("juju:machine-action", "stop")
+	c.Assert(machineAction(), check.Equals, "stop")
+	config.Set("juju:machine-action", "none")
+	c.Assert(machineAction(), check.Equals, "none")
+	config.Set("juju:machine-action", "bogus")
+	c.Assert(machineAction(), check.Equals, "terminate")
+}
+
+func (s *S) TestTerminateMachinesStopAction(c *check.C) {
+	config.Set("juju:machine-action", "stop")
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	terminateMachines("", 4)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"stop-machine", "4"}), check.Equals, true)
+	coll, err := machineActionsCollection()
+	c.Assert(err, check.IsNil)
+	defer coll.Close()
+	var record machineActionLog
+	err = coll.Find(nil).One(&record)
+	c.Assert(err, check.IsNil)
+	c.Assert(record.Machine, check.Equals, 4)
+	c.Assert(record.Action, check.Equals, "stop")
+}
+
+func (s *S) TestTerminateMachinesNoneAction(c *check.C) {
+	config.Set("juju:machine-action", "none")
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	terminateMachines("", 4)
+	c.Assert(fexec.GetCommands("juju"), check.HasLen, 0)
+	coll, err := machineActionsCollection()
+	c.Assert(err, check.IsNil)
+	defer coll.Close()
+	var record machineActionLog
+	err = coll.Find(nil).One(&record)
+	c.Assert(err, check.IsNil)
+	c.Assert(record.Action, check.Equals, "none")
+}
+
+func (s *S) TestTerminateMachinesRecordsTerminate(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	terminateMachines("", 7)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"terminate-machine", "7"}), check.Equals, true)
+	coll, err := machineActionsCollection()
+	c.Assert(err, check.IsNil)
+	defer coll.Close()
+	var record machineActionLog
+	err = coll.Find(nil).One(&record)
+	c.Assert(err, check.IsNil)
+	c.Assert(record.Machine, check.Equals, 7)
+	c.Assert(record.Action, check.Equals, "terminate")
+}
+
+func (s *S) TestTerminateConcurrency(c *check.C) {
+	c.Assert(terminateConcurrency(), check.Equals, 0)
+	config.Set("juju:terminate-concurrency", 3)
+	c.Assert(terminateConcurrency(), check.Equals, 3)
+	config.Set("juju:terminate-concurrency", 0)
+	c.Assert(terminateConcurrency(), check.Equals, 0)
+	config.Set("juju:terminate-concurrency", -2)
+	c.Assert(terminateConcurrency(), check.Equals, 0)
+}
+
+func (s *S) TestTerminateMachinesBoundedConcurrency(c *check.C) {
+	config.Set("juju:terminate-concurrency", 1)
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	results := terminateMachines("", 1, 2, 3)
+	c.Assert(results, check.HasLen, 3)
+	for machine, err := range results {
+		c.Check(err, check.IsNil)
+		c.Check(fexec.ExecutedCmd("juju", []string{"terminate-machine", strconv.Itoa(machine)}), check.Equals, true)
+	}
+}
+
+func (s *S) TestTerminateMachinesCollectsFailures(c *check.C) {
+	fexec := exectest.ErrorExecutor{}
+	execut = &fexec
+	results := terminateMachines("", 5, 6)
+	c.Assert(results, check.HasLen, 2)
+	c.Assert(results[5], check.NotNil)
+	c.Assert(results[6], check.NotNil)
+}
+
+const inServiceHealthResponse = `<DescribeInstanceHealthResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/">
+  <DescribeInstanceHealthResult>
+    <InstanceStates>
+      <member>
+        <Description>N/A</Description>
+        <InstanceId>i-00000zz5</InstanceId>
+        <State>InService</State>
+        <ReasonCode>N/A</ReasonCode>
+      </member>
+    </InstanceStates>
+  </DescribeInstanceHealthResult>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</DescribeInstanceHealthResponse>`
+
+func (s *S) TestRestartNotRolling(c *check.C) {
+	var buf bytes.Buffer
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "nemesis/0", AppName: "nemesis", Machine: 1, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("nemesis", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Restart(app, "", nil, &buf)
+	c.Assert(err, check.IsNil)
+	args := append(sshArgs("1"), restartHook)
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestRollingRestartDrainsUnits(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	elbDrainPollInterval = time.Millisecond
+	srv.dnsNames["nemesis"] = "nemesis.us-east-1.elb.amazonaws.com"
+	srv.healthQueue = []string{outOfServiceHealthResponse, inServiceHealthResponse}
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{
+		UnitName:   "nemesis/0",
+		AppName:    "nemesis",
+		Machine:    1,
+		InstanceID: "i-00000zz5",
+		Status:     provision.StatusStarted.String(),
+	})
+	app := provisiontest.NewFakeApp("nemesis", "python", 1)
+	p := &jujuProvisioner{}
+	var buf bytes.Buffer
+	err := p.RollingRestart(app, &buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", append(sshArgs("1"), restartHook)), check.Equals, true)
+	c.Assert(buf.String(), check.Equals, "Restarting unit \"nemesis/0\"\n")
+	var actions []string
+	for _, req := range srv.reqs {
+		actions = append(actions, req.Get("Action"))
+	}
+	expected := []string{
+		"DeregisterInstancesFromLoadBalancer",
+		"DescribeInstanceHealth",
+		"RegisterInstancesWithLoadBalancer",
+		"DescribeInstanceHealth",
+	}
+	c.Assert(actions, check.DeepEquals, expected)
+}
+
+func (s *S) TestRollingRestartWithoutELBFallsBack(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "nemesis/0", AppName: "nemesis", Machine: 1, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("nemesis", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.RollingRestart(app, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", append(sshArgs("1"), restartHook)), check.Equals, true)
+}
+
+func (s *S) TestWaitELBStateGivesUp(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	elbDrainPollInterval = time.Millisecond
+	srv.healthResponse = outOfServiceHealthResponse
+	p := &jujuProvisioner{}
+	err := p.waitELBState("nemesis", "i-00000zz5", "InService")
+	c.Assert(err, check.ErrorMatches, `juju: instance "i-00000zz5" of app "nemesis" did not reach ELB state "InService"`)
+}
+
+func (s *S) TestAuthorizedKeys(c *check.C) {
+	c.Assert(authorizedKeys(), check.HasLen, 0)
+	config.Set("juju:ssh:authorized-keys", []string{"ssh-rsa AAAA ops@tsuru"})
+	c.Assert(authorizedKeys(), check.DeepEquals, []string{"ssh-rsa AAAA ops@tsuru"})
+}
+
+func (s *S) TestInjectSSHKeys(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "lockup/0", AppName: "lockup", Machine: 3, Status: provision.StatusStarted.String()})
+	p := &jujuProvisioner{}
+	inst := s.getInstance(c, "lockup/0")
+	err := p.injectSSHKeys(inst, []string{"ssh-rsa AAAA ops@tsuru"})
+	c.Assert(err, check.IsNil)
+	quoted := shellQuote("ssh-rsa AAAA ops@tsuru")
+	script := "mkdir -p ~/.ssh; touch ~/.ssh/authorized_keys; " +
+		"grep -qxF " + quoted + " ~/.ssh/authorized_keys || echo " + quoted + " >> ~/.ssh/authorized_keys"
+	args := append(sshArgs("3"), "/bin/sh", "-c", shellQuote(script))
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+	c.Assert(s.getInstance(c, "lockup/0").KeysInjected, check.Equals, true)
+}
+
+func (s *S) TestInjectSSHKeysCommandFailure(c *check.C) {
+	fexec := exectest.ErrorExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "lockup/0", AppName: "lockup", Machine: 3, Status: provision.StatusStarted.String()})
+	p := &jujuProvisioner{}
+	inst := s.getInstance(c, "lockup/0")
+	err := p.injectSSHKeys(inst, []string{"ssh-rsa AAAA ops@tsuru"})
+	c.Assert(err, check.FitsTypeOf, &provision.Error{})
+	c.Assert(s.getInstance(c, "lockup/0").KeysInjected, check.Equals, false)
+}
+
+func (s *S) TestProvisionUndefinedCharmsPath(c *check.C) {
+	config.Unset("juju:charms-path")
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("trace", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Provision(app)
+	c.Assert(err, check.Equals, ErrCharmsPathUndefined)
+	c.Assert(err, check.ErrorMatches, "juju: charms-path must be defined in config")
+}
+
+func (s *S) TestLockAppSerializes(c *check.C) {
+	var counter int
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := lockApp("racer")
+			defer unlock()
+			counter++
+		}()
+	}
+	wg.Wait()
+	c.Assert(counter, check.Equals, 32)
+}
+
+func (s *S) TestParallelAddAndRemoveUnits(c *check.C) {
+	output := []byte("Unit 'racer/2' added to machine 5\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	s.addInstances(c,
+		instance{UnitName: "racer/0", AppName: "racer", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "racer/1", AppName: "racer", Machine: 2, Status: provision.StatusStarted.String()},
+	)
+	app := provisiontest.NewFakeApp("racer", "python", 2)
+	p := &jujuProvisioner{}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.Check(p.AddUnits(app, 1, "", nil, nil), check.IsNil)
+	}()
+	go func() {
+		defer wg.Done()
+		c.Check(p.RemoveUnits(app, 1, "", nil, nil), check.IsNil)
+	}()
+	wg.Wait()
+	insts, err := p.appInstances("racer")
+	c.Assert(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 2)
+}
+
+func (s *S) TestPlatform(c *check.C) {
+	s.addInstances(c,
+		instance{UnitName: "drifted/0", AppName: "drifted", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "drifted/1", AppName: "drifted", Machine: 2, Type: "python", Status: provision.StatusStarted.String()},
+	)
+	app := provisiontest.NewFakeApp("drifted", "static", 2)
+	p := &jujuProvisioner{}
+	platform, err := p.Platform(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(platform, check.Equals, "python")
+}
+
+func (s *S) TestPlatformNoUnits(c *check.C) {
+	app := provisiontest.NewFakeApp("drifted", "static", 0)
+	p := &jujuProvisioner{}
+	platform, err := p.Platform(app)
+	c.Assert(err, check.ErrorMatches, `app "drifted" has no units to infer the platform from`)
+	c.Assert(platform, check.Equals, "")
+}
+
+func (s *S) TestPlatformUnknownYet(c *check.C) {
+	s.addInstances(c, instance{UnitName: "drifted/0", AppName: "drifted", Machine: 1, Status: provision.StatusCreated.String()})
+	app := provisiontest.NewFakeApp("drifted", "static", 1)
+	p := &jujuProvisioner{}
+	_, err := p.Platform(app)
+	c.Assert(err, check.ErrorMatches, `the platform of app "drifted" is not known yet`)
+}
+
+func (s *S) TestDestroyPreservesELB(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	config.Set("juju:elb:preserve-on-destroy", true)
+	srv.dnsNames["doomed"] = "doomed.us-east-1.elb.amazonaws.com"
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "doomed/0", AppName: "doomed", Machine: 7, InstanceID: "i-00000zz5"})
+	app := provisiontest.NewFakeApp("doomed", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Destroy(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.reqs, check.HasLen, 1)
+	c.Assert(srv.reqs[0].Get("Action"), check.Equals, "DeregisterInstancesFromLoadBalancer")
+	c.Assert(srv.reqs[0].Get("Instances.member.1.InstanceId"), check.Equals, "i-00000zz5")
+	_, ok := srv.dnsNames["doomed"]
+	c.Assert(ok, check.Equals, true)
+}
+
+func (s *S) TestForgetELB(c *check.C) {
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	srv.dnsNames["doomed"] = "doomed.us-east-1.elb.amazonaws.com"
+	p := &jujuProvisioner{}
+	err := p.ForgetELB("doomed")
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.reqs, check.HasLen, 1)
+	c.Assert(srv.reqs[0].Get("Action"), check.Equals, "DeleteLoadBalancer")
+	_, ok := srv.dnsNames["doomed"]
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *S) TestForgetELBDisabled(c *check.C) {
+	p := &jujuProvisioner{}
+	err := p.ForgetELB("doomed")
+	c.Assert(err, check.ErrorMatches, "juju: ELB support is disabled")
+}
+
+func (s *S) TestProvisionWithProgressStreamsDeployOutput(c *check.C) {
+	output := []byte("Added charm to the environment.\nDeploying service trace.\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("trace", "python", 1)
+	p := &jujuProvisioner{}
+	var buf bytes.Buffer
+	err := p.ProvisionWithProgress(app, &buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s).*Added charm to the environment\.\nDeploying service trace\..*`)
+}
+
+func (s *S) TestExecuteCommandOnMachine(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "almah/0", AppName: "almah", Machine: 4, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("almah", "static", 1)
+	p := &jujuProvisioner{}
+	var buf bytes.Buffer
+	err := p.ExecuteCommandOnMachine(&buf, app, 4, "tail", "-n", "50", "/var/log/syslog")
+	c.Assert(err, check.IsNil)
+	args := append(sshArgs("4"), "tail", "-n", "50", "/var/log/syslog")
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestExecuteCommandOnMachineNotOwned(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "almah/0", AppName: "almah", Machine: 4, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("intruder", "static", 1)
+	p := &jujuProvisioner{}
+	err := p.ExecuteCommandOnMachine(nil, app, 4, "ls")
+	c.Assert(err, check.ErrorMatches, `machine 4 does not belong to app "intruder"`)
+	c.Assert(fexec.GetCommands("juju"), check.HasLen, 0)
+}
+
+func (s *S) TestUnitCountFollowsAddAndRemove(c *check.C) {
+	output := []byte("Unit 'billing/1' added to machine 3\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "billing/0", AppName: "billing", Machine: 1, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("billing", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.AddUnits(app, 1, "", nil, nil)
+	c.Assert(err, check.IsNil)
+	count, err := p.UnitCount(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, 1)
+	err = p.RemoveUnit(app, "billing/1")
+	c.Assert(err, check.IsNil)
+	count, err = p.UnitCount(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, 0)
+}
+
+func (s *S) TestUnitCountReconcilesWhenMissing(c *check.C) {
+	s.addInstances(c,
+		instance{UnitName: "billing/0", AppName: "billing", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "billing/1", AppName: "billing", Machine: 2, Status: provision.StatusStarted.String()},
+	)
+	app := provisiontest.NewFakeApp("billing", "python", 2)
+	p := &jujuProvisioner{}
+	count, err := p.UnitCount(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, 2)
+}
+
+func (s *S) TestReconcileUnitCountFixesDrift(c *check.C) {
+	s.addInstances(c, instance{UnitName: "billing/0", AppName: "billing", Machine: 1, Status: provision.StatusStarted.String()})
+	err := adjustUnitCount("billing", 5)
+	c.Assert(err, check.IsNil)
+	p := &jujuProvisioner{}
+	count, err := p.ReconcileUnitCount("billing")
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, 1)
+	app := provisiontest.NewFakeApp("billing", "python", 1)
+	count, err = p.UnitCount(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, 1)
+}
+
+func (s *S) TestAllocateUnitNames(c *check.C) {
+	coll, err := unitsCollection()
+	c.Assert(err, check.IsNil)
+	defer coll.Close()
+	s.addInstances(c,
+		instance{UnitName: "resist/0", AppName: "resist", Machine: 1},
+		instance{UnitName: "resist/3", AppName: "resist", Machine: 2},
+	)
+	names, err := allocateUnitNames(coll, "resist", "resist", 2)
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.DeepEquals, []string{"resist/4", "resist/5"})
+}
+
+func (s *S) TestAddUnitsFallsBackToAllocator(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "resist/0", AppName: "resist", Machine: 1, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("resist", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.AddUnits(app, 2, "", nil, nil)
+	c.Assert(err, check.IsNil)
+	insts, err := p.appInstances("resist")
+	c.Assert(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 3)
+	inst := s.getInstance(c, "resist/1")
+	c.Assert(inst.Machine, check.Equals, 0)
+	c.Assert(inst.Status, check.Equals, provision.StatusCreated.String())
+	s.getInstance(c, "resist/2")
+}
+
+func (s *S) TestELBAutoRegisterDefaultsTrue(c *check.C) {
+	p := &jujuProvisioner{}
+	c.Assert(p.elbAutoRegister(), check.Equals, true)
+	config.Set("juju:elb:auto-register", false)
+	c.Assert(p.elbAutoRegister(), check.Equals, false)
+	config.Set("juju:elb:auto-register", true)
+	c.Assert(p.elbAutoRegister(), check.Equals, true)
+}
+
+func (s *S) TestRemoveUnitSkipsDeregisterWhenAutoRegisterDisabled(c *check.C) {
+	server := s.startELBServer()
+	defer server.close()
+	config.Set("juju:elb:auto-register", false)
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "trace/0", AppName: "trace", Machine: 1, InstanceID: "i-00000zz5"})
+	app := provisiontest.NewFakeApp("trace", "python", 1)
+	p := &jujuProvisioner{elb: true}
+	p.elbOnce.Do(func() {})
+	err := p.RemoveUnit(app, "trace/0")
+	c.Assert(err, check.IsNil)
+	c.Assert(server.requests("DeregisterInstancesFromLoadBalancer"), check.HasLen, 0)
+}
+
+func (s *S) TestMergeConstraints(c *check.C) {
+	var tests = []struct{ defaults, override, expected string }{
+		{"", "", ""},
+		{"mem=512M", "", "mem=512M"},
+		{"", "mem=1G", "mem=1G"},
+		{"mem=512M instance-type=m1.small", "instance-type=m1.large", "mem=512M instance-type=m1.large"},
+		{"mem=512M", "mem=1G zones=us-east-1b", "mem=1G zones=us-east-1b"},
+	}
+	for _, t := range tests {
+		c.Check(mergeConstraints(t.defaults, t.override), check.Equals, t.expected)
+	}
+}
+
+func (s *S) TestProvisionAppliesPlatformDefaults(c *check.C) {
+	config.Set("juju:platform-defaults:python:constraints", "mem=512M")
+	config.Set("juju:platform-defaults:python:env", map[interface{}]interface{}{
+		"PYTHONUNBUFFERED": 1,
+		"LANG":             "C.UTF-8",
+	})
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("snakes", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Provision(app)
+	c.Assert(err, check.IsNil)
+	args := []string{"deploy", "--repository", "/home/charms", "--constraints", "mem=512M", "local:python", "snakes"}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+	args = []string{"set", "snakes", "app-repo=" + repositoryURL("snakes"), "app-env=LANG=C.UTF-8 PYTHONUNBUFFERED=1"}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestAddUnitsMergesPlatformConstraints(c *check.C) {
+	config.Set("juju:platform-defaults:python:constraints", "mem=512M instance-type=m1.small")
+	output := []byte("Unit 'chemistry/1' added to machine 3\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("chemistry", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.AddUnitsWithConstraints(app, 1, "instance-type=m1.large", nil)
+	c.Assert(err, check.IsNil)
+	args := []string{"add-unit", "chemistry", "--num-units", "1", "--constraints", "mem=512M instance-type=m1.large"}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestSSHUser(c *check.C) {
+	c.Assert(sshUser("python"), check.Equals, "")
+	config.Set("juju:ssh:user", "app")
+	c.Assert(sshUser("python"), check.Equals, "app")
+	config.Set("juju:platform-defaults:python:ssh-user", "django")
+	c.Assert(sshUser("python"), check.Equals, "django")
+	c.Assert(sshUser("static"), check.Equals, "app")
+}
+
+func (s *S) TestSSHTargetCustomUser(c *check.C) {
+	inst := instance{UnitName: "almah/0", AppName: "almah", Machine: 4, Type: "python"}
+	c.Assert(inst.sshTarget(), check.Equals, "4")
+	config.Set("juju:ssh:user", "app")
+	c.Assert(inst.sshTarget(), check.Equals, "app@4")
+	config.Set("juju:platform-defaults:python:ssh-user", "django")
+	c.Assert(inst.sshTarget(), check.Equals, "django@4")
+}
+
+func (s *S) TestExecuteCommandCustomUser(c *check.C) {
+	config.Set("juju:ssh:user", "app")
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	app := provisiontest.NewFakeApp("almah", "static", 0)
+	s.addInstances(c, instance{
+		UnitName: "almah/0",
+		AppName:  "almah",
+		Machine:  1,
+		Status:   provision.StatusStarted.String(),
+	})
+	var buf bytes.Buffer
+	p := &jujuProvisioner{}
+	err := p.ExecuteCommand(provision.ExecOptions{
+		App:    app,
+		Stdout: &buf,
+		Stderr: &buf,
+		Cmds:   []string{"ls", "-lh"},
+	})
+	c.Assert(err, check.IsNil)
+	args := []string{"ssh", "-o", "StrictHostKeyChecking no", "-q", "app@1", "ls", "-lh"}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestCordonMachine(c *check.C) {
+	server := s.startELBServer()
+	defer server.close()
+	server.dnsNames["vigil"] = "vigil.us-east-1.elb.amazonaws.com"
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	s.addInstances(c,
+		instance{UnitName: "vigil/0", AppName: "vigil", Machine: 3, InstanceID: "i-00000zz5", Status: provision.StatusStarted.String()},
+		instance{UnitName: "vigil/1", AppName: "vigil", Machine: 4, InstanceID: "i-00000zz6", Status: provision.StatusStarted.String()},
+	)
+	p := &jujuProvisioner{}
+	err := p.CordonMachine(3)
+	c.Assert(err, check.IsNil)
+	reqs := server.requests("DeregisterInstancesFromLoadBalancer")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("LoadBalancerName"), check.Equals, "vigil")
+	c.Assert(reqs[0].Get("Instances.member.1.InstanceId"), check.Equals, "i-00000zz5")
+	c.Assert(s.getInstance(c, "vigil/0").Cordoned, check.Equals, true)
+	c.Assert(s.getInstance(c, "vigil/1").Cordoned, check.Equals, false)
+}
+
+func (s *S) TestUncordonMachine(c *check.C) {
+	server := s.startELBServer()
+	defer server.close()
+	server.dnsNames["vigil"] = "vigil.us-east-1.elb.amazonaws.com"
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	s.addInstances(c,
+		instance{UnitName: "vigil/0", AppName: "vigil", Machine: 3, InstanceID: "i-00000zz5", Status: provision.StatusStarted.String(), Cordoned: true},
+		instance{UnitName: "vigil/1", AppName: "vigil", Machine: 3, InstanceID: "i-00000zz6", Status: StatusDown.String(), Cordoned: true},
+	)
+	p := &jujuProvisioner{}
+	err := p.UncordonMachine(3)
+	c.Assert(err, check.IsNil)
+	reqs := server.requests("RegisterInstancesWithLoadBalancer")
+	c.Assert(reqs, check.HasLen, 1)
+	c.Assert(reqs[0].Get("Instances.member.1.InstanceId"), check.Equals, "i-00000zz5")
+	c.Assert(s.getInstance(c, "vigil/0").Cordoned, check.Equals, false)
+	c.Assert(s.getInstance(c, "vigil/1").Cordoned, check.Equals, false)
+}
+
+func (s *S) TestCordonMachineNoUnits(c *check.C) {
+	p := &jujuProvisioner{}
+	err := p.CordonMachine(9)
+	c.Assert(err, check.ErrorMatches, "no units found on machine 9")
+}
+
+func (s *S) TestExecuteCommandDelimiterFormat(c *check.C) {
+	config.Set("juju:exec:output-format", "delimiter")
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	app := provisiontest.NewFakeApp("almah", "static", 0)
+	s.addInstances(c, instance{
+		UnitName: "almah/0",
+		AppName:  "almah",
+		Machine:  1,
+		Status:   provision.StatusStarted.String(),
+	})
+	var buf bytes.Buffer
+	p := &jujuProvisioner{}
+	err := p.ExecuteCommand(provision.ExecOptions{
+		App:    app,
+		Stdout: &buf,
+		Stderr: &buf,
+		Cmds:   []string{"ls"},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "----- unit almah/0 -----\n")
+}
+
+func (s *S) TestExecuteCommandJSONFormat(c *check.C) {
+	config.Set("juju:exec:output-format", "json")
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	app := provisiontest.NewFakeApp("almah", "static", 0)
+	s.addInstances(c,
+		instance{UnitName: "almah/0", AppName: "almah", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "almah/1", AppName: "almah", Machine: 2, Status: StatusDown.String()},
+	)
+	var buf bytes.Buffer
+	p := &jujuProvisioner{}
+	err := p.ExecuteCommand(provision.ExecOptions{
+		App:    app,
+		Stdout: &buf,
+		Stderr: &buf,
+		Cmds:   []string{"ls"},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "{\"unit\":\"almah/0\"}\n{\"unit\":\"almah/1\",\"down\":true}\n")
+	downArgs := []string{"ssh", "-o", "StrictHostKeyChecking no", "-q", "2", "ls"}
+	c.Assert(fexec.ExecutedCmd("juju", downArgs), check.Equals, false)
+}
+
+func (s *S) TestExecOutputFormatUnknownFallsBackToText(c *check.C) {
+	config.Set("juju:exec:output-format", "yaml")
+	c.Assert(execOutputFormat(), check.Equals, "text")
+}
+
+func (s *S) TestProcessServiceName(c *check.C) {
+	name, err := processServiceName("myapp", "worker")
+	c.Assert(err, check.IsNil)
+	c.Assert(name, check.Equals, "myapp-worker")
+	name, err = processServiceName("my_app", "Send_Mail")
+	c.Assert(err, check.IsNil)
+	c.Assert(name, check.Equals, "my-app-send-mail")
+}
+
+func (s *S) TestProvisionProcess(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("myapp", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.ProvisionProcess(app, "worker")
+	c.Assert(err, check.IsNil)
+	args := []string{"deploy", "--repository", "/home/charms", "local:python", "myapp-worker"}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestProvisionProcessEmptyName(c *check.C) {
+	p := &jujuProvisioner{}
+	err := p.ProvisionProcess(provisiontest.NewFakeApp("myapp", "python", 1), "")
+	c.Assert(err, check.ErrorMatches, "juju: process name cannot be empty")
+}
+
+func (s *S) TestAddUnitsToProcess(c *check.C) {
+	output := []byte("Unit 'myapp-worker/0' added to machine 5\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("myapp", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.AddUnits(app, 1, "worker", nil, nil)
+	c.Assert(err, check.IsNil)
+	args := []string{"add-unit", "myapp-worker", "--num-units", "1"}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+	inst := s.getInstance(c, "myapp-worker/0")
+	c.Assert(inst.Process, check.Equals, "worker")
+	c.Assert(inst.Service, check.Equals, "myapp-worker")
+}
+
+func (s *S) TestExecuteCommandOnProcess(c *check.C) {
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	app := provisiontest.NewFakeApp("myapp", "python", 0)
+	s.addInstances(c,
+		instance{UnitName: "myapp/0", AppName: "myapp", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "myapp-worker/0", AppName: "myapp", Process: "worker", Machine: 2, Status: provision.StatusStarted.String()},
+	)
+	var buf bytes.Buffer
+	p := &jujuProvisioner{}
+	err := p.ExecuteCommandOnProcess(provision.ExecOptions{
+		App:    app,
+		Stdout: &buf,
+		Stderr: &buf,
+		Cmds:   []string{"ls"},
+	}, "worker")
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"ssh", "-o", "StrictHostKeyChecking no", "-q", "2", "ls"}), check.Equals, true)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"ssh", "-o", "StrictHostKeyChecking no", "-q", "1", "ls"}), check.Equals, false)
+	err = p.ExecuteCommandOnProcess(provision.ExecOptions{
+		App:  app,
+		Cmds: []string{"ls"},
+	}, "scheduler")
+	c.Assert(err, check.ErrorMatches, `app "myapp" has no units of process "scheduler"`)
+}
+
+const waitOutput = `machines:
+  0:
+    agent-state: running
+    dns-name: 192.168.0.60
+    instance-id: i-00000zz5
+    instance-state: running
+  1:
+    agent-state: pending
+services:
+  vigil:
+    charm: local:python-11
+    units:
+      vigil/0:
+        agent-state: started
+        machine: 0
+      vigil/1:
+        agent-state: pending
+        machine: 1
+`
+
+func (s *S) TestWaitForUnits(c *check.C) {
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {[]byte(waitOutput)}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("vigil", "python", 2)
+	p := &jujuProvisioner{}
+	err := p.WaitForUnits(app, 1, time.Second)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestWaitForUnitsTimeout(c *check.C) {
+	waitForUnitsPollInterval = time.Millisecond
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {[]byte(waitOutput)}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("vigil", "python", 2)
+	p := &jujuProvisioner{}
+	err := p.WaitForUnits(app, 2, 10*time.Millisecond)
+	c.Assert(err, check.ErrorMatches, `timed out waiting for 2 started units of app "vigil": 1 of 2 started after 10ms`)
+}
+
+func (s *S) TestAddUnitsWaitsWhenConfigured(c *check.C) {
+	config.Set("juju:add-units-wait", 5)
+	addOutput := []byte("Unit 'vigil/0' added to machine 0\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{
+		"*":      {addOutput},
+		"status": {[]byte(waitOutput)},
+	}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("vigil", "python", 0)
+	p := &jujuProvisioner{}
+	var buf bytes.Buffer
+	err := p.AddUnits(app, 1, "", nil, &buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s).*Waiting for 1 units to start\.\.\..*`)
+}
+
+func (s *S) TestRecycleMachine(c *check.C) {
+	server := s.startELBServer()
+	defer server.close()
+	server.dnsNames["vigil"] = "vigil.us-east-1.elb.amazonaws.com"
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	var fexec exectest.FakeExecutor
+	execut = &fexec
+	s.addInstances(c, instance{
+		UnitName: "vigil/0", AppName: "vigil", Machine: 4,
+		InstanceID:    "i-00000zz5",
+		PublicAddress: "old.public.amazonaws.com",
+		Status:        provision.StatusStarted.String(),
+		ELBState:      "InService",
+	})
+	app := provisiontest.NewFakeApp("vigil", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.RecycleMachine(app, "vigil/0")
+	c.Assert(err, check.IsNil)
+	c.Assert(server.requests("DeregisterInstancesFromLoadBalancer"), check.HasLen, 1)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"terminate-machine", "4"}), check.Equals, true)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"retry-provisioning", "4"}), check.Equals, true)
+	inst := s.getInstance(c, "vigil/0")
+	c.Assert(inst.InstanceID, check.Equals, "")
+	c.Assert(inst.PublicAddress, check.Equals, "")
+	c.Assert(inst.Status, check.Equals, StatusCreating.String())
+	c.Assert(inst.ELBState, check.Equals, "")
+}
+
+func (s *S) TestRecycleMachineUnknownUnit(c *check.C) {
+	p := &jujuProvisioner{}
+	err := p.RecycleMachine(provisiontest.NewFakeApp("vigil", "python", 1), "vigil/9")
+	c.Assert(err, check.ErrorMatches, `app "vigil" has no unit "vigil/9"`)
+}
+
+func (s *S) TestRecycleMachineUnknownMachine(c *check.C) {
+	s.addInstances(c, instance{UnitName: "vigil/0", AppName: "vigil", Machine: 0})
+	p := &jujuProvisioner{}
+	err := p.RecycleMachine(provisiontest.NewFakeApp("vigil", "python", 1), "vigil/0")
+	c.Assert(err, check.ErrorMatches, `machine of unit "vigil/0" is not known yet`)
+}
+
+func (s *S) TestCharmHooks(c *check.C) {
+	charmsPath := c.MkDir()
+	hooksDir := filepath.Join(charmsPath, "python", "hooks")
+	err := os.MkdirAll(hooksDir, 0755)
+	c.Assert(err, check.IsNil)
+	for _, hook := range []string{"install", "restart", "start"} {
+		err = ioutil.WriteFile(filepath.Join(hooksDir, hook), []byte("#!/bin/sh\n"), 0755)
+		c.Assert(err, check.IsNil)
+	}
+	err = os.MkdirAll(filepath.Join(hooksDir, "lib"), 0755)
+	c.Assert(err, check.IsNil)
+	config.Set("juju:charms-path", charmsPath)
+	defer config.Unset("juju:charms-path")
+	p := &jujuProvisioner{}
+	hooks, err := p.CharmHooks("python")
+	c.Assert(err, check.IsNil)
+	c.Assert(hooks, check.DeepEquals, []string{"install", "restart", "start"})
+}
+
+func (s *S) TestCharmHooksCharmNotFound(c *check.C) {
+	charmsPath := c.MkDir()
+	config.Set("juju:charms-path", charmsPath)
+	defer config.Unset("juju:charms-path")
+	p := &jujuProvisioner{}
+	hooks, err := p.CharmHooks("python")
+	c.Assert(hooks, check.IsNil)
+	c.Assert(err, check.ErrorMatches, `juju: charm of platform "python" not found in `+charmsPath)
+}
+
+func (s *S) TestCharmHooksPathUndefined(c *check.C) {
+	config.Unset("juju:charms-path")
+	p := &jujuProvisioner{}
+	hooks, err := p.CharmHooks("python")
+	c.Assert(hooks, check.IsNil)
+	c.Assert(err, check.Equals, ErrCharmsPathUndefined)
+}
+
+func (s *S) TestAssignPool(c *check.C) {
+	config.Set("juju:pools:dedicated", []int{3, 4})
+	p := &jujuProvisioner{}
+	err := p.AssignPool(&namedApp{name: "vault"}, "dedicated")
+	c.Assert(err, check.IsNil)
+	pool, err := p.appPool("vault")
+	c.Assert(err, check.IsNil)
+	c.Assert(pool, check.Equals, "dedicated")
+	err = p.AssignPool(&namedApp{name: "vault"}, "")
+	c.Assert(err, check.IsNil)
+	pool, err = p.appPool("vault")
+	c.Assert(err, check.IsNil)
+	c.Assert(pool, check.Equals, "")
+}
+
+func (s *S) TestAssignPoolUnknownPool(c *check.C) {
+	p := &jujuProvisioner{}
+	err := p.AssignPool(&namedApp{name: "vault"}, "dedicated")
+	c.Assert(err, check.ErrorMatches, `juju: pool "dedicated" is not defined in config`)
+}
+
+func (s *S) TestPoolMachines(c *check.C) {
+	config.Set("juju:pools:dedicated", []int{3, 4, 7})
+	machines, err := poolMachines("dedicated")
+	c.Assert(err, check.IsNil)
+	c.Assert(machines, check.DeepEquals, []int{3, 4, 7})
+	config.Set("juju:pools:dedicated", []string{"three"})
+	_, err = poolMachines("dedicated")
+	c.Assert(err, check.ErrorMatches, `juju: pool "dedicated" lists invalid machine number "three"`)
+}
+
+func (s *S) TestAddUnitsToPooledApp(c *check.C) {
+	config.Set("juju:pools:dedicated", []int{3, 4, 5})
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{
+		"add-unit vault --to 3": {[]byte("Unit 'vault/0' added to machine 3\n")},
+		"add-unit vault --to 5": {[]byte("Unit 'vault/1' added to machine 5\n")},
+		"*":                     {[]byte{}},
+	}}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "other/0", AppName: "other", Machine: 4, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("vault", "python", 0)
+	p := &jujuProvisioner{}
+	err := p.AssignPool(app, "dedicated")
+	c.Assert(err, check.IsNil)
+	err = p.AddUnits(app, 2, "", nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"add-unit", "vault", "--to", "3"}), check.Equals, true)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"add-unit", "vault", "--to", "5"}), check.Equals, true)
+	inst := s.getInstance(c, "vault/0")
+	c.Assert(inst.Machine, check.Equals, 3)
+	c.Assert(inst.Pool, check.Equals, "dedicated")
+	c.Assert(inst.Status, check.Equals, provision.StatusCreated.String())
+	inst = s.getInstance(c, "vault/1")
+	c.Assert(inst.Machine, check.Equals, 5)
+	c.Assert(inst.Pool, check.Equals, "dedicated")
+}
+
+func (s *S) TestAddUnitsPoolExhausted(c *check.C) {
+	config.Set("juju:pools:dedicated", []int{3})
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "other/0", AppName: "other", Machine: 3, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("vault", "python", 0)
+	p := &jujuProvisioner{}
+	err := p.AssignPool(app, "dedicated")
+	c.Assert(err, check.IsNil)
+	err = p.AddUnits(app, 1, "", nil, nil)
+	c.Assert(err, check.ErrorMatches, `juju: pool "dedicated" has 0 free machine\(s\), 1 needed`)
+}
+
+func (s *S) TestRewriteRepoURL(c *check.C) {
+	c.Assert(rewriteRepoURL("git://git.tsuru.io/highway.git"), check.Equals, "git://git.tsuru.io/highway.git")
+	config.Set("juju:repo-rewrite:from", "git://git.tsuru.io/")
+	config.Set("juju:repo-rewrite:to", "git://mirror.internal/")
+	c.Assert(rewriteRepoURL("git://git.tsuru.io/highway.git"), check.Equals, "git://mirror.internal/highway.git")
+	c.Assert(rewriteRepoURL("git://elsewhere.io/highway.git"), check.Equals, "git://elsewhere.io/highway.git")
+}
+
+func (s *S) TestAddUnitsRewritesRepositoryURL(c *check.C) {
+	if old, err := config.Get("repo-manager"); err == nil {
+		defer config.Set("repo-manager", old)
+	} else {
+		defer config.Unset("repo-manager")
+	}
+	config.Set("repo-manager", "fake")
+	err := repository.Manager().CreateRepository("highway", nil)
+	c.Assert(err, check.IsNil)
+	defer repository.Manager().RemoveRepository("highway")
+	config.Set("juju:repo-rewrite:from", "git://git.tsuru.io/")
+	config.Set("juju:repo-rewrite:to", "git://mirror.internal/")
+	output := []byte("Unit 'highway/0' added to machine 3\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("highway", "python", 0)
+	p := &jujuProvisioner{}
+	err = p.AddUnits(app, 1, "", nil, nil)
+	c.Assert(err, check.IsNil)
+	args := []string{"set", "highway", "app-repo=git://mirror.internal/highway.git"}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+}
+
+func (s *S) TestAppConfigHash(c *check.C) {
+	app := provisiontest.NewFakeApp("cartman", "python", 1)
+	other := provisiontest.NewFakeApp("cartman", "python", 1)
+	c.Assert(appConfigHash(app), check.Equals, appConfigHash(other))
+	app.SetEnv(bind.EnvVar{Name: "DATABASE_URL", Value: "mysql://db"})
+	c.Assert(appConfigHash(app), check.Not(check.Equals), appConfigHash(other))
+	other.SetEnv(bind.EnvVar{Name: "DATABASE_URL", Value: "mysql://db"})
+	c.Assert(appConfigHash(app), check.Equals, appConfigHash(other))
+}
+
+func (s *S) TestRestartRecordsConfigHash(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "cartman/0", AppName: "cartman", Machine: 3, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("cartman", "python", 1)
+	app.SetEnv(bind.EnvVar{Name: "DATABASE_URL", Value: "mysql://db"})
+	p := &jujuProvisioner{}
+	err := p.Restart(app, "", nil, nil)
+	c.Assert(err, check.IsNil)
+	hash := appConfigHash(app)
+	stored, err := storedAppConfigHash("cartman")
+	c.Assert(err, check.IsNil)
+	c.Assert(stored, check.Equals, hash)
+	inst := s.getInstance(c, "cartman/0")
+	c.Assert(inst.ConfigHash, check.Equals, hash)
+}
+
+func (s *S) TestCharmRevisionFor(c *check.C) {
+	revision, err := charmRevisionFor("stairs")
+	c.Assert(err, check.IsNil)
+	c.Assert(revision, check.Equals, -1)
+	config.Set("juju:charm-revision", 7)
+	revision, err = charmRevisionFor("stairs")
+	c.Assert(err, check.IsNil)
+	c.Assert(revision, check.Equals, 7)
+	p := &jujuProvisioner{}
+	err = p.PinCharmRevision(&namedApp{name: "stairs"}, 9)
+	c.Assert(err, check.IsNil)
+	revision, err = charmRevisionFor("stairs")
+	c.Assert(err, check.IsNil)
+	c.Assert(revision, check.Equals, 9)
+	err = p.PinCharmRevision(&namedApp{name: "stairs"}, -1)
+	c.Assert(err, check.IsNil)
+	revision, err = charmRevisionFor("stairs")
+	c.Assert(err, check.IsNil)
+	c.Assert(revision, check.Equals, 7)
+}
+
+func (s *S) TestProvisionDeploysPinnedCharmRevision(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("stairs", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.PinCharmRevision(app, 5)
+	c.Assert(err, check.IsNil)
+	err = p.Provision(app)
+	c.Assert(err, check.IsNil)
+	args := []string{"deploy", "--repository", "/home/charms", "local:python-5", "stairs"}
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+	deployed, err := p.DeployedCharmRevision(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(deployed, check.Equals, 5)
+}
+
+func (s *S) TestDeployedCharmRevisionUnknown(c *check.C) {
+	p := &jujuProvisioner{}
+	deployed, err := p.DeployedCharmRevision(&namedApp{name: "stairs"})
+	c.Assert(err, check.IsNil)
+	c.Assert(deployed, check.Equals, -1)
+}
+
+func (s *S) TestRemoveUnitsSkipsUnknownMachines(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c,
+		instance{UnitName: "resist/0", AppName: "resist", Machine: 3, Status: provision.StatusStarted.String()},
+		instance{UnitName: "resist/1", AppName: "resist", Machine: 0, Status: provision.StatusCreated.String()},
+	)
+	app := provisiontest.NewFakeApp("resist", "python", 2)
+	p := &jujuProvisioner{}
+	err := p.RemoveUnits(app, 2, "", nil, nil)
+	c.Assert(err, check.IsNil)
+	err = p.Shutdown(5 * time.Second)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"terminate-machine", "3"}), check.Equals, true)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"terminate-machine", "0"}), check.Equals, false)
+}
+
+func (s *S) TestRunOnceUnparseableOutputFallsBackToAllocator(c *check.C) {
+	output := []byte("added 1 unit\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	s.addInstances(c, instance{UnitName: "clock/4", AppName: "clock", Machine: 2, Status: provision.StatusStarted.String()})
+	app := provisiontest.NewFakeApp("clock", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.RunOnce(app, "python manage.py clearsessions", nil)
+	c.Assert(err, check.IsNil)
+	args := append(sshArgs("clock/5"), "python manage.py clearsessions")
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"remove-unit", "clock/5"}), check.Equals, true)
+	err = p.Shutdown(5 * time.Second)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"terminate-machine", "0"}), check.Equals, false)
+	insts, err := p.appInstances("clock")
+	c.Assert(err, check.IsNil)
+	c.Assert(insts, check.HasLen, 1)
+	c.Assert(insts[0].UnitName, check.Equals, "clock/4")
+}
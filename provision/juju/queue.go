@@ -0,0 +1,546 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"github.com/tsuru/config"
+	"github.com/tsuru/monsterqueue"
+	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/queue"
+)
+
+const (
+	provisionRetryTaskName        = "provisionRetry"
+	addUnitToLoadBalancerTaskName = "addUnitToLoadBalancer"
+	elbReconcileTaskName          = "elbReconcile"
+	dnsRegisterTaskName           = "dnsRegister"
+	injectSSHKeysTaskName         = "injectSSHKeys"
+	restartUnitTaskName           = "restartUnit"
+
+	defaultProvisionRetryMaxAttempts = 3
+
+	// defaultELBReconcileInterval is how often the reconcile worker sweeps
+	// the known apps when juju:elb:reconcile-interval is not set.
+	defaultELBReconcileInterval = 5 * time.Minute
+)
+
+// getQueue is stored in a variable so tests can replace the queue used by the
+// provisioner.
+var getQueue = defaultGetQueue
+
+func defaultGetQueue() (monsterqueue.Queue, error) {
+	return queue.Queue()
+}
+
+// Initialize registers the provisioner background tasks in the work queue.
+func (p *jujuProvisioner) Initialize() error {
+	q, err := getQueue()
+	if err != nil {
+		return err
+	}
+	err = q.RegisterTask(&provisionRetryTask{p: p})
+	if err != nil {
+		return err
+	}
+	err = q.RegisterTask(&addUnitToLoadBalancerTask{p: p})
+	if err != nil {
+		return err
+	}
+	err = q.RegisterTask(&elbReconcileTask{p: p})
+	if err != nil {
+		return err
+	}
+	err = q.RegisterTask(&dnsRegisterTask{p: p})
+	if err != nil {
+		return err
+	}
+	err = q.RegisterTask(&injectSSHKeysTask{p: p})
+	if err != nil {
+		return err
+	}
+	err = q.RegisterTask(&restartUnitTask{p: p})
+	if err != nil {
+		return err
+	}
+	if p.elbSupport() {
+		p.startELBReconcileLoop(elbReconcileInterval())
+	}
+	return nil
+}
+
+// elbReconcileInterval returns how often the reconcile worker runs, from
+// juju:elb:reconcile-interval. Zero or a negative value disables the worker.
+func elbReconcileInterval() time.Duration {
+	interval, err := config.GetDuration("juju:elb:reconcile-interval")
+	if err != nil {
+		return defaultELBReconcileInterval
+	}
+	return interval
+}
+
+// reconcileLoop holds the stop channel of the running ELB reconcile worker,
+// so Shutdown can halt it and Initialize never starts a second one.
+var reconcileLoop struct {
+	sync.Mutex
+	stop chan struct{}
+}
+
+// startELBReconcileLoop starts the background worker that periodically
+// enqueues an ELB reconciliation for every known app. It's the safety net
+// for lost registrations — a unit whose registration job gave up before the
+// unit started, for instance — and out-of-band balancer changes. A
+// non-positive interval disables the worker.
+func (p *jujuProvisioner) startELBReconcileLoop(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	reconcileLoop.Lock()
+	defer reconcileLoop.Unlock()
+	if reconcileLoop.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	reconcileLoop.stop = stop
+	spawn(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := p.enqueueELBReconcileAll(); err != nil {
+					log.Errorf("juju: failed to enqueue ELB reconciliation: %s", err)
+				}
+			}
+		}
+	})
+}
+
+// stopELBReconcileLoop halts the reconcile worker, if one is running.
+func stopELBReconcileLoop() {
+	reconcileLoop.Lock()
+	defer reconcileLoop.Unlock()
+	if reconcileLoop.stop != nil {
+		close(reconcileLoop.stop)
+		reconcileLoop.stop = nil
+	}
+}
+
+// enqueueELBReconcileAll enqueues the reconcile task for every app with
+// units in the units collection. An enqueue failure aborts the sweep; the
+// next tick starts over.
+func (p *jujuProvisioner) enqueueELBReconcileAll() error {
+	coll, err := unitsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	var apps []string
+	err = coll.Find(nil).Distinct("app", &apps)
+	if err != nil {
+		return err
+	}
+	for _, appName := range apps {
+		if err = enqueueELBReconcile(appName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueueUnitRestart schedules a restart of the unit to reapply the app's
+// configuration. The hash travels in the job so the task can record what the
+// unit applied once the restart hook succeeds.
+func enqueueUnitRestart(appName, unitName, configHash string) error {
+	q, err := getQueue()
+	if err != nil {
+		return err
+	}
+	_, err = q.Enqueue(restartUnitTaskName, monsterqueue.JobParams{
+		"appName":    appName,
+		"unitName":   unitName,
+		"configHash": configHash,
+	})
+	return err
+}
+
+// restartUnitTask runs the restart hook on one unit, so it picks up the
+// app's current configuration. Units that aren't started yet make the job
+// fail, so the failure is visible and the job can be enqueued again.
+type restartUnitTask struct {
+	p *jujuProvisioner
+}
+
+func (t *restartUnitTask) Name() string {
+	return restartUnitTaskName
+}
+
+func (t *restartUnitTask) Run(job monsterqueue.Job) {
+	params := job.Parameters()
+	unitName, _ := params["unitName"].(string)
+	configHash, _ := params["configHash"].(string)
+	coll, err := unitsCollection()
+	if err != nil {
+		job.Error(err)
+		return
+	}
+	defer coll.Close()
+	var inst instance
+	err = coll.FindId(unitName).One(&inst)
+	if err != nil {
+		job.Error(errors.Wrapf(err, "failed to load unit %q", unitName))
+		return
+	}
+	if inst.Status != provision.StatusStarted.String() {
+		job.Error(errors.Errorf("unit %q is not started yet", unitName))
+		return
+	}
+	if err = t.p.restartUnit(inst); err != nil {
+		job.Error(err)
+		return
+	}
+	if configHash != "" {
+		if err = coll.UpdateId(unitName, bson.M{"$set": bson.M{"confighash": configHash}}); err != nil {
+			job.Error(err)
+			return
+		}
+	}
+	job.Success(nil)
+}
+
+// enqueueSSHKeys schedules the injection of the operator ssh keys on the
+// units of the app. The task only touches started units, so it's enqueued
+// right after provisioning and runs once status collection reports the new
+// units as started.
+func enqueueSSHKeys(appName string) error {
+	q, err := getQueue()
+	if err != nil {
+		return err
+	}
+	_, err = q.Enqueue(injectSSHKeysTaskName, monsterqueue.JobParams{"appName": appName})
+	return err
+}
+
+// injectSSHKeysTask pushes the keys from juju:ssh:authorized-keys to every
+// started unit of the app that doesn't have them yet. Units that aren't
+// started yet make the job fail, so the failure is visible and the job can
+// be enqueued again.
+type injectSSHKeysTask struct {
+	p *jujuProvisioner
+}
+
+func (t *injectSSHKeysTask) Name() string {
+	return injectSSHKeysTaskName
+}
+
+func (t *injectSSHKeysTask) Run(job monsterqueue.Job) {
+	params := job.Parameters()
+	appName, _ := params["appName"].(string)
+	keys := authorizedKeys()
+	if len(keys) == 0 {
+		job.Success(nil)
+		return
+	}
+	insts, err := t.p.appInstances(appName)
+	if err != nil {
+		job.Error(err)
+		return
+	}
+	var pending []string
+	for _, inst := range insts {
+		if inst.KeysInjected {
+			continue
+		}
+		if inst.Status != provision.StatusStarted.String() {
+			pending = append(pending, inst.UnitName)
+			continue
+		}
+		if err = t.p.injectSSHKeys(inst, keys); err != nil {
+			job.Error(err)
+			return
+		}
+	}
+	if len(pending) > 0 {
+		job.Error(errors.Errorf("units %v of app %q are not started yet", pending, appName))
+		return
+	}
+	job.Success(nil)
+}
+
+// enqueueDNSRegister schedules the creation (or update) of the app's DNS
+// record, mirroring the flow that registers units with the load balancer.
+func enqueueDNSRegister(appName string) error {
+	q, err := getQueue()
+	if err != nil {
+		return err
+	}
+	_, err = q.Enqueue(dnsRegisterTaskName, monsterqueue.JobParams{"appName": appName})
+	return err
+}
+
+// dnsRegisterTask points the app's DNS record at its current address, using
+// the provider selected by juju:dns:provider.
+type dnsRegisterTask struct {
+	p *jujuProvisioner
+}
+
+func (t *dnsRegisterTask) Name() string {
+	return dnsRegisterTaskName
+}
+
+func (t *dnsRegisterTask) Run(job monsterqueue.Job) {
+	params := job.Parameters()
+	appName, _ := params["appName"].(string)
+	provider, err := dnsProvider()
+	if err != nil {
+		job.Error(err)
+		return
+	}
+	router, err := t.p.router()
+	if err != nil {
+		job.Error(err)
+		return
+	}
+	addr, err := router.Addr(&namedApp{name: appName})
+	if err != nil {
+		job.Error(err)
+		return
+	}
+	err = provider.Register(appName, addr)
+	if err != nil {
+		job.Error(err)
+		return
+	}
+	job.Success(nil)
+}
+
+// enqueueELBReconcile schedules a reconciliation of the app's load balancer
+// membership. The reconcile worker enqueues it periodically for every known
+// app.
+func enqueueELBReconcile(appName string) error {
+	q, err := getQueue()
+	if err != nil {
+		return err
+	}
+	_, err = q.Enqueue(elbReconcileTaskName, monsterqueue.JobParams{"appName": appName})
+	return err
+}
+
+// elbReconcileTask converges the membership of an app's load balancer with
+// the started units in the units collection, fixing drift caused by lost
+// registrations or out-of-band changes.
+type elbReconcileTask struct {
+	p *jujuProvisioner
+}
+
+func (t *elbReconcileTask) Name() string {
+	return elbReconcileTaskName
+}
+
+func (t *elbReconcileTask) Run(job monsterqueue.Job) {
+	params := job.Parameters()
+	appName, _ := params["appName"].(string)
+	manager := t.p.LoadBalancer()
+	if manager == nil {
+		job.Error(errors.New("ELB support is disabled"))
+		return
+	}
+	err := manager.Reconcile(&namedApp{name: appName})
+	if err != nil {
+		job.Error(err)
+		return
+	}
+	job.Success(nil)
+}
+
+func enqueueUnitToLoadBalancer(appName, unitName string) error {
+	q, err := getQueue()
+	if err != nil {
+		return err
+	}
+	// requireStarted makes the task hold the registration until status
+	// collection reports the unit as started, so the balancer never routes
+	// to an instance that isn't ready. It's recorded in the job parameters
+	// so jobs enqueued before this behavior existed keep their old
+	// semantics when replayed.
+	_, err = q.Enqueue(addUnitToLoadBalancerTaskName, monsterqueue.JobParams{
+		"appName":        appName,
+		"unitName":       unitName,
+		"requireStarted": true,
+	})
+	return err
+}
+
+// addUnitToLoadBalancerTask registers the instance backing a freshly added
+// unit with the app's load balancer, once CollectStatus has recorded its
+// instance id and — when the job asks for it — reported the unit as started.
+type addUnitToLoadBalancerTask struct {
+	p *jujuProvisioner
+}
+
+func (t *addUnitToLoadBalancerTask) Name() string {
+	return addUnitToLoadBalancerTaskName
+}
+
+func (t *addUnitToLoadBalancerTask) Run(job monsterqueue.Job) {
+	params := job.Parameters()
+	appName, _ := params["appName"].(string)
+	unitName, _ := params["unitName"].(string)
+	coll, err := unitsCollection()
+	if err != nil {
+		job.Error(err)
+		return
+	}
+	defer coll.Close()
+	var inst instance
+	err = coll.FindId(unitName).One(&inst)
+	if err != nil {
+		job.Error(errors.Wrapf(err, "failed to load unit %q", unitName))
+		return
+	}
+	if inst.InstanceID == "" {
+		job.Error(errors.Errorf("unit %q has no instance id yet", unitName))
+		return
+	}
+	if requireStarted, _ := params["requireStarted"].(bool); requireStarted && inst.Status != provision.StatusStarted.String() {
+		job.Error(errors.Errorf("unit %q is not started yet", unitName))
+		return
+	}
+	manager := t.p.LoadBalancer()
+	if manager == nil {
+		job.Error(errors.New("ELB support is disabled"))
+		return
+	}
+	err = manager.Register(&namedApp{name: appName}, inst.InstanceID)
+	if err != nil {
+		job.Error(err)
+		return
+	}
+	job.Success(nil)
+}
+
+func (p *jujuProvisioner) enqueueProvisionRetry(appName, platform, env string, attempt int) error {
+	maxAttempts, err := config.GetInt("juju:provision-retry:max-attempts")
+	if err != nil {
+		maxAttempts = defaultProvisionRetryMaxAttempts
+	}
+	q, err := getQueue()
+	if err != nil {
+		return err
+	}
+	_, err = q.Enqueue(provisionRetryTaskName, monsterqueue.JobParams{
+		"appName":     appName,
+		"platform":    platform,
+		"environment": env,
+		"attempt":     attempt,
+		"maxAttempts": maxAttempts,
+	})
+	return err
+}
+
+// provisionRetryTask retries the deploy of a juju service whose initial
+// Provision call failed transiently, giving up after the maxAttempts recorded
+// in the job parameters.
+type provisionRetryTask struct {
+	p *jujuProvisioner
+}
+
+func (t *provisionRetryTask) Name() string {
+	return provisionRetryTaskName
+}
+
+func (t *provisionRetryTask) Run(job monsterqueue.Job) {
+	params := job.Parameters()
+	appName, _ := params["appName"].(string)
+	platform, _ := params["platform"].(string)
+	env, _ := params["environment"].(string)
+	attempt := intParam(params, "attempt")
+	maxAttempts := intParam(params, "maxAttempts")
+	err := t.p.deployService(appName, platform, env, nil)
+	if err == nil {
+		if err = t.p.postDeploySetup(&namedApp{name: appName}); err != nil {
+			job.Error(err)
+			return
+		}
+		job.Success(nil)
+		return
+	}
+	if attempt >= maxAttempts {
+		job.Error(errors.Wrapf(err, "giving up provisioning app %q after %d attempts", appName, attempt))
+		return
+	}
+	qErr := t.p.enqueueProvisionRetry(appName, platform, env, attempt+1)
+	if qErr != nil {
+		log.Errorf("juju: failed to enqueue provision retry for %q: %s", appName, qErr)
+	}
+	job.Error(err)
+}
+
+// namedApp satisfies provision.Named for queue tasks, which only carry the
+// app name in their parameters.
+type namedApp struct {
+	name string
+}
+
+func (a *namedApp) GetName() string {
+	return a.name
+}
+
+// intParam reads an integer from job parameters, accepting the numeric types
+// that queue backends may deserialize numbers into.
+func intParam(params monsterqueue.JobParams, name string) int {
+	switch v := params[name].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+// RetryQueued re-enqueues the failed queue jobs of the app — jobs that
+// finished with an error, typically after an outage was fixed — and returns
+// how many were requeued. Jobs still enqueued or running are left alone, the
+// queue will get to them.
+func (p *jujuProvisioner) RetryQueued(appName string) (int, error) {
+	q, err := getQueue()
+	if err != nil {
+		return 0, err
+	}
+	jobs, err := q.ListJobs()
+	if err != nil {
+		return 0, err
+	}
+	requeued := 0
+	for _, job := range jobs {
+		if name, _ := job.Parameters()["appName"].(string); name != appName {
+			continue
+		}
+		if job.Status().State != monsterqueue.JobStateDone {
+			continue
+		}
+		if _, err := job.Result(); err == nil {
+			continue
+		}
+		if _, err = q.Enqueue(job.TaskName(), job.Parameters()); err != nil {
+			return requeued, err
+		}
+		if err = q.DeleteJob(job.ID()); err != nil {
+			return requeued, err
+		}
+		log.Debugf("juju: event=retry-queued app=%s task=%s job=%s", appName, job.TaskName(), job.ID())
+		requeued++
+	}
+	return requeued, nil
+}
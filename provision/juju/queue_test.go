@@ -0,0 +1,453 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/config"
+	"github.com/tsuru/monsterqueue"
+	"github.com/tsuru/tsuru/exec/exectest"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	check "gopkg.in/check.v1"
+)
+
+type enqueuedJob struct {
+	taskName string
+	params   monsterqueue.JobParams
+}
+
+// fakeQueue implements monsterqueue.Queue recording enqueued jobs, so tests
+// can exercise the queue integration without a queue server.
+type fakeQueue struct {
+	jobs       []enqueuedJob
+	enqueueErr error
+	tasks      []string
+	listed     []monsterqueue.Job
+	deleted    []string
+}
+
+func (q *fakeQueue) RegisterTask(task monsterqueue.Task) error {
+	q.tasks = append(q.tasks, task.Name())
+	return nil
+}
+
+func (q *fakeQueue) Enqueue(taskName string, params monsterqueue.JobParams) (monsterqueue.Job, error) {
+	if q.enqueueErr != nil {
+		return nil, q.enqueueErr
+	}
+	q.jobs = append(q.jobs, enqueuedJob{taskName: taskName, params: params})
+	return nil, nil
+}
+
+func (q *fakeQueue) EnqueueWait(taskName string, params monsterqueue.JobParams, timeout time.Duration) (monsterqueue.Job, error) {
+	return q.Enqueue(taskName, params)
+}
+
+func (q *fakeQueue) ProcessLoop()                                       {}
+func (q *fakeQueue) Stop()                                              {}
+func (q *fakeQueue) Wait()                                              {}
+func (q *fakeQueue) RetrieveJob(jobId string) (monsterqueue.Job, error) { return nil, nil }
+func (q *fakeQueue) ResetStorage() error                                { return nil }
+func (q *fakeQueue) ListJobs() ([]monsterqueue.Job, error)              { return q.listed, nil }
+
+func (q *fakeQueue) DeleteJob(jobId string) error {
+	q.deleted = append(q.deleted, jobId)
+	return nil
+}
+
+// fakeJob is a finished (or still pending) job listed by fakeQueue, for the
+// RetryQueued tests.
+type fakeJob struct {
+	id       string
+	taskName string
+	params   monsterqueue.JobParams
+	state    string
+	err      error
+}
+
+func (j *fakeJob) Success(result monsterqueue.JobResult) (bool, error) { return false, nil }
+func (j *fakeJob) Error(jobErr error) (bool, error)                    { return false, nil }
+func (j *fakeJob) Result() (monsterqueue.JobResult, error)             { return nil, j.err }
+func (j *fakeJob) ID() string                                          { return j.id }
+func (j *fakeJob) Parameters() monsterqueue.JobParams                  { return j.params }
+func (j *fakeJob) TaskName() string                                    { return j.taskName }
+func (j *fakeJob) Queue() monsterqueue.Queue                           { return nil }
+func (j *fakeJob) Status() monsterqueue.JobStatus                      { return monsterqueue.JobStatus{State: j.state} }
+func (j *fakeJob) EnqueueStack() string                                { return "" }
+
+func (s *S) useFakeQueue() *fakeQueue {
+	q := &fakeQueue{}
+	getQueue = func() (monsterqueue.Queue, error) {
+		return q, nil
+	}
+	return q
+}
+
+func (s *S) TestInitializeRegistersTasks(c *check.C) {
+	q := s.useFakeQueue()
+	p := &jujuProvisioner{}
+	err := p.Initialize()
+	c.Assert(err, check.IsNil)
+	c.Assert(q.tasks, check.DeepEquals, []string{provisionRetryTaskName, addUnitToLoadBalancerTaskName, elbReconcileTaskName, dnsRegisterTaskName, injectSSHKeysTaskName, restartUnitTaskName})
+}
+
+func (s *S) TestProvisionFailureEnqueuesRetry(c *check.C) {
+	q := s.useFakeQueue()
+	execut = &exectest.ErrorExecutor{Err: errors.New("juju is down")}
+	app := provisiontest.NewFakeApp("trace", "python", 0)
+	p := &jujuProvisioner{}
+	err := p.Provision(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(q.jobs, check.HasLen, 1)
+	c.Assert(q.jobs[0].taskName, check.Equals, provisionRetryTaskName)
+	c.Assert(q.jobs[0].params["appName"], check.Equals, "trace")
+	c.Assert(q.jobs[0].params["platform"], check.Equals, "python")
+	c.Assert(q.jobs[0].params["attempt"], check.Equals, 1)
+	c.Assert(q.jobs[0].params["maxAttempts"], check.Equals, defaultProvisionRetryMaxAttempts)
+}
+
+func (s *S) TestProvisionFailureEnqueueFails(c *check.C) {
+	q := s.useFakeQueue()
+	q.enqueueErr = errors.New("queue is down")
+	execut = &exectest.ErrorExecutor{Err: errors.New("juju is down")}
+	app := provisiontest.NewFakeApp("trace", "python", 0)
+	p := &jujuProvisioner{}
+	err := p.Provision(app)
+	c.Assert(err, check.NotNil)
+	c.Assert(q.jobs, check.HasLen, 0)
+}
+
+func (s *S) TestAddUnitsSurfacesEnqueueFailure(c *check.C) {
+	q := s.useFakeQueue()
+	q.enqueueErr = errors.New("queue is down")
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	output := []byte("Unit 'needle/1' added to machine 3\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("needle", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.AddUnits(app, 1, "", nil, nil)
+	c.Assert(err, check.ErrorMatches, `failed to enqueue ELB registration of unit "needle/1": queue is down`)
+}
+
+type fakeDNSProvider struct {
+	records map[string]string
+	err     error
+}
+
+func (p *fakeDNSProvider) Register(appName, addr string) error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.records == nil {
+		p.records = make(map[string]string)
+	}
+	p.records[appName] = addr
+	return nil
+}
+
+func (s *S) TestProvisionEnqueuesDNSRegister(c *check.C) {
+	q := s.useFakeQueue()
+	config.Set("juju:dns:provider", "fake")
+	defer config.Unset("juju:dns:provider")
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("trace", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Provision(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(q.jobs, check.HasLen, 1)
+	c.Assert(q.jobs[0].taskName, check.Equals, dnsRegisterTaskName)
+	c.Assert(q.jobs[0].params["appName"], check.Equals, "trace")
+}
+
+func (s *S) TestAddUnitsEnqueuesDNSRegister(c *check.C) {
+	q := s.useFakeQueue()
+	config.Set("juju:dns:provider", "fake")
+	defer config.Unset("juju:dns:provider")
+	output := []byte("Unit 'trace/1' added to machine 3\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("trace", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.AddUnits(app, 1, "", nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(q.jobs, check.HasLen, 1)
+	c.Assert(q.jobs[0].taskName, check.Equals, dnsRegisterTaskName)
+}
+
+func (s *S) TestDNSProviderSelection(c *check.C) {
+	provider := &fakeDNSProvider{}
+	RegisterDNSProvider("fake", func() DNSProvider { return provider })
+	defer delete(dnsProviders, "fake")
+	_, err := dnsProvider()
+	c.Assert(err, check.ErrorMatches, "juju: dns:provider is not configured")
+	config.Set("juju:dns:provider", "fake")
+	defer config.Unset("juju:dns:provider")
+	got, err := dnsProvider()
+	c.Assert(err, check.IsNil)
+	c.Assert(got, check.Equals, provider)
+	config.Set("juju:dns:provider", "route53")
+	_, err = dnsProvider()
+	c.Assert(err, check.ErrorMatches, `juju: unknown DNS provider "route53"`)
+}
+
+func (s *S) TestAddUnitsEnqueuesSSHKeys(c *check.C) {
+	q := s.useFakeQueue()
+	config.Set("juju:ssh:authorized-keys", []string{"ssh-rsa AAAA ops@tsuru"})
+	output := []byte("Unit 'trace/1' added to machine 3\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("trace", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.AddUnits(app, 1, "", nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(q.jobs, check.HasLen, 1)
+	c.Assert(q.jobs[0].taskName, check.Equals, injectSSHKeysTaskName)
+	c.Assert(q.jobs[0].params["appName"], check.Equals, "trace")
+}
+
+func (s *S) TestProvisionEnqueuesSSHKeys(c *check.C) {
+	q := s.useFakeQueue()
+	config.Set("juju:ssh:authorized-keys", []string{"ssh-rsa AAAA ops@tsuru"})
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("trace", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.Provision(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(q.jobs, check.HasLen, 1)
+	c.Assert(q.jobs[0].taskName, check.Equals, injectSSHKeysTaskName)
+}
+
+func (s *S) TestEnqueueUnitToLoadBalancerRequiresStarted(c *check.C) {
+	q := s.useFakeQueue()
+	err := enqueueUnitToLoadBalancer("trace", "trace/1")
+	c.Assert(err, check.IsNil)
+	c.Assert(q.jobs, check.HasLen, 1)
+	c.Assert(q.jobs[0].params["requireStarted"], check.Equals, true)
+}
+
+func (s *S) TestAddUnitsSkipsELBWhenAutoRegisterDisabled(c *check.C) {
+	q := s.useFakeQueue()
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	config.Set("juju:elb:auto-register", false)
+	output := []byte("Unit 'trace/1' added to machine 3\n")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {output}}}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("trace", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.AddUnits(app, 1, "", nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(q.jobs, check.HasLen, 0)
+}
+
+func (s *S) TestRetryQueued(c *check.C) {
+	q := s.useFakeQueue()
+	q.listed = []monsterqueue.Job{
+		&fakeJob{
+			id: "j1", taskName: addUnitToLoadBalancerTaskName,
+			params: monsterqueue.JobParams{"appName": "trace", "unitName": "trace/0"},
+			state:  monsterqueue.JobStateDone, err: errors.New("elb is down"),
+		},
+		&fakeJob{
+			id: "j2", taskName: addUnitToLoadBalancerTaskName,
+			params: monsterqueue.JobParams{"appName": "trace", "unitName": "trace/1"},
+			state:  monsterqueue.JobStateDone,
+		},
+		&fakeJob{
+			id: "j3", taskName: injectSSHKeysTaskName,
+			params: monsterqueue.JobParams{"appName": "trace"},
+			state:  monsterqueue.JobStateEnqueued,
+		},
+		&fakeJob{
+			id: "j4", taskName: addUnitToLoadBalancerTaskName,
+			params: monsterqueue.JobParams{"appName": "other"},
+			state:  monsterqueue.JobStateDone, err: errors.New("elb is down"),
+		},
+	}
+	p := &jujuProvisioner{}
+	requeued, err := p.RetryQueued("trace")
+	c.Assert(err, check.IsNil)
+	c.Assert(requeued, check.Equals, 1)
+	c.Assert(q.jobs, check.HasLen, 1)
+	c.Assert(q.jobs[0].taskName, check.Equals, addUnitToLoadBalancerTaskName)
+	c.Assert(q.jobs[0].params["unitName"], check.Equals, "trace/0")
+	c.Assert(q.deleted, check.DeepEquals, []string{"j1"})
+}
+
+func (s *S) TestRetryQueuedNothingToDo(c *check.C) {
+	s.useFakeQueue()
+	p := &jujuProvisioner{}
+	requeued, err := p.RetryQueued("trace")
+	c.Assert(err, check.IsNil)
+	c.Assert(requeued, check.Equals, 0)
+}
+
+func (s *S) TestInstanceIDChangeEnqueuesRestartWhenConfigDiffers(c *check.C) {
+	q := s.useFakeQueue()
+	defer func() { getQueue = defaultGetQueue }()
+	err := recordAppConfigHash("as_i_rise", "deadbeef")
+	c.Assert(err, check.IsNil)
+	s.addInstances(c, instance{
+		UnitName: "as_i_rise/0", AppName: "as_i_rise", Machine: 0,
+		InstanceID: "i-old", ConfigHash: "cafebabe",
+		Status: provision.StatusStarted.String(),
+	})
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(collectOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	_, err = p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	c.Assert(q.jobs, check.HasLen, 1)
+	c.Assert(q.jobs[0].taskName, check.Equals, restartUnitTaskName)
+	c.Assert(q.jobs[0].params["unitName"], check.Equals, "as_i_rise/0")
+	c.Assert(q.jobs[0].params["configHash"], check.Equals, "deadbeef")
+}
+
+func (s *S) TestInstanceIDChangeSkipsRestartWhenConfigUnchanged(c *check.C) {
+	q := s.useFakeQueue()
+	defer func() { getQueue = defaultGetQueue }()
+	err := recordAppConfigHash("as_i_rise", "deadbeef")
+	c.Assert(err, check.IsNil)
+	s.addInstances(c, instance{
+		UnitName: "as_i_rise/0", AppName: "as_i_rise", Machine: 0,
+		InstanceID: "i-old", ConfigHash: "deadbeef",
+		Status: provision.StatusStarted.String(),
+	})
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(collectOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	_, err = p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	c.Assert(q.jobs, check.HasLen, 0)
+}
+
+func (s *S) TestInstanceIDChangeSkipsRestartWhenFrozen(c *check.C) {
+	q := s.useFakeQueue()
+	defer func() { getQueue = defaultGetQueue }()
+	err := recordAppConfigHash("as_i_rise", "deadbeef")
+	c.Assert(err, check.IsNil)
+	s.addInstances(c, instance{
+		UnitName: "as_i_rise/0", AppName: "as_i_rise", Machine: 0,
+		InstanceID: "i-old", ConfigHash: "cafebabe", Frozen: true,
+		Status: provision.StatusStarted.String(),
+	})
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"status": {[]byte(collectOutput)}}}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	_, err = p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	c.Assert(q.jobs, check.HasLen, 0)
+}
+
+func (s *S) TestRestartUnitTask(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	s.addInstances(c, instance{
+		UnitName: "cartman/0", AppName: "cartman", Machine: 3,
+		Status: provision.StatusStarted.String(),
+	})
+	p := &jujuProvisioner{}
+	task := &restartUnitTask{p: p}
+	job := &fakeJob{params: monsterqueue.JobParams{
+		"appName":    "cartman",
+		"unitName":   "cartman/0",
+		"configHash": "deadbeef",
+	}}
+	task.Run(job)
+	args := append(sshArgs("3"), "/var/lib/tsuru/hooks/restart")
+	c.Assert(fexec.ExecutedCmd("juju", args), check.Equals, true)
+	inst := s.getInstance(c, "cartman/0")
+	c.Assert(inst.ConfigHash, check.Equals, "deadbeef")
+}
+
+func (s *S) TestProvisionRetryTaskRunsPostDeployFlow(c *check.C) {
+	q := s.useFakeQueue()
+	defer func() { getQueue = defaultGetQueue }()
+	srv := s.startELBServer()
+	defer srv.close()
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	config.Set("juju:dns:provider", "fake")
+	defer config.Unset("juju:dns:provider")
+	config.Set("juju:ssh:authorized-keys", []string{"ssh-rsa AAAA ops@tsuru"})
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	p := &jujuProvisioner{}
+	task := &provisionRetryTask{p: p}
+	job := &fakeJob{params: monsterqueue.JobParams{
+		"appName":     "trace",
+		"platform":    "python",
+		"attempt":     1,
+		"maxAttempts": 3,
+	}}
+	task.Run(job)
+	c.Assert(srv.requests("CreateLoadBalancer"), check.HasLen, 1)
+	c.Assert(q.jobs, check.HasLen, 2)
+	c.Assert(q.jobs[0].taskName, check.Equals, injectSSHKeysTaskName)
+	c.Assert(q.jobs[0].params["appName"], check.Equals, "trace")
+	c.Assert(q.jobs[1].taskName, check.Equals, dnsRegisterTaskName)
+	c.Assert(q.jobs[1].params["appName"], check.Equals, "trace")
+}
+
+func (s *S) TestEnqueueELBReconcileAll(c *check.C) {
+	q := s.useFakeQueue()
+	defer func() { getQueue = defaultGetQueue }()
+	s.addInstances(c,
+		instance{UnitName: "trace/0", AppName: "trace", Machine: 1, Status: provision.StatusStarted.String()},
+		instance{UnitName: "trace/1", AppName: "trace", Machine: 2, Status: provision.StatusStarted.String()},
+		instance{UnitName: "sight/0", AppName: "sight", Machine: 3, Status: provision.StatusStarted.String()},
+	)
+	p := &jujuProvisioner{}
+	err := p.enqueueELBReconcileAll()
+	c.Assert(err, check.IsNil)
+	c.Assert(q.jobs, check.HasLen, 2)
+	apps := make(map[string]struct{})
+	for _, job := range q.jobs {
+		c.Assert(job.taskName, check.Equals, elbReconcileTaskName)
+		apps[job.params["appName"].(string)] = struct{}{}
+	}
+	c.Assert(apps, check.DeepEquals, map[string]struct{}{"trace": {}, "sight": {}})
+}
+
+func (s *S) TestELBReconcileLoopEnqueuesPeriodically(c *check.C) {
+	q := s.useFakeQueue()
+	defer func() { getQueue = defaultGetQueue }()
+	s.addInstances(c, instance{UnitName: "trace/0", AppName: "trace", Machine: 1, Status: provision.StatusStarted.String()})
+	p := &jujuProvisioner{}
+	p.startELBReconcileLoop(10 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	err := p.Shutdown(5 * time.Second)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(q.jobs) > 0, check.Equals, true)
+	c.Assert(q.jobs[0].taskName, check.Equals, elbReconcileTaskName)
+	c.Assert(q.jobs[0].params["appName"], check.Equals, "trace")
+}
+
+func (s *S) TestInitializeStartsELBReconcileLoop(c *check.C) {
+	s.useFakeQueue()
+	defer func() { getQueue = defaultGetQueue }()
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	p := &jujuProvisioner{}
+	err := p.Initialize()
+	c.Assert(err, check.IsNil)
+	reconcileLoop.Lock()
+	running := reconcileLoop.stop != nil
+	reconcileLoop.Unlock()
+	c.Assert(running, check.Equals, true)
+	err = p.Shutdown(5 * time.Second)
+	c.Assert(err, check.IsNil)
+	reconcileLoop.Lock()
+	running = reconcileLoop.stop != nil
+	reconcileLoop.Unlock()
+	c.Assert(running, check.Equals, false)
+}
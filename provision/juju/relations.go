@@ -0,0 +1,130 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/db/storage"
+	"github.com/tsuru/tsuru/provision"
+)
+
+const defaultRelationsCollection = "juju_relations"
+
+// relation is the document kept in the relations collection, recording that
+// the app's service is related to another juju service (e.g. a subordinate
+// charm). Relations must be removed before the service can be destroyed.
+type relation struct {
+	ID     string `bson:"_id"`
+	App    string `bson:"app"`
+	Remote string `bson:"remote"`
+}
+
+func relationID(appName, remote string) string {
+	return fmt.Sprintf("%s %s", appName, remote)
+}
+
+func relationsCollection() (*storage.Collection, error) {
+	name, err := config.GetString("juju:relations-collection")
+	if err != nil {
+		name = defaultRelationsCollection
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Collection(name), nil
+}
+
+func appRelations(appName string) ([]relation, error) {
+	coll, err := relationsCollection()
+	if err != nil {
+		return nil, err
+	}
+	defer coll.Close()
+	var relations []relation
+	err = coll.Find(bson.M{"app": appName}).Sort("_id").All(&relations)
+	return relations, err
+}
+
+// AddRelation relates the app's service to the given remote service and
+// records the relation, so Destroy can undo it before destroying the service.
+func (p *jujuProvisioner) AddRelation(app provision.App, remote string) error {
+	serviceName, err := jujuServiceName(app.GetName())
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	args := append(environmentArgs(appEnvironment(app)), "add-relation", serviceName, remote)
+	err = runCmd(&buf, &buf, args...)
+	if err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	coll, err := relationsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	return coll.Insert(relation{
+		ID:     relationID(app.GetName(), remote),
+		App:    app.GetName(),
+		Remote: remote,
+	})
+}
+
+// RemoveRelation breaks the relation between the app's service and the given
+// remote service and forgets it.
+func (p *jujuProvisioner) RemoveRelation(app provision.App, remote string) error {
+	serviceName, err := jujuServiceName(app.GetName())
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	args := append(environmentArgs(appEnvironment(app)), "remove-relation", serviceName, remote)
+	err = runCmd(&buf, &buf, args...)
+	if err != nil {
+		return &provision.Error{Reason: buf.String(), Err: err}
+	}
+	coll, err := relationsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	return coll.RemoveId(relationID(app.GetName(), remote))
+}
+
+// removeRelations breaks every relation tracked for the app. Juju refuses to
+// destroy a service that still has relations, so Destroy calls this first.
+func (p *jujuProvisioner) removeRelations(app provision.App) error {
+	relations, err := appRelations(app.GetName())
+	if err != nil {
+		return err
+	}
+	serviceName, err := jujuServiceName(app.GetName())
+	if err != nil {
+		return err
+	}
+	coll, err := relationsCollection()
+	if err != nil {
+		return err
+	}
+	defer coll.Close()
+	for _, rel := range relations {
+		var buf bytes.Buffer
+		args := append(environmentArgs(appEnvironment(app)), "remove-relation", serviceName, rel.Remote)
+		err = runCmd(&buf, &buf, args...)
+		if err != nil {
+			return &provision.Error{Reason: buf.String(), Err: err}
+		}
+		if err = coll.RemoveId(rel.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
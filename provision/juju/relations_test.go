@@ -0,0 +1,69 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"github.com/tsuru/tsuru/exec/exectest"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *S) TestAddRelation(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("cribcaged", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.AddRelation(app, "mysql")
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"add-relation", "cribcaged", "mysql"}), check.Equals, true)
+	relations, err := appRelations("cribcaged")
+	c.Assert(err, check.IsNil)
+	c.Assert(relations, check.HasLen, 1)
+	c.Assert(relations[0].Remote, check.Equals, "mysql")
+}
+
+func (s *S) TestAddRelationUsesServiceNameAndEnvironment(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := &envApp{FakeApp: provisiontest.NewFakeApp("crib_caged", "python", 1), env: "staging"}
+	p := &jujuProvisioner{}
+	err := p.AddRelation(app, "mysql")
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"-e", "staging", "add-relation", "crib-caged", "mysql"}), check.Equals, true)
+	err = p.RemoveRelation(app, "mysql")
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"-e", "staging", "remove-relation", "crib-caged", "mysql"}), check.Equals, true)
+}
+
+func (s *S) TestRemoveRelation(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("cribcaged", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.AddRelation(app, "mysql")
+	c.Assert(err, check.IsNil)
+	err = p.RemoveRelation(app, "mysql")
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"remove-relation", "cribcaged", "mysql"}), check.Equals, true)
+	relations, err := appRelations("cribcaged")
+	c.Assert(err, check.IsNil)
+	c.Assert(relations, check.HasLen, 0)
+}
+
+func (s *S) TestDestroyRemovesRelationsFirst(c *check.C) {
+	fexec := exectest.FakeExecutor{}
+	execut = &fexec
+	app := provisiontest.NewFakeApp("cribcaged", "python", 1)
+	p := &jujuProvisioner{}
+	err := p.AddRelation(app, "mysql")
+	c.Assert(err, check.IsNil)
+	err = p.Destroy(app)
+	c.Assert(err, check.IsNil)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"remove-relation", "cribcaged", "mysql"}), check.Equals, true)
+	c.Assert(fexec.ExecutedCmd("juju", []string{"destroy-service", "cribcaged"}), check.Equals, true)
+	relations, err := appRelations("cribcaged")
+	c.Assert(err, check.IsNil)
+	c.Assert(relations, check.HasLen, 0)
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"github.com/pkg/errors"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/provision"
+)
+
+// Router resolves the public address of an app. The ELB manager is one
+// implementation; a router sitting in front of the units (hipache, galeb)
+// can be registered as another and selected with the juju:router setting.
+type Router interface {
+	Addr(app provision.Named) (string, error)
+}
+
+var routers = make(map[string]func(*jujuProvisioner) Router)
+
+// RegisterRouter makes a router available for selection through the
+// juju:router setting. It's meant to be called from init functions, mirroring
+// provision.Register.
+func RegisterRouter(name string, factory func(*jujuProvisioner) Router) {
+	routers[name] = factory
+}
+
+func init() {
+	RegisterRouter("elb", func(p *jujuProvisioner) Router { return p.LoadBalancer() })
+	RegisterRouter("unit", func(p *jujuProvisioner) Router { return &unitRouter{p: p} })
+}
+
+// router returns the Router selected by juju:router. Without the setting the
+// historical behavior is kept: the ELB when ELB support is enabled, the
+// public address of the first unit otherwise.
+func (p *jujuProvisioner) router() (Router, error) {
+	name, _ := config.GetString("juju:router")
+	if name == "" {
+		if p.elbSupport() {
+			return p.LoadBalancer(), nil
+		}
+		return &unitRouter{p: p}, nil
+	}
+	factory, ok := routers[name]
+	if !ok {
+		return nil, errors.Errorf("juju: unknown router %q", name)
+	}
+	return factory(p), nil
+}
+
+// unitRouter is the routerless default: apps are reached directly through
+// the public address of their first unit, once exposed.
+type unitRouter struct {
+	p *jujuProvisioner
+}
+
+func (r *unitRouter) Addr(app provision.Named) (string, error) {
+	insts, err := r.p.appInstances(app.GetName())
+	if err != nil {
+		return "", err
+	}
+	if len(insts) == 0 {
+		return "", provision.ErrEmptyApp
+	}
+	if !insts[0].Exposed {
+		return "", errors.Errorf("app %q is not exposed", app.GetName())
+	}
+	return insts[0].PublicAddress, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *S) TestRouterDefault(c *check.C) {
+	p := &jujuProvisioner{}
+	router, err := p.router()
+	c.Assert(err, check.IsNil)
+	_, ok := router.(*unitRouter)
+	c.Assert(ok, check.Equals, true)
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	router, err = p.router()
+	c.Assert(err, check.IsNil)
+	_, ok = router.(*ELBManager)
+	c.Assert(ok, check.Equals, true)
+}
+
+func (s *S) TestRouterFromConfig(c *check.C) {
+	config.Set("juju:router", "elb")
+	defer config.Unset("juju:router")
+	p := &jujuProvisioner{}
+	router, err := p.router()
+	c.Assert(err, check.IsNil)
+	_, ok := router.(*ELBManager)
+	c.Assert(ok, check.Equals, true)
+}
+
+func (s *S) TestRouterUnknown(c *check.C) {
+	config.Set("juju:router", "galeb")
+	defer config.Unset("juju:router")
+	p := &jujuProvisioner{}
+	_, err := p.router()
+	c.Assert(err, check.ErrorMatches, `juju: unknown router "galeb"`)
+	_, err = p.Addr(provisiontest.NewFakeApp("impossible", "python", 1))
+	c.Assert(err, check.ErrorMatches, `juju: unknown router "galeb"`)
+}
+
+type staticRouter struct {
+	addr string
+}
+
+func (r *staticRouter) Addr(app provision.Named) (string, error) {
+	return r.addr, nil
+}
+
+func (s *S) TestRegisterRouter(c *check.C) {
+	RegisterRouter("static", func(p *jujuProvisioner) Router {
+		return &staticRouter{addr: "apps.example.com"}
+	})
+	defer delete(routers, "static")
+	config.Set("juju:router", "static")
+	defer config.Unset("juju:router")
+	p := &jujuProvisioner{}
+	addr, err := p.Addr(provisiontest.NewFakeApp("impossible", "python", 1))
+	c.Assert(err, check.IsNil)
+	c.Assert(addr, check.Equals, "apps.example.com")
+}
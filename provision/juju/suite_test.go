@@ -0,0 +1,133 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/db"
+	"github.com/tsuru/tsuru/db/dbtest"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	conn *db.Storage
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	config.Set("log:disable-syslog", true)
+	config.Set("database:url", "127.0.0.1:27017")
+	config.Set("database:name", "juju_provision_tests_s")
+	var err error
+	s.conn, err = db.Conn()
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) SetUpTest(c *check.C) {
+	config.Set("juju:charms-path", "/home/charms")
+	config.Set("juju:units-collection", "juju_units_test")
+	config.Set("juju:relations-collection", "juju_relations_test")
+	config.Set("juju:machine-actions-collection", "juju_machine_actions_test")
+	config.Set("juju:app-counts-collection", "juju_app_counts_test")
+	config.Set("juju:app-pools-collection", "juju_app_pools_test")
+	config.Set("juju:app-configs-collection", "juju_app_configs_test")
+	config.Set("juju:app-charms-collection", "juju_app_charms_test")
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	coll, err := unitsCollection()
+	c.Assert(err, check.IsNil)
+	defer coll.Close()
+	coll.RemoveAll(nil)
+	relColl, err := relationsCollection()
+	c.Assert(err, check.IsNil)
+	defer relColl.Close()
+	relColl.RemoveAll(nil)
+	actionsColl, err := machineActionsCollection()
+	c.Assert(err, check.IsNil)
+	defer actionsColl.Close()
+	actionsColl.RemoveAll(nil)
+	countsColl, err := appCountsCollection()
+	c.Assert(err, check.IsNil)
+	defer countsColl.Close()
+	countsColl.RemoveAll(nil)
+	poolsColl, err := appPoolsCollection()
+	c.Assert(err, check.IsNil)
+	defer poolsColl.Close()
+	poolsColl.RemoveAll(nil)
+	configsColl, err := appConfigsCollection()
+	c.Assert(err, check.IsNil)
+	defer configsColl.Close()
+	configsColl.RemoveAll(nil)
+	charmsColl, err := appCharmsCollection()
+	c.Assert(err, check.IsNil)
+	defer charmsColl.Close()
+	charmsColl.RemoveAll(nil)
+	config.Unset("juju:machine-action")
+	config.Unset("juju:terminate-concurrency")
+	config.Unset("juju:ssh:authorized-keys")
+	config.Unset("juju:elb:preserve-on-destroy")
+	config.Unset("juju:elb:auto-register")
+	config.Unset("juju:instance-tags-to-import")
+	config.Unset("juju:platform-defaults:python:constraints")
+	config.Unset("juju:platform-defaults:python:env")
+	config.Unset("juju:ssh:user")
+	config.Unset("juju:platform-defaults:python:ssh-user")
+	config.Unset("juju:elb:access-log:enabled")
+	config.Unset("juju:elb:access-log:bucket")
+	config.Unset("juju:elb:access-log:prefix")
+	config.Unset("juju:elb:access-log:interval")
+	config.Unset("juju:elb:create-timeout")
+	config.Unset("juju:elb:unhealthy-threshold")
+	config.Unset("juju:pools:dedicated")
+	config.Unset("juju:repo-rewrite:from")
+	config.Unset("juju:repo-rewrite:to")
+	config.Unset("juju:charm-revision")
+	elbDrainPollInterval = 3 * time.Second
+	waitForUnitsPollInterval = 3 * time.Second
+	config.Unset("juju:add-units-wait")
+	config.Unset("juju:ssh:jump-host")
+	execut = nil
+	getQueue = defaultGetQueue
+	addrCache.Lock()
+	addrCache.addrs = make(map[string]string)
+	addrCache.Unlock()
+	versionCache.Lock()
+	versionCache.version = ""
+	versionCache.fetched = false
+	versionCache.Unlock()
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	defer s.conn.Close()
+	dbtest.ClearAllCollections(s.conn.Apps().Database)
+}
+
+func (s *S) addInstances(c *check.C, insts ...instance) {
+	coll, err := unitsCollection()
+	c.Assert(err, check.IsNil)
+	defer coll.Close()
+	for _, inst := range insts {
+		err = coll.Insert(inst)
+		c.Assert(err, check.IsNil)
+	}
+}
+
+func (s *S) getInstance(c *check.C, unitName string) instance {
+	coll, err := unitsCollection()
+	c.Assert(err, check.IsNil)
+	defer coll.Close()
+	var inst instance
+	err = coll.Find(bson.M{"_id": unitName}).One(&inst)
+	c.Assert(err, check.IsNil)
+	return inst
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	"github.com/tsuru/tsuru/provision"
+)
+
+// The topology types describe the JSON document produced by Topology. Field
+// names are part of the document format consumed by external tooling; don't
+// rename them lightly.
+type topologyUnit struct {
+	Name      string `json:"name"`
+	Machine   int    `json:"machine"`
+	Container string `json:"container,omitempty"`
+	Status    string `json:"status"`
+	ELBState  string `json:"elbState,omitempty"`
+}
+
+type topologyMachine struct {
+	Number         int    `json:"number"`
+	InstanceID     string `json:"instanceId,omitempty"`
+	InstanceState  string `json:"instanceState,omitempty"`
+	AgentState     string `json:"agentState,omitempty"`
+	PublicAddress  string `json:"publicAddress,omitempty"`
+	PrivateAddress string `json:"privateAddress,omitempty"`
+}
+
+type topologyELB struct {
+	Name      string   `json:"name"`
+	Addr      string   `json:"addr,omitempty"`
+	Instances []string `json:"instances,omitempty"`
+}
+
+type topology struct {
+	AppName   string            `json:"appName"`
+	Units     []topologyUnit    `json:"units"`
+	Machines  []topologyMachine `json:"machines"`
+	ELB       *topologyELB      `json:"elb,omitempty"`
+	Relations []string          `json:"relations"`
+}
+
+// Topology exports the app's topology — units, machines, load balancer and
+// relations — as a JSON document for UI graphs and external tooling. The
+// view is assembled from the units collection plus a single scoped
+// "juju status" call.
+func (p *jujuProvisioner) Topology(app provision.App) ([]byte, error) {
+	insts, err := p.appInstances(app.GetName())
+	if err != nil {
+		return nil, err
+	}
+	serviceName, err := jujuServiceName(app.GetName())
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	args := append(environmentArgs(appEnvironment(app)), "status", serviceName)
+	err = execWithTimeout(statusTimeout(), &buf, &buf, args...)
+	if err != nil {
+		return nil, &provision.Error{Reason: buf.String(), Err: err}
+	}
+	output, err := parseStatus(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	topo := topology{
+		AppName:   app.GetName(),
+		Units:     make([]topologyUnit, 0, len(insts)),
+		Relations: []string{},
+	}
+	machines := make(map[int]struct{})
+	for _, inst := range insts {
+		topo.Units = append(topo.Units, topologyUnit{
+			Name:      inst.UnitName,
+			Machine:   inst.Machine,
+			Container: inst.Container,
+			Status:    inst.Status,
+			ELBState:  inst.ELBState,
+		})
+		machines[inst.Machine] = struct{}{}
+	}
+	sort.Slice(topo.Units, func(i, j int) bool { return topo.Units[i].Name < topo.Units[j].Name })
+	topo.Machines = make([]topologyMachine, 0, len(machines))
+	for number := range machines {
+		machine := output.Machines[number]
+		topo.Machines = append(topo.Machines, topologyMachine{
+			Number:         number,
+			InstanceID:     machine.InstanceID,
+			InstanceState:  machine.InstanceState,
+			AgentState:     machine.AgentState,
+			PublicAddress:  machine.DNSName,
+			PrivateAddress: machine.PrivateDNSName,
+		})
+	}
+	sort.Slice(topo.Machines, func(i, j int) bool { return topo.Machines[i].Number < topo.Machines[j].Number })
+	if p.elbSupport() {
+		desc, err := p.LoadBalancer().Describe(app)
+		if err != nil && err != ErrLoadBalancerNotFound {
+			return nil, err
+		}
+		if err == nil {
+			lb := topologyELB{Name: app.GetName()}
+			if desc.DNSName != nil {
+				lb.Addr = *desc.DNSName
+			}
+			for _, lbInst := range desc.Instances {
+				if lbInst.InstanceId != nil {
+					lb.Instances = append(lb.Instances, *lbInst.InstanceId)
+				}
+			}
+			sort.Strings(lb.Instances)
+			topo.ELB = &lb
+		}
+	}
+	relations, err := appRelations(app.GetName())
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range relations {
+		topo.Relations = append(topo.Relations, rel.Remote)
+	}
+	sort.Strings(topo.Relations)
+	return json.Marshal(topo)
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"encoding/json"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/exec/exectest"
+	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *S) TestTopology(c *check.C) {
+	server := s.startELBServer()
+	defer server.close()
+	server.dnsNames["lostkeys"] = "lostkeys.us-east-1.elb.amazonaws.com"
+	server.instances["lostkeys"] = []string{"i-00000zz6", "i-00000zz5"}
+	config.Set("juju:use-elb", true)
+	defer config.Unset("juju:use-elb")
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {[]byte(diagnoseOutput)}}}
+	execut = &fexec
+	s.addInstances(c,
+		instance{
+			UnitName: "lostkeys/0", AppName: "lostkeys", Machine: 0,
+			InstanceID: "i-00000zz5",
+			Status:     provision.StatusStarted.String(),
+			ELBState:   "InService",
+		},
+		instance{
+			UnitName: "lostkeys/1", AppName: "lostkeys", Machine: 1,
+			InstanceID: "i-00000zz6",
+			Status:     provision.StatusStarted.String(),
+		},
+	)
+	relColl, err := relationsCollection()
+	c.Assert(err, check.IsNil)
+	defer relColl.Close()
+	err = relColl.Insert(relation{ID: relationID("lostkeys", "mysql"), App: "lostkeys", Remote: "mysql"})
+	c.Assert(err, check.IsNil)
+	app := provisiontest.NewFakeApp("lostkeys", "python", 2)
+	p := &jujuProvisioner{}
+	data, err := p.Topology(app)
+	c.Assert(err, check.IsNil)
+	var topo topology
+	err = json.Unmarshal(data, &topo)
+	c.Assert(err, check.IsNil)
+	c.Assert(topo.AppName, check.Equals, "lostkeys")
+	c.Assert(topo.Units, check.DeepEquals, []topologyUnit{
+		{Name: "lostkeys/0", Machine: 0, Status: "started", ELBState: "InService"},
+		{Name: "lostkeys/1", Machine: 1, Status: "started"},
+	})
+	c.Assert(topo.Machines, check.DeepEquals, []topologyMachine{
+		{
+			Number: 0, InstanceID: "i-00000zz5", InstanceState: "running", AgentState: "running",
+			PublicAddress: "lost0.public.amazonaws.com", PrivateAddress: "lost0.private.internal",
+		},
+		{
+			Number: 1, InstanceID: "i-00000zz6", InstanceState: "running", AgentState: "running",
+			PublicAddress: "lost1.public.amazonaws.com", PrivateAddress: "lost1.private.internal",
+		},
+	})
+	c.Assert(topo.ELB, check.NotNil)
+	c.Assert(topo.ELB.Addr, check.Equals, "lostkeys.us-east-1.elb.amazonaws.com")
+	c.Assert(topo.ELB.Instances, check.DeepEquals, []string{"i-00000zz5", "i-00000zz6"})
+	c.Assert(topo.Relations, check.DeepEquals, []string{"mysql"})
+}
+
+func (s *S) TestTopologyWithoutELB(c *check.C) {
+	fexec := exectest.FakeExecutor{Output: map[string][][]byte{"*": {[]byte(diagnoseOutput)}}}
+	execut = &fexec
+	s.addInstances(c, instance{
+		UnitName: "lostkeys/0", AppName: "lostkeys", Machine: 0,
+		Status: provision.StatusStarted.String(),
+	})
+	app := provisiontest.NewFakeApp("lostkeys", "python", 1)
+	p := &jujuProvisioner{}
+	data, err := p.Topology(app)
+	c.Assert(err, check.IsNil)
+	var topo topology
+	err = json.Unmarshal(data, &topo)
+	c.Assert(err, check.IsNil)
+	c.Assert(topo.ELB, check.IsNil)
+	c.Assert(topo.Relations, check.DeepEquals, []string{})
+}
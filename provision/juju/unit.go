@@ -0,0 +1,76 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"github.com/tsuru/tsuru/provision"
+)
+
+// UnitJSON wraps a provision.Unit together with the juju-specific details
+// tracked in the units collection — machine, container, instance type and
+// ELB health — so the API can serialize both consistently in a single flat
+// object. The wrapped unit keeps its own field names for backward
+// compatibility; the juju fields are additions, omitted when empty.
+type UnitJSON struct {
+	provision.Unit
+	Machine        int    `json:"Machine,omitempty"`
+	Container      string `json:"Container,omitempty"`
+	InstanceType   string `json:"InstanceType,omitempty"`
+	Zone           string `json:"Zone,omitempty"`
+	ELBState       string `json:"ELBState,omitempty"`
+	ELBReasonCode  string `json:"ELBReasonCode,omitempty"`
+	ELBDescription string `json:"ELBDescription,omitempty"`
+}
+
+// newUnitJSON pairs a unit reported by status collection with its instance
+// document.
+func newUnitJSON(unit provision.Unit, inst instance) UnitJSON {
+	return UnitJSON{
+		Unit:           unit,
+		Machine:        inst.Machine,
+		Container:      inst.Container,
+		InstanceType:   inst.InstanceType,
+		Zone:           inst.Zone,
+		ELBState:       inst.ELBState,
+		ELBReasonCode:  inst.ELBReasonCode,
+		ELBDescription: inst.ELBDescription,
+	}
+}
+
+func (u *UnitJSON) MarshalJSON() ([]byte, error) {
+	unit := u.Unit
+	if unit.Address == nil {
+		// provision.Unit's marshaler splits the address unconditionally, and
+		// juju units don't carry one.
+		unit.Address = &url.URL{}
+	}
+	data, err := json.Marshal(&unit)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]interface{}
+	if err = json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	if u.Machine != 0 {
+		obj["Machine"] = u.Machine
+	}
+	for key, value := range map[string]string{
+		"Container":      u.Container,
+		"InstanceType":   u.InstanceType,
+		"Zone":           u.Zone,
+		"ELBState":       u.ELBState,
+		"ELBReasonCode":  u.ELBReasonCode,
+		"ELBDescription": u.ELBDescription,
+	} {
+		if value != "" {
+			obj[key] = value
+		}
+	}
+	return json.Marshal(obj)
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"encoding/json"
+
+	"github.com/tsuru/tsuru/provision"
+	check "gopkg.in/check.v1"
+)
+
+func (s *S) TestUnitJSONMarshal(c *check.C) {
+	unit := newUnitJSON(provision.Unit{
+		ID:      "carol/0",
+		Name:    "carol/0",
+		AppName: "carol",
+		Type:    "python",
+		IP:      "192.168.0.10",
+		Status:  provision.StatusStarted,
+	}, instance{
+		UnitName:       "carol/0",
+		AppName:        "carol",
+		Machine:        4,
+		Container:      "4/lxc/0",
+		InstanceType:   "m1.large",
+		Zone:           "us-east-1b",
+		ELBState:       "OutOfService",
+		ELBReasonCode:  "Instance",
+		ELBDescription: "Instance has failed at least the UnhealthyThreshold number of health checks consecutively.",
+	})
+	data, err := json.Marshal(&unit)
+	c.Assert(err, check.IsNil)
+	var obj map[string]interface{}
+	err = json.Unmarshal(data, &obj)
+	c.Assert(err, check.IsNil)
+	c.Assert(obj["ID"], check.Equals, "carol/0")
+	c.Assert(obj["AppName"], check.Equals, "carol")
+	c.Assert(obj["Status"], check.Equals, "started")
+	c.Assert(obj["IP"], check.Equals, "192.168.0.10")
+	c.Assert(obj["Machine"], check.Equals, float64(4))
+	c.Assert(obj["Container"], check.Equals, "4/lxc/0")
+	c.Assert(obj["InstanceType"], check.Equals, "m1.large")
+	c.Assert(obj["Zone"], check.Equals, "us-east-1b")
+	c.Assert(obj["ELBState"], check.Equals, "OutOfService")
+	c.Assert(obj["ELBReasonCode"], check.Equals, "Instance")
+}
+
+func (s *S) TestUnitJSONMarshalOmitsEmptyFields(c *check.C) {
+	unit := newUnitJSON(provision.Unit{ID: "carol/0", AppName: "carol"}, instance{})
+	data, err := json.Marshal(&unit)
+	c.Assert(err, check.IsNil)
+	var obj map[string]interface{}
+	err = json.Unmarshal(data, &obj)
+	c.Assert(err, check.IsNil)
+	for _, key := range []string{"Machine", "Container", "InstanceType", "Zone", "ELBState", "ELBReasonCode", "ELBDescription"} {
+		_, ok := obj[key]
+		c.Assert(ok, check.Equals, false)
+	}
+	c.Assert(obj["ID"], check.Equals, "carol/0")
+}
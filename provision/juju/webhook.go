@@ -0,0 +1,73 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/log"
+	tsuruNet "github.com/tsuru/tsuru/net"
+)
+
+// statusChange is the JSON body POSTed to the status webhook whenever status
+// collection detects that a unit changed status.
+type statusChange struct {
+	Unit      string `json:"unit"`
+	App       string `json:"app"`
+	Machine   int    `json:"machine"`
+	OldStatus string `json:"old_status"`
+	NewStatus string `json:"new_status"`
+}
+
+const statusWebhookAttempts = 3
+
+// statusWebhookRetryInterval is how long notifyStatusChange waits between
+// delivery attempts. It's a variable so tests don't have to sleep.
+var statusWebhookRetryInterval = 500 * time.Millisecond
+
+// notifyStatusChange delivers the status change to the URL configured in
+// juju:status-webhook, if any, so external dashboards can track unit statuses
+// without polling. Delivery is attempted a bounded number of times; failures
+// are logged and never propagate, as losing a notification must not affect
+// status collection.
+func notifyStatusChange(change statusChange) {
+	url, err := config.GetString("juju:status-webhook")
+	if err != nil || url == "" {
+		return
+	}
+	body, err := json.Marshal(change)
+	if err != nil {
+		log.Errorf("juju: failed to marshal status change of unit %q: %s", change.Unit, err)
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err = postStatusChange(url, body)
+		if err == nil {
+			return
+		}
+		if attempt >= statusWebhookAttempts {
+			log.Errorf("juju: failed to deliver status change of unit %q after %d attempts: %s", change.Unit, attempt, err)
+			return
+		}
+		time.Sleep(statusWebhookRetryInterval)
+	}
+}
+
+func postStatusChange(url string, body []byte) error {
+	resp, err := tsuruNet.Dial15Full60ClientNoKeepAlive.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package juju
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/tsuru/provision"
+	check "gopkg.in/check.v1"
+)
+
+type webhookServer struct {
+	srv         *httptest.Server
+	mut         sync.Mutex
+	bodies      []statusChange
+	fails       int
+	oldInterval time.Duration
+}
+
+func (w *webhookServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	if w.fails > 0 {
+		w.fails--
+		http.Error(rw, "try again", http.StatusInternalServerError)
+		return
+	}
+	var change statusChange
+	json.NewDecoder(r.Body).Decode(&change)
+	w.bodies = append(w.bodies, change)
+}
+
+func (w *webhookServer) changes() []statusChange {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	return append([]statusChange(nil), w.bodies...)
+}
+
+func (s *S) startWebhookServer(c *check.C) *webhookServer {
+	w := &webhookServer{oldInterval: statusWebhookRetryInterval}
+	w.srv = httptest.NewServer(w)
+	config.Set("juju:status-webhook", w.srv.URL)
+	statusWebhookRetryInterval = 0
+	return w
+}
+
+func (w *webhookServer) close() {
+	config.Unset("juju:status-webhook")
+	statusWebhookRetryInterval = w.oldInterval
+	w.srv.Close()
+}
+
+func (s *S) TestSaveInstancesNotifiesStatusWebhook(c *check.C) {
+	srv := s.startWebhookServer(c)
+	defer srv.close()
+	s.addInstances(c, instance{UnitName: "umbriel/0", AppName: "umbriel", Machine: 3, Status: StatusCreating.String()})
+	p := &jujuProvisioner{}
+	err := p.saveInstances([]instance{{UnitName: "umbriel/0", AppName: "umbriel", Machine: 3, Status: provision.StatusStarted.String()}})
+	c.Assert(err, check.IsNil)
+	err = p.Shutdown(5 * time.Second)
+	c.Assert(err, check.IsNil)
+	changes := srv.changes()
+	c.Assert(changes, check.HasLen, 1)
+	c.Assert(changes[0], check.DeepEquals, statusChange{
+		Unit:      "umbriel/0",
+		App:       "umbriel",
+		Machine:   3,
+		OldStatus: StatusCreating.String(),
+		NewStatus: provision.StatusStarted.String(),
+	})
+}
+
+func (s *S) TestSaveInstancesSkipsWebhookWhenUnchanged(c *check.C) {
+	srv := s.startWebhookServer(c)
+	defer srv.close()
+	s.addInstances(c, instance{UnitName: "umbriel/0", AppName: "umbriel", Machine: 3, Status: provision.StatusStarted.String()})
+	p := &jujuProvisioner{}
+	err := p.saveInstances([]instance{{UnitName: "umbriel/0", AppName: "umbriel", Machine: 3, Status: provision.StatusStarted.String()}})
+	c.Assert(err, check.IsNil)
+	err = p.Shutdown(5 * time.Second)
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.changes(), check.HasLen, 0)
+}
+
+func (s *S) TestSaveInstancesConcurrentStatusChangeNotifiesOnce(c *check.C) {
+	srv := s.startWebhookServer(c)
+	defer srv.close()
+	s.addInstances(c, instance{UnitName: "umbriel/0", AppName: "umbriel", Machine: 3, Status: StatusCreating.String()})
+	p := &jujuProvisioner{}
+	insts := []instance{{UnitName: "umbriel/0", AppName: "umbriel", Machine: 3, Status: provision.StatusStarted.String()}}
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = p.saveInstances(insts)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		c.Assert(err, check.IsNil)
+	}
+	err := p.Shutdown(5 * time.Second)
+	c.Assert(err, check.IsNil)
+	// Only one of the racing collections wins the conditional findAndModify;
+	// the others find the status already applied and stay quiet. A
+	// find-then-update would have every one of them read the old status and
+	// notify.
+	changes := srv.changes()
+	c.Assert(changes, check.HasLen, 1)
+	c.Assert(changes[0].OldStatus, check.Equals, StatusCreating.String())
+	c.Assert(changes[0].NewStatus, check.Equals, provision.StatusStarted.String())
+}
+
+func (s *S) TestNotifyStatusChangeRetries(c *check.C) {
+	srv := s.startWebhookServer(c)
+	defer srv.close()
+	srv.fails = 2
+	notifyStatusChange(statusChange{Unit: "umbriel/0", App: "umbriel", NewStatus: "started"})
+	changes := srv.changes()
+	c.Assert(changes, check.HasLen, 1)
+	c.Assert(changes[0].Unit, check.Equals, "umbriel/0")
+}
+
+func (s *S) TestNotifyStatusChangeGivesUp(c *check.C) {
+	srv := s.startWebhookServer(c)
+	defer srv.close()
+	srv.fails = statusWebhookAttempts
+	notifyStatusChange(statusChange{Unit: "umbriel/0", App: "umbriel", NewStatus: "started"})
+	c.Assert(srv.changes(), check.HasLen, 0)
+}
+
+func (s *S) TestNotifyStatusChangeNoWebhookConfigured(c *check.C) {
+	notifyStatusChange(statusChange{Unit: "umbriel/0", App: "umbriel", NewStatus: "started"})
+}
+
+func (s *S) TestFrozenInstanceSkipsWebhook(c *check.C) {
+	srv := s.startWebhookServer(c)
+	defer srv.close()
+	s.addInstances(c, instance{UnitName: "umbriel/0", AppName: "umbriel", Machine: 3, Status: StatusCreating.String()})
+	p := &jujuProvisioner{}
+	err := p.Freeze("umbriel")
+	c.Assert(err, check.IsNil)
+	err = p.saveInstances([]instance{{UnitName: "umbriel/0", AppName: "umbriel", Machine: 3, Status: provision.StatusStarted.String()}})
+	c.Assert(err, check.IsNil)
+	err = p.Shutdown(5 * time.Second)
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.changes(), check.HasLen, 0)
+	c.Assert(s.getInstance(c, "umbriel/0").Status, check.Equals, provision.StatusStarted.String())
+	err = p.Unfreeze("umbriel")
+	c.Assert(err, check.IsNil)
+	err = p.saveInstances([]instance{{UnitName: "umbriel/0", AppName: "umbriel", Machine: 3, Status: StatusDown.String()}})
+	c.Assert(err, check.IsNil)
+	err = p.Shutdown(5 * time.Second)
+	c.Assert(err, check.IsNil)
+	c.Assert(srv.changes(), check.HasLen, 1)
+}
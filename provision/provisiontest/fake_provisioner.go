@@ -383,6 +383,8 @@ type FakeProvisioner struct {
 	mut            sync.RWMutex
 	execs          map[string][]provision.ExecOptions
 	execsMut       sync.Mutex
+	calls          []string
+	callsMut       sync.Mutex
 	nodes          map[string]FakeNode
 	nodeContainers map[string]int
 }
@@ -398,6 +400,22 @@ func NewFakeProvisioner() *FakeProvisioner {
 	return &p
 }
 
+func (p *FakeProvisioner) recordCall(method string) {
+	p.callsMut.Lock()
+	defer p.callsMut.Unlock()
+	p.calls = append(p.calls, method)
+}
+
+// Calls returns the name of every recorded method called on the provisioner,
+// in order. Only methods that go through recordCall are tracked.
+func (p *FakeProvisioner) Calls() []string {
+	p.callsMut.Lock()
+	defer p.callsMut.Unlock()
+	calls := make([]string, len(p.calls))
+	copy(calls, p.calls)
+	return calls
+}
+
 func (p *FakeProvisioner) getError(method string) error {
 	select {
 	case fail := <-p.failures:
@@ -844,6 +862,10 @@ func (p *FakeProvisioner) Reset() {
 	p.execs = make(map[string][]provision.ExecOptions)
 	p.execsMut.Unlock()
 
+	p.callsMut.Lock()
+	p.calls = nil
+	p.callsMut.Unlock()
+
 	p.mut.Lock()
 	p.nodes = make(map[string]FakeNode)
 	p.mut.Unlock()
@@ -920,6 +942,7 @@ func (p *FakeProvisioner) CleanImage(appName, imgName string) error {
 }
 
 func (p *FakeProvisioner) Provision(app provision.App) error {
+	p.recordCall("Provision")
 	if err := p.getError("Provision"); err != nil {
 		return err
 	}
@@ -982,6 +1005,7 @@ func (p *FakeProvisioner) Destroy(app provision.App) error {
 }
 
 func (p *FakeProvisioner) AddUnits(app provision.App, n uint, process string, version appTypes.AppVersion, w io.Writer) error {
+	p.recordCall("AddUnits")
 	_, err := p.AddUnitsToNode(app, n, process, w, "")
 	return err
 }
@@ -1046,6 +1070,7 @@ func (p *FakeProvisioner) AddUnitsToNode(app provision.App, n uint, process stri
 }
 
 func (p *FakeProvisioner) RemoveUnits(app provision.App, n uint, process string, version appTypes.AppVersion, w io.Writer) error {
+	p.recordCall("RemoveUnits")
 	if err := p.getError("RemoveUnits"); err != nil {
 		return err
 	}
@@ -1085,6 +1110,48 @@ func (p *FakeProvisioner) RemoveUnits(app provision.App, n uint, process string,
 	return nil
 }
 
+// RemoveUnit removes one specific unit of the app, by ID.
+func (p *FakeProvisioner) RemoveUnit(app provision.App, unitID string) error {
+	p.recordCall("RemoveUnit")
+	if err := p.getError("RemoveUnit"); err != nil {
+		return err
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	pApp, ok := p.apps[app.GetName()]
+	if !ok {
+		return errNotProvisioned
+	}
+	for i, u := range pApp.units {
+		if u.ID == unitID {
+			err := routertest.FakeRouter.RemoveRoutes(app.GetName(), []*url.URL{u.Address})
+			if err != nil {
+				return err
+			}
+			pApp.units = append(pApp.units[:i], pApp.units[i+1:]...)
+			pApp.unitLen = len(pApp.units)
+			p.apps[app.GetName()] = pApp
+			return nil
+		}
+	}
+	return &provision.UnitNotFoundError{ID: unitID}
+}
+
+// CollectStatus returns the current units of every provisioned app.
+func (p *FakeProvisioner) CollectStatus() ([]provision.Unit, error) {
+	p.recordCall("CollectStatus")
+	if err := p.getError("CollectStatus"); err != nil {
+		return nil, err
+	}
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	var units []provision.Unit
+	for _, a := range p.apps {
+		units = append(units, a.units...)
+	}
+	return units, nil
+}
+
 func (p *FakeProvisioner) AddUnit(app provision.App, unit provision.Unit) {
 	p.mut.Lock()
 	defer p.mut.Unlock()
@@ -1269,6 +1336,7 @@ func (p *FakeProvisioner) RegisterUnit(a provision.App, unitId string, customDat
 }
 
 func (p *FakeProvisioner) ExecuteCommand(opts provision.ExecOptions) error {
+	p.recordCall("ExecuteCommand")
 	p.execsMut.Lock()
 	defer p.execsMut.Unlock()
 	var err error
@@ -654,6 +654,79 @@ func (s *S) TestRemoveUnits(c *check.C) {
 	c.Assert(routertest.FakeRouter.HasRoute(app.GetName(), oldUnits[3].Address.String()), check.Equals, true)
 }
 
+func (s *S) TestRemoveUnit(c *check.C) {
+	app := NewFakeApp("hemispheres", "rush", 0)
+	p := NewFakeProvisioner()
+	err := p.Provision(app)
+	c.Assert(err, check.IsNil)
+	err = p.AddUnits(app, 3, "web", nil, nil)
+	c.Assert(err, check.IsNil)
+	oldUnits := p.GetUnits(app)
+	err = p.RemoveUnit(app, "hemispheres-1")
+	c.Assert(err, check.IsNil)
+	units := p.GetUnits(app)
+	c.Assert(units, check.HasLen, 2)
+	c.Assert(units[0].ID, check.Equals, "hemispheres-0")
+	c.Assert(units[1].ID, check.Equals, "hemispheres-2")
+	c.Assert(routertest.FakeRouter.HasRoute(app.GetName(), oldUnits[1].Address.String()), check.Equals, false)
+	c.Assert(routertest.FakeRouter.HasRoute(app.GetName(), oldUnits[2].Address.String()), check.Equals, true)
+}
+
+func (s *S) TestRemoveUnitNotFound(c *check.C) {
+	app := NewFakeApp("hemispheres", "rush", 0)
+	p := NewFakeProvisioner()
+	err := p.Provision(app)
+	c.Assert(err, check.IsNil)
+	err = p.RemoveUnit(app, "hemispheres-9")
+	c.Assert(err, check.NotNil)
+	e, ok := err.(*provision.UnitNotFoundError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(e.ID, check.Equals, "hemispheres-9")
+}
+
+func (s *S) TestRemoveUnitNotProvisioned(c *check.C) {
+	app := NewFakeApp("hemispheres", "rush", 0)
+	p := NewFakeProvisioner()
+	err := p.RemoveUnit(app, "hemispheres-0")
+	c.Assert(err, check.Equals, errNotProvisioned)
+}
+
+func (s *S) TestCollectStatus(c *check.C) {
+	app := NewFakeApp("hemispheres", "rush", 0)
+	p := NewFakeProvisioner()
+	err := p.Provision(app)
+	c.Assert(err, check.IsNil)
+	err = p.AddUnits(app, 2, "web", nil, nil)
+	c.Assert(err, check.IsNil)
+	units, err := p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	c.Assert(units, check.HasLen, 2)
+}
+
+func (s *S) TestCollectStatusFailure(c *check.C) {
+	p := NewFakeProvisioner()
+	p.PrepareFailure("CollectStatus", errors.New("something went wrong"))
+	units, err := p.CollectStatus()
+	c.Assert(err, check.ErrorMatches, "something went wrong")
+	c.Assert(units, check.IsNil)
+}
+
+func (s *S) TestCalls(c *check.C) {
+	app := NewFakeApp("hemispheres", "rush", 0)
+	p := NewFakeProvisioner()
+	err := p.Provision(app)
+	c.Assert(err, check.IsNil)
+	err = p.AddUnits(app, 2, "web", nil, nil)
+	c.Assert(err, check.IsNil)
+	err = p.RemoveUnit(app, "hemispheres-0")
+	c.Assert(err, check.IsNil)
+	_, err = p.CollectStatus()
+	c.Assert(err, check.IsNil)
+	c.Assert(p.Calls(), check.DeepEquals, []string{"Provision", "AddUnits", "RemoveUnit", "CollectStatus"})
+	p.Reset()
+	c.Assert(p.Calls(), check.HasLen, 0)
+}
+
 func (s *S) TestRemoveUnitsDifferentProcesses(c *check.C) {
 	app := NewFakeApp("hemispheres", "rush", 0)
 	p := NewFakeProvisioner()